@@ -0,0 +1,163 @@
+// Package batch reads the batches Alexandria writes to its bucket.
+//
+// Each batch is an object at inp/{kind}/batch-{id}.jsonl holding one JSON
+// encoded Entry per line. Batches may also be stored gzip or zstd
+// compressed, optionally with a .gz or .zst suffix on the key; NewReader
+// detects this from the content.
+package batch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/google/uuid"
+)
+
+// KeyPrefix is where batches are stored in the bucket.
+const KeyPrefix = "inp/"
+
+// Entry is a single upload as stored in a batch.
+type Entry struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	LogID string `json:"logID"`
+
+	// Data is the uploaded log lines, base64 encoded. Use Bytes or Lines to
+	// read it.
+	Data string `json:"data"`
+
+	// Meta describes the program that produced Data, when the client sent it.
+	Meta *alexandria.Metadata `json:"meta,omitempty"`
+
+	// Times holds the time of each line in Data for protocol v2 uploads.
+	Times []time.Time `json:"times,omitempty"`
+
+	// Dropped is how many lines the client lost before this upload.
+	Dropped uint64 `json:"dropped,omitempty"`
+
+	// Schema is the version of the kind's schema the lines were validated
+	// against, or empty if they weren't.
+	Schema string `json:"schema,omitempty"`
+
+	// Invalid holds the indices of the lines that didn't match Schema.
+	Invalid []int `json:"invalid,omitempty"`
+}
+
+// Line is one log line of an entry.
+type Line struct {
+	// Time is when the client recorded the line, or the zero time if the
+	// upload didn't say.
+	Time time.Time
+	Data []byte
+
+	// Invalid is set if the line didn't match the entry's schema.
+	Invalid bool
+}
+
+// SetData stores data as the entry's log lines.
+func (e *Entry) SetData(data []byte) {
+	e.Data = base64.StdEncoding.EncodeToString(data)
+}
+
+// Bytes returns the decoded log lines of the entry.
+func (e Entry) Bytes() ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(e.Data)
+	if err != nil {
+		return nil, fmt.Errorf("batch: can't decode data of entry %s: %w", e.ID, err)
+	}
+	return data, nil
+}
+
+// Lines splits the entry's data into lines without their trailing newlines.
+// When the entry has a time for every line, each Line carries it. Lines
+// listed in Invalid are marked as such.
+func (e Entry) Lines() ([]Line, error) {
+	data, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	raw := bytes.Split(data, []byte("\n"))
+	result := make([]Line, len(raw))
+	for i, line := range raw {
+		result[i].Data = line
+		if len(e.Times) == len(raw) {
+			result[i].Time = e.Times[i]
+		}
+	}
+
+	for _, i := range e.Invalid {
+		if i >= 0 && i < len(result) {
+			result[i].Invalid = true
+		}
+	}
+
+	return result, nil
+}
+
+// Key returns the object key of the batch with the given kind and ID.
+func Key(kind, id string) string {
+	return fmt.Sprintf("%s%s/batch-%s.jsonl", KeyPrefix, kind, id)
+}
+
+// ParseKey returns the kind of the batch stored at key, or false if key
+// isn't a batch.
+func ParseKey(key string) (kind string, ok bool) {
+	rest, ok := strings.CutPrefix(key, KeyPrefix)
+	if !ok {
+		return "", false
+	}
+
+	kind, name, ok := strings.Cut(rest, "/")
+	if !ok || kind == "" || !strings.HasPrefix(name, "batch-") {
+		return "", false
+	}
+
+	for _, suffix := range []string{".jsonl", ".jsonl.gz", ".jsonl.zst"} {
+		if strings.HasSuffix(name, suffix) {
+			return kind, true
+		}
+	}
+
+	return "", false
+}
+
+// KeyAfter returns a key that sorts before the key of every batch of kind
+// whose ID was made at or after t, for use as the StartAfter of a listing.
+// Batch IDs are UUIDv7s, which start with the millisecond they were made in
+// fixed-width hex, so the batches of a kind are listed in the order they
+// were made.
+func KeyAfter(kind string, t time.Time) string {
+	ms := t.UnixMilli()
+	return fmt.Sprintf("%s%s/batch-%08x-%04x", KeyPrefix, kind, ms>>16, ms&0xffff)
+}
+
+// KeyTime returns when the ID of the batch at key was made, or false if it
+// isn't a UUIDv7.
+func KeyTime(key string) (time.Time, bool) {
+	if _, ok := ParseKey(key); !ok {
+		return time.Time{}, false
+	}
+
+	_, name, _ := strings.Cut(strings.TrimPrefix(key, KeyPrefix), "/batch-")
+	id, _, _ := strings.Cut(name, ".")
+	u, err := uuid.Parse(id)
+	if err != nil || u.Version() != 7 {
+		return time.Time{}, false
+	}
+
+	var ms int64
+	for _, b := range u[:6] {
+		ms = ms<<8 | int64(b)
+	}
+	return time.UnixMilli(ms).UTC(), true
+}
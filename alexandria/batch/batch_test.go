@@ -0,0 +1,225 @@
+package batch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+func testEntries() []Entry {
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	a := Entry{ID: "1", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"}
+	a.SetData([]byte("first\nsecond\n"))
+
+	b := Entry{ID: "2", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Times: []time.Time{t0}, Dropped: 4}
+	b.SetData([]byte("third\n"))
+
+	return []Entry{a, b}
+}
+
+func encodeJSONL(t *testing.T, entries []Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestEntries(t *testing.T) {
+	plain := encodeJSONL(t, testEntries())
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll(plain, nil)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "plain", data: plain},
+		{name: "gzip", data: gz.Bytes()},
+		{name: "zstd", data: zst},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compressed(tt.data); got != (tt.name != "plain") {
+				t.Errorf("Compressed returned %v", got)
+			}
+
+			var got []Entry
+			for e, err := range Entries(bytes.NewReader(tt.data)) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e)
+			}
+
+			want := testEntries()
+			if len(got) != len(want) {
+				t.Fatalf("expected %d entries, got %d", len(want), len(got))
+			}
+			for i := range got {
+				if got[i].ID != want[i].ID || got[i].Data != want[i].Data || got[i].Dropped != want[i].Dropped {
+					t.Errorf("entry %d: expected %+v, got %+v", i, want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEntries_Empty(t *testing.T) {
+	for e, err := range Entries(strings.NewReader("")) {
+		t.Errorf("unexpected entry %+v, %v", e, err)
+	}
+}
+
+func TestReader_Error(t *testing.T) {
+	r, err := NewReader(strings.NewReader(`{"id":"1"}` + "\n{nope\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("first entry: %v", err)
+	}
+
+	if _, err := r.Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("expected a decode error, got %v", err)
+	}
+
+	n := 0
+	for _, err := range Entries(strings.NewReader("{nope")) {
+		n++
+		if err == nil {
+			t.Error("expected an error")
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected iteration to stop after the error, got %d items", n)
+	}
+}
+
+func TestEntry_Lines(t *testing.T) {
+	entries := testEntries()
+
+	lines, err := entries[0].Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || string(lines[0].Data) != "first" || string(lines[1].Data) != "second" {
+		t.Errorf("unexpected lines %+v", lines)
+	}
+	if !lines[0].Time.IsZero() {
+		t.Errorf("expected no time for a v1 upload, got %v", lines[0].Time)
+	}
+
+	lines, err = entries[1].Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !lines[0].Time.Equal(entries[1].Times[0]) {
+		t.Errorf("expected line to carry its time, got %+v", lines)
+	}
+
+	invalid := Entry{Invalid: []int{1, 5}}
+	invalid.SetData([]byte("first\nsecond\n"))
+	lines, err = invalid.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines[0].Invalid || !lines[1].Invalid {
+		t.Errorf("expected only the second line to be invalid, got %+v", lines)
+	}
+
+	if lines, _ := (Entry{}).Lines(); lines != nil {
+		t.Errorf("expected no lines for an empty entry, got %+v", lines)
+	}
+
+	if _, err := (Entry{Data: "!!"}).Lines(); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		kind string
+		ok   bool
+	}{
+		{key: Key("techaro.anubis", "0198d7c4"), kind: "techaro.anubis", ok: true},
+		{key: "inp/techaro.anubis/batch-1.jsonl.gz", kind: "techaro.anubis", ok: true},
+		{key: "inp/techaro.anubis/batch-1.jsonl.zst", kind: "techaro.anubis", ok: true},
+		{key: "inp/techaro.anubis/other.jsonl"},
+		{key: "logs/techaro.anubis/batch-1.jsonl"},
+		{key: "inp/batch-1.jsonl"},
+		{key: "inp//batch-1.jsonl"},
+	}
+
+	for _, tt := range tests {
+		kind, ok := ParseKey(tt.key)
+		if kind != tt.kind || ok != tt.ok {
+			t.Errorf("ParseKey(%q) = %q, %v; want %q, %v", tt.key, kind, ok, tt.kind, tt.ok)
+		}
+	}
+}
+
+func TestKeyAfter(t *testing.T) {
+	made := time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	var keys []string
+	for _, at := range []time.Time{made.Add(-time.Millisecond), made, made.Add(time.Millisecond), made.Add(24 * time.Hour)} {
+		id, err := uuid.NewV7FromReader(bytes.NewReader(make([]byte, 16)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms := at.UnixMilli()
+		for i := range 6 {
+			id[i] = byte(ms >> (40 - 8*i))
+		}
+		keys = append(keys, Key("techaro.anubis", id.String()))
+
+		got, ok := KeyTime(keys[len(keys)-1])
+		if !ok || !got.Equal(at) {
+			t.Errorf("KeyTime(%q) = %v, %v; want %v, true", keys[len(keys)-1], got, ok, at)
+		}
+	}
+
+	after := KeyAfter("techaro.anubis", made)
+	if keys[0] >= after {
+		t.Errorf("%q doesn't sort before %q", keys[0], after)
+	}
+	for _, key := range keys[1:] {
+		if key <= after {
+			t.Errorf("%q doesn't sort after %q", key, after)
+		}
+	}
+
+	for _, key := range []string{"inp/techaro.anubis/batch-1.jsonl", Key("techaro.anubis", uuid.NewString()), "inp/techaro.anubis/notes.txt"} {
+		if _, ok := KeyTime(key); ok {
+			t.Errorf("KeyTime(%q) = true, want false", key)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Compressed reports whether the batch starting with prefix is gzip or zstd
+// compressed. Each entry of an uncompressed batch is a line of its own, so
+// entries can be read by byte range.
+func Compressed(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, gzipMagic) || bytes.HasPrefix(prefix, zstdMagic)
+}
+
+// Reader reads entries from a batch one at a time.
+type Reader struct {
+	dec    *json.Decoder
+	closer func()
+	n      int
+}
+
+// NewReader returns a Reader for the batch in r, decompressing it if it is
+// gzip or zstd compressed. Close the Reader when done with it.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("batch: can't read: %w", err)
+	}
+
+	result := &Reader{closer: func() {}}
+	var src io.Reader = br
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("batch: can't decompress: %w", err)
+		}
+		src = gr
+		result.closer = func() { gr.Close() }
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("batch: can't decompress: %w", err)
+		}
+		src = zr
+		result.closer = zr.Close
+	}
+
+	result.dec = json.NewDecoder(src)
+	return result, nil
+}
+
+// Next returns the next entry in the batch, or io.EOF after the last one.
+func (r *Reader) Next() (Entry, error) {
+	var result Entry
+	if err := r.dec.Decode(&result); err != nil {
+		if errors.Is(err, io.EOF) {
+			return result, io.EOF
+		}
+		return result, fmt.Errorf("batch: can't decode entry %d: %w", r.n, err)
+	}
+
+	r.n++
+	return result, nil
+}
+
+// Close releases the decompressor, if any. It doesn't close the underlying
+// reader.
+func (r *Reader) Close() error {
+	r.closer()
+	return nil
+}
+
+// Entries iterates over the entries of the batch in r. Iteration stops after
+// the first error, which is yielded with a zero Entry.
+func Entries(r io.Reader) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		br, err := NewReader(r)
+		if err != nil {
+			yield(Entry{}, err)
+			return
+		}
+		defer br.Close()
+
+		for {
+			e, err := br.Next()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if !yield(e, err) || err != nil {
+				return
+			}
+		}
+	}
+}
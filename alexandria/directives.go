@@ -0,0 +1,115 @@
+package alexandria
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers and paths of the directives channel, which lets a server change how
+// a client ships logs for a logID without restarting it.
+const (
+	// HeaderDirectives is set on upload and poll responses to the JSON
+	// encoded Directives for the logID. Its absence doesn't end directives
+	// a client already applies: they last until they expire or a newer
+	// version replaces them.
+	HeaderDirectives = "X-Alexandria-Directives"
+
+	// HeaderDirectivesApplied is set on requests to the Version of the
+	// Directives the client is running with, or 0 if none.
+	HeaderDirectivesApplied = "X-Alexandria-Directives-Applied"
+
+	// DirectivesPath is where paused clients poll for directives, as
+	// GET DirectivesPath/{kind}/{logID}.
+	DirectivesPath = "/directives"
+)
+
+// Bounds on the flush interval a server can ask for.
+const (
+	MinFlushInterval = time.Second
+	MaxFlushInterval = 5 * time.Minute
+)
+
+// Directives are settings a server asks a client to use instead of its own
+// for a logID until they expire. Unset fields leave the client's settings as
+// they are.
+type Directives struct {
+	// Version increases every time the directives of a logID change, on
+	// every server, so clients can ignore directives older than the ones
+	// they apply.
+	Version int64     `json:"version"`
+	Expires time.Time `json:"expires"`
+
+	MinLevel   *slog.Level `json:"minLevel,omitempty"`
+	SampleRate *float64    `json:"sampleRate,omitempty"`
+
+	// FlushInterval is how often buffered lines are uploaded, in
+	// nanoseconds.
+	FlushInterval time.Duration `json:"flushInterval,omitempty"`
+
+	// Pause stops shipping lines. Paused clients poll DirectivesPath at
+	// their flush interval to learn when to resume.
+	Pause bool `json:"pause,omitempty"`
+}
+
+// Validate checks that d can be applied.
+func (d Directives) Validate() error {
+	if d.Version <= 0 {
+		return fmt.Errorf("alexandria: directives version must be positive, got %d", d.Version)
+	}
+	if d.SampleRate != nil && (*d.SampleRate < 0 || *d.SampleRate > 1) {
+		return fmt.Errorf("alexandria: sample rate must be between 0 and 1, got %v", *d.SampleRate)
+	}
+	if d.FlushInterval != 0 && (d.FlushInterval < MinFlushInterval || d.FlushInterval > MaxFlushInterval) {
+		return fmt.Errorf("alexandria: flush interval must be between %s and %s, got %s", MinFlushInterval, MaxFlushInterval, d.FlushInterval)
+	}
+	return nil
+}
+
+// empty reports whether d leaves every setting of the client as it is, as
+// servers send when directives are cleared.
+func (d Directives) empty() bool {
+	return d.MinLevel == nil && d.SampleRate == nil && d.FlushInterval == 0 && !d.Pause
+}
+
+// SetHeader writes d into h.
+func (d Directives) SetHeader(h http.Header) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	h.Set(HeaderDirectives, string(data))
+	return nil
+}
+
+// DirectivesFromHeader reads Directives from h. It returns nil if h carries
+// none.
+func DirectivesFromHeader(h http.Header) (*Directives, error) {
+	val := strings.TrimSpace(h.Get(HeaderDirectives))
+	if val == "" {
+		return nil, nil
+	}
+
+	var result Directives
+	if err := json.Unmarshal([]byte(val), &result); err != nil {
+		return nil, fmt.Errorf("alexandria: can't decode directives: %w", err)
+	}
+	if err := result.Validate(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// AppliedFromHeader reads the version of the directives a client reported
+// applying from h, or 0 if it reported none.
+func AppliedFromHeader(h http.Header) int64 {
+	v, err := strconv.ParseInt(strings.TrimSpace(h.Get(HeaderDirectivesApplied)), 10, 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
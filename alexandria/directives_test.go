@@ -0,0 +1,72 @@
+package alexandria
+
+import (
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDirectives_Header(t *testing.T) {
+	level := slog.LevelWarn
+	rate := 0.25
+	d := Directives{
+		Version:       7,
+		Expires:       time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC),
+		MinLevel:      &level,
+		SampleRate:    &rate,
+		FlushInterval: 30 * time.Second,
+		Pause:         true,
+	}
+
+	h := http.Header{}
+	if err := d.SetHeader(h); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DirectivesFromHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != d.Version || !got.Expires.Equal(d.Expires) || *got.MinLevel != level || *got.SampleRate != rate ||
+		got.FlushInterval != d.FlushInterval || !got.Pause {
+		t.Errorf("expected %+v, got %+v", d, got)
+	}
+
+	got, err = DirectivesFromHeader(http.Header{})
+	if got != nil || err != nil {
+		t.Errorf("expected no directives, got %+v, %v", got, err)
+	}
+}
+
+func TestDirectivesFromHeader_Invalid(t *testing.T) {
+	for _, val := range []string{
+		"nope",
+		`{"version":0}`,
+		`{"version":1,"sampleRate":1.5}`,
+		`{"version":1,"flushInterval":1000}`,
+		`{"version":1,"minLevel":"LOUD"}`,
+	} {
+		h := http.Header{}
+		h.Set(HeaderDirectives, val)
+		if _, err := DirectivesFromHeader(h); err == nil {
+			t.Errorf("%s: expected an error", val)
+		}
+	}
+}
+
+func TestAppliedFromHeader(t *testing.T) {
+	for val, expected := range map[string]int64{
+		"":     0,
+		"3":    3,
+		" 12 ": 12,
+		"-1":   0,
+		"nope": 0,
+	} {
+		h := http.Header{}
+		h.Set(HeaderDirectivesApplied, val)
+		if got := AppliedFromHeader(h); got != expected {
+			t.Errorf("%q: expected %d, got %d", val, expected, got)
+		}
+	}
+}
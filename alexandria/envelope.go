@@ -0,0 +1,164 @@
+package alexandria
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol versions and how servers advertise them.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// HeaderProtocols is set on upload responses to the comma-separated list
+	// of protocol versions the server accepts.
+	HeaderProtocols = "X-Alexandria-Protocols"
+
+	// IngestV2Path is where protocol v2 envelopes are POSTed.
+	IngestV2Path = "/v2/ingest"
+
+	ContentTypeJSON   = "application/json"
+	ContentTypeNDJSON = "application/x-ndjson"
+)
+
+// ErrEmptyEnvelope is returned when an envelope has no header.
+var ErrEmptyEnvelope = errors.New("alexandria: empty envelope")
+
+// Transport delivers envelopes to Alexandria by some means other than the
+// default HTTP protocol.
+type Transport interface {
+	Send(ctx context.Context, env *Envelope) error
+}
+
+// DirectivesTransport is a Transport that also carries directives. Writers
+// use SendDirectives instead of Send when their transport implements it;
+// with any other Transport, directives only arrive while paused, when the
+// writer polls over HTTP.
+type DirectivesTransport interface {
+	Transport
+
+	// SendDirectives delivers env, reporting that the writer runs with the
+	// directives with version applied, and returns the directives the
+	// server answered with, or nil if it sent none.
+	SendDirectives(ctx context.Context, env *Envelope, applied int64) (*Directives, error)
+}
+
+// Envelope is the body of a protocol v2 upload.
+//
+// As JSON it is a single object with the records in Records. As NDJSON the
+// first line is the envelope without Records and every following line is one
+// Record.
+type Envelope struct {
+	Version int      `json:"version"`
+	Kind    string   `json:"kind"`
+	LogID   string   `json:"logID"`
+	Meta    Metadata `json:"meta,omitzero"`
+
+	// Dropped is how many lines the client lost to buffer overflow since its
+	// previous upload.
+	Dropped uint64   `json:"dropped,omitempty"`
+	Records []Record `json:"records,omitempty"`
+}
+
+// Record is a single log line.
+type Record struct {
+	Time time.Time `json:"time,omitzero"`
+	Line string    `json:"line"`
+}
+
+// Encode writes e as a single JSON object.
+func (e *Envelope) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(e)
+}
+
+// DecodeEnvelope reads an envelope from r, which is JSON or NDJSON depending
+// on contentType. An empty content type is treated as JSON.
+func DecodeEnvelope(r io.Reader, contentType string) (*Envelope, error) {
+	mediaType := ContentTypeJSON
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("alexandria: can't parse content type: %w", err)
+		}
+	}
+
+	switch mediaType {
+	case ContentTypeJSON:
+		var result Envelope
+		if err := json.NewDecoder(r).Decode(&result); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrEmptyEnvelope
+			}
+			return nil, fmt.Errorf("alexandria: can't decode envelope: %w", err)
+		}
+		return &result, nil
+	case ContentTypeNDJSON:
+		return decodeNDJSON(r)
+	default:
+		return nil, fmt.Errorf("alexandria: unsupported envelope content type %q", mediaType)
+	}
+}
+
+func decodeNDJSON(r io.Reader) (*Envelope, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+
+	var result *Envelope
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if result == nil {
+			result = new(Envelope)
+			if err := json.Unmarshal(line, result); err != nil {
+				return nil, fmt.Errorf("alexandria: can't decode envelope header: %w", err)
+			}
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("alexandria: can't decode record on line %d: %w", lineNo, err)
+		}
+		result.Records = append(result.Records, rec)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("alexandria: can't read envelope: %w", err)
+	}
+
+	if result == nil {
+		return nil, ErrEmptyEnvelope
+	}
+
+	return result, nil
+}
+
+// ParseProtocols parses the value of HeaderProtocols.
+func ParseProtocols(val string) []int {
+	var result []int
+	for v := range strings.SplitSeq(val, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// SupportsProtocol reports whether a HeaderProtocols value includes version.
+func SupportsProtocol(val string, version int) bool {
+	return slices.Contains(ParseProtocols(val), version)
+}
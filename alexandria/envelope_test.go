@@ -0,0 +1,143 @@
+package alexandria
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expected := &Envelope{
+		Version: ProtocolV2,
+		Kind:    "techaro.anubis",
+		LogID:   "anubis_01jz4k5n8v",
+		Dropped: 3,
+		Records: []Record{
+			{Time: ts, Line: `{"msg":"one"}`},
+			{Time: ts.Add(time.Second), Line: "two"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		expected    *Envelope
+		err         error
+	}{
+		{
+			name:        "json",
+			body:        `{"version":2,"kind":"techaro.anubis","logID":"anubis_01jz4k5n8v","dropped":3,"records":[{"time":"2025-01-01T00:00:00Z","line":"{\"msg\":\"one\"}"},{"time":"2025-01-01T00:00:01Z","line":"two"}]}`,
+			contentType: "application/json; charset=utf-8",
+			expected:    expected,
+		},
+		{
+			name:        "ndjson",
+			body:        "{\"version\":2,\"kind\":\"techaro.anubis\",\"logID\":\"anubis_01jz4k5n8v\",\"dropped\":3}\n{\"time\":\"2025-01-01T00:00:00Z\",\"line\":\"{\\\"msg\\\":\\\"one\\\"}\"}\n\n{\"time\":\"2025-01-01T00:00:01Z\",\"line\":\"two\"}\n",
+			contentType: ContentTypeNDJSON,
+			expected:    expected,
+		},
+		{
+			name:        "empty content type is json",
+			body:        `{"version":2,"kind":"techaro.thoth","logID":"x"}`,
+			contentType: "",
+			expected:    &Envelope{Version: ProtocolV2, Kind: "techaro.thoth", LogID: "x"},
+		},
+		{
+			name:        "empty json body",
+			body:        "",
+			contentType: ContentTypeJSON,
+			err:         ErrEmptyEnvelope,
+		},
+		{
+			name:        "empty ndjson body",
+			body:        "\n\n",
+			contentType: ContentTypeNDJSON,
+			err:         ErrEmptyEnvelope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeEnvelope(strings.NewReader(tt.body), tt.contentType)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelope_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+	}{
+		{name: "unsupported content type", body: "{}", contentType: "text/plain"},
+		{name: "malformed content type", body: "{}", contentType: "application/json; ="},
+		{name: "bad json", body: "{", contentType: ContentTypeJSON},
+		{name: "bad ndjson header", body: "nope\n", contentType: ContentTypeNDJSON},
+		{name: "bad ndjson record", body: "{\"version\":2}\nnope\n", contentType: ContentTypeNDJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeEnvelope(strings.NewReader(tt.body), tt.contentType); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEnvelope_EncodeRoundTrip(t *testing.T) {
+	env := &Envelope{
+		Version: ProtocolV2,
+		Kind:    "techaro.anubis",
+		LogID:   "anubis_01jz4k5n8v",
+		Meta:    Metadata{OS: "linux", Arch: "amd64"},
+		Records: []Record{{Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Line: "hello"}},
+	}
+
+	var buf bytes.Buffer
+	if err := env.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeEnvelope(&buf, ContentTypeJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, env) {
+		t.Errorf("expected %+v, got %+v", env, got)
+	}
+}
+
+func TestSupportsProtocol(t *testing.T) {
+	tests := []struct {
+		val      string
+		version  int
+		expected bool
+	}{
+		{val: "", version: ProtocolV2, expected: false},
+		{val: "1", version: ProtocolV2, expected: false},
+		{val: "1, 2", version: ProtocolV2, expected: true},
+		{val: "2,garbage", version: ProtocolV2, expected: true},
+		{val: "1, 2", version: ProtocolV1, expected: true},
+	}
+
+	for _, tt := range tests {
+		if got := SupportsProtocol(tt.val, tt.version); got != tt.expected {
+			t.Errorf("SupportsProtocol(%q, %d) = %v, want %v", tt.val, tt.version, got, tt.expected)
+		}
+	}
+}
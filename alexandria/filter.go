@@ -0,0 +1,389 @@
+package alexandria
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinLevel        = slog.LevelInfo
+	defaultInfoSampleRate  = 1.0
+	defaultRateLimitWindow = time.Minute
+)
+
+// logLine is the subset of a slog JSON record that filtering and buffering
+// care about. Msg is the raw JSON string, escapes included, and points into
+// the line it was parsed from.
+type logLine struct {
+	Time  time.Time
+	Level slog.Level
+	Msg   []byte
+}
+
+// parseLine extracts the time, level and message from a slog JSON line
+// without allocating. Lines that aren't slog JSON are treated as INFO with no
+// time or message, and lines with a time that isn't RFC 3339 have no time.
+func parseLine(data []byte) logLine {
+	invalid := logLine{Level: slog.LevelInfo}
+	ll := invalid
+
+	i := skipSpace(data, 0)
+	if i == len(data) || data[i] != '{' {
+		return invalid
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return ll
+	}
+
+	for {
+		key, end, ok := scanString(data, i)
+		if !ok {
+			return invalid
+		}
+		i = skipSpace(data, end)
+		if i == len(data) || data[i] != ':' {
+			return invalid
+		}
+		i = skipSpace(data, i+1)
+		if end, ok = skipValue(data, i); !ok {
+			return invalid
+		}
+		val := data[i:end]
+
+		switch string(key) {
+		case "time":
+			// A time that isn't RFC 3339 is left unset rather than losing
+			// the level and message of the line
+			ll.Time = time.Time{}
+			if str, isString := unquote(val); isString {
+				if t, ok := parseTime(str); ok {
+					ll.Time = t
+				}
+			}
+		case "level":
+			if str, isString := unquote(val); isString {
+				if ll.Level, ok = parseLevel(str); !ok {
+					return invalid
+				}
+			} else if string(val) != "null" {
+				return invalid
+			}
+		case "msg":
+			if str, isString := unquote(val); isString {
+				ll.Msg = str
+			}
+		}
+
+		i = skipSpace(data, end)
+		if i == len(data) {
+			return invalid
+		}
+		switch data[i] {
+		case ',':
+			i = skipSpace(data, i+1)
+		case '}':
+			return ll
+		default:
+			return invalid
+		}
+	}
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// scanString returns the contents of the JSON string starting at data[i],
+// escapes included, and the offset just past its closing quote.
+func scanString(data []byte, i int) ([]byte, int, bool) {
+	if i == len(data) || data[i] != '"' {
+		return nil, 0, false
+	}
+	for j := i + 1; j < len(data); j++ {
+		k := bytes.IndexByte(data[j:], '"')
+		if k < 0 {
+			break
+		}
+		j += k
+
+		// The quote is escaped if an odd number of backslashes precede it
+		escaped := false
+		for b := j - 1; b > i && data[b] == '\\'; b-- {
+			escaped = !escaped
+		}
+		if !escaped {
+			return data[i+1 : j], j + 1, true
+		}
+	}
+	return nil, 0, false
+}
+
+// skipValue returns the offset just past the JSON value starting at data[i].
+// It only checks what it needs to find the end of the value.
+func skipValue(data []byte, i int) (int, bool) {
+	if i == len(data) {
+		return 0, false
+	}
+
+	switch data[i] {
+	case '"':
+		_, end, ok := scanString(data, i)
+		return end, ok
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(data); j++ {
+			switch data[j] {
+			case '"':
+				_, end, ok := scanString(data, j)
+				if !ok {
+					return 0, false
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1, true
+				}
+			}
+		}
+		return 0, false
+	default:
+		j := i
+		for j < len(data) && data[j] != ',' && data[j] != '}' && data[j] != ']' && data[j] != ' ' && data[j] != '\t' && data[j] != '\n' && data[j] != '\r' {
+			j++
+		}
+		return j, j > i
+	}
+}
+
+// unquote returns the contents of val if it is a JSON string.
+func unquote(val []byte) ([]byte, bool) {
+	if len(val) < 2 || val[0] != '"' {
+		return nil, false
+	}
+	return val[1 : len(val)-1], true
+}
+
+// parseLevel parses a level the way slog.Level.UnmarshalText does: a name
+// in any case, optionally followed by a signed offset.
+func parseLevel(data []byte) (slog.Level, bool) {
+	var level slog.Level
+	name, offset := data, []byte(nil)
+	if i := bytes.IndexAny(data, "+-"); i >= 0 {
+		name, offset = data[:i], data[i:]
+	}
+
+	switch {
+	case bytes.EqualFold(name, []byte("DEBUG")):
+		level = slog.LevelDebug
+	case bytes.EqualFold(name, []byte("INFO")):
+		level = slog.LevelInfo
+	case bytes.EqualFold(name, []byte("WARN")):
+		level = slog.LevelWarn
+	case bytes.EqualFold(name, []byte("ERROR")):
+		level = slog.LevelError
+	default:
+		return 0, false
+	}
+
+	if offset != nil {
+		n, ok := parseDigits(offset[1:])
+		if !ok {
+			return 0, false
+		}
+		if offset[0] == '-' {
+			n = -n
+		}
+		level += slog.Level(n)
+	}
+
+	return level, true
+}
+
+// parseTime parses an RFC 3339 timestamp, as slog writes them, into UTC.
+func parseTime(data []byte) (time.Time, bool) {
+	// 2006-01-02T15:04:05[.999999999](Z|-07:00)
+	if len(data) < 20 || data[4] != '-' || data[7] != '-' || (data[10] != 'T' && data[10] != 't') || data[13] != ':' || data[16] != ':' {
+		return time.Time{}, false
+	}
+
+	var fields [6]int
+	for i, span := range [6][2]int{{0, 4}, {5, 7}, {8, 10}, {11, 13}, {14, 16}, {17, 19}} {
+		n, ok := parseDigits(data[span[0]:span[1]])
+		if !ok {
+			return time.Time{}, false
+		}
+		fields[i] = n
+	}
+	if fields[1] < 1 || fields[1] > 12 || fields[2] < 1 || fields[2] > 31 || fields[3] > 23 || fields[4] > 59 || fields[5] > 59 {
+		return time.Time{}, false
+	}
+
+	rest := data[19:]
+	nsec := 0
+	if rest[0] == '.' {
+		digits := 0
+		for digits+1 < len(rest) && rest[digits+1] >= '0' && rest[digits+1] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits > 9 {
+			return time.Time{}, false
+		}
+		nsec, _ = parseDigits(rest[1 : digits+1])
+		for range 9 - digits {
+			nsec *= 10
+		}
+		rest = rest[digits+1:]
+	}
+
+	var offset time.Duration
+	switch {
+	case len(rest) == 1 && (rest[0] == 'Z' || rest[0] == 'z'):
+	case len(rest) == 6 && (rest[0] == '+' || rest[0] == '-') && rest[3] == ':':
+		hours, ok1 := parseDigits(rest[1:3])
+		minutes, ok2 := parseDigits(rest[4:6])
+		if !ok1 || !ok2 || hours > 23 || minutes > 59 {
+			return time.Time{}, false
+		}
+		offset = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if rest[0] == '-' {
+			offset = -offset
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	t := time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], nsec, time.UTC)
+	return t.Add(-offset), true
+}
+
+// parseDigits parses a non-empty run of decimal digits.
+func parseDigits(data []byte) (int, bool) {
+	if len(data) == 0 || len(data) > 9 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range data {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// filter decides which log lines get shipped to Alexandria. Lines at or above
+// ERROR are always shipped.
+type filter struct {
+	mu             sync.Mutex
+	minLevel       slog.Level
+	infoSampleRate float64
+	rateLimit      int
+	window         time.Duration
+	windowStart    time.Time
+	seen           map[string]int
+
+	// overrideLevel and overrideRate replace minLevel and infoSampleRate
+	// while server directives ask for them.
+	overrideLevel *slog.Level
+	overrideRate  *float64
+
+	now    func() time.Time
+	random func() float64
+}
+
+func newFilter() *filter {
+	return &filter{
+		minLevel:       defaultMinLevel,
+		infoSampleRate: defaultInfoSampleRate,
+		window:         defaultRateLimitWindow,
+		seen:           map[string]int{},
+		now:            time.Now,
+		random:         rand.Float64,
+	}
+}
+
+func (f *filter) setMinLevel(level slog.Level) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.minLevel = level
+}
+
+func (f *filter) setInfoSampleRate(rate float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.infoSampleRate = min(max(rate, 0), 1)
+}
+
+// setOverride replaces the minimum level and sample rate with level and
+// rate where they aren't nil, until it is called again.
+func (f *filter) setOverride(level *slog.Level, rate *float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrideLevel = level
+	f.overrideRate = nil
+	if rate != nil {
+		r := min(max(*rate, 0), 1)
+		f.overrideRate = &r
+	}
+}
+
+func (f *filter) setRateLimit(limit int, window time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rateLimit = limit
+	f.window = window
+	f.windowStart = time.Time{}
+	clear(f.seen)
+}
+
+// allow reports whether a parsed line should be shipped.
+func (f *filter) allow(ll logLine) bool {
+	if ll.Level >= slog.LevelError {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	minLevel, sampleRate := f.minLevel, f.infoSampleRate
+	if f.overrideLevel != nil {
+		minLevel = *f.overrideLevel
+	}
+	if f.overrideRate != nil {
+		sampleRate = *f.overrideRate
+	}
+
+	if ll.Level < minLevel {
+		return false
+	}
+
+	if ll.Level < slog.LevelWarn && sampleRate < 1 && f.random() >= sampleRate {
+		return false
+	}
+
+	if f.rateLimit > 0 {
+		now := f.now()
+		if now.Sub(f.windowStart) >= f.window {
+			f.windowStart = now
+			clear(f.seen)
+		}
+
+		n := f.seen[string(ll.Msg)]
+		if n >= f.rateLimit {
+			return false
+		}
+		f.seen[string(ll.Msg)] = n + 1
+	}
+
+	return true
+}
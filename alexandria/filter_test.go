@@ -0,0 +1,226 @@
+package alexandria
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected logLine
+	}{
+		{
+			name:     "info line",
+			data:     `{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"hello"}`,
+			expected: logLine{Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Level: slog.LevelInfo, Msg: []byte("hello")},
+		},
+		{
+			name:     "error line",
+			data:     `{"level":"ERROR","msg":"oh no"}`,
+			expected: logLine{Level: slog.LevelError, Msg: []byte("oh no")},
+		},
+		{
+			name:     "offset level",
+			data:     `{"level":"DEBUG-4","msg":"verbose"}`,
+			expected: logLine{Level: slog.LevelDebug - 4, Msg: []byte("verbose")},
+		},
+		{
+			name:     "lowercase level",
+			data:     `{"level":"warn+1"}`,
+			expected: logLine{Level: slog.LevelWarn + 1},
+		},
+		{
+			name:     "missing level",
+			data:     `{"msg":"no level"}`,
+			expected: logLine{Level: slog.LevelInfo, Msg: []byte("no level")},
+		},
+		{
+			name:     "time zone and fraction",
+			data:     `{"time":"2025-01-01T02:00:00.25+02:00","level":"INFO","msg":"hello"}` + "\n",
+			expected: logLine{Time: time.Date(2025, 1, 1, 0, 0, 0, 250_000_000, time.UTC), Level: slog.LevelInfo, Msg: []byte("hello")},
+		},
+		{
+			name:     "nested attributes",
+			data:     `{ "source" : {"file":"main.go","msg":"nope","lines":[1,{"level":"ERROR"}]}, "msg":"say \"hi\"}", "n":-1.5e3, "ok":true }`,
+			expected: logLine{Level: slog.LevelInfo, Msg: []byte(`say \"hi\"}`)},
+		},
+		{
+			name:     "unknown level",
+			data:     `{"level":"LOUD","msg":"hello"}`,
+			expected: logLine{Level: slog.LevelInfo},
+		},
+		{
+			name:     "bad time",
+			data:     `{"time":"yesterday","level":"ERROR","msg":"hello"}`,
+			expected: logLine{Level: slog.LevelError, Msg: []byte("hello")},
+		},
+		{
+			name:     "time without zone",
+			data:     `{"time":"2025-01-01 00:00:00","level":"ERROR","msg":"x"}`,
+			expected: logLine{Level: slog.LevelError, Msg: []byte("x")},
+		},
+		{
+			name:     "numeric time",
+			data:     `{"time":1735689600,"level":"ERROR","msg":"x"}`,
+			expected: logLine{Level: slog.LevelError, Msg: []byte("x")},
+		},
+		{
+			name:     "truncated",
+			data:     `{"level":"ERROR","msg":"hel`,
+			expected: logLine{Level: slog.LevelInfo},
+		},
+		{
+			name:     "not json",
+			data:     "plain text line\n",
+			expected: logLine{Level: slog.LevelInfo},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseLine([]byte(tt.data))
+			if !got.Time.Equal(tt.expected.Time) || got.Level != tt.expected.Level || !bytes.Equal(got.Msg, tt.expected.Msg) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseLine_Allocs(t *testing.T) {
+	if allocs := testing.AllocsPerRun(100, func() { parseLine(benchLine) }); allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestFilter_Allow(t *testing.T) {
+	const (
+		debugLine = `{"level":"DEBUG","msg":"chatter"}`
+		infoLine  = `{"level":"INFO","msg":"hello"}`
+		warnLine  = `{"level":"WARN","msg":"careful"}`
+		errorLine = `{"level":"ERROR","msg":"oh no"}`
+	)
+
+	tests := []struct {
+		name       string
+		minLevel   slog.Level
+		sampleRate float64
+		random     float64
+		rateLimit  int
+		lines      []string
+		expected   []bool
+	}{
+		{
+			name:       "default drops debug",
+			minLevel:   defaultMinLevel,
+			sampleRate: 1,
+			lines:      []string{debugLine, infoLine, warnLine, errorLine},
+			expected:   []bool{false, true, true, true},
+		},
+		{
+			name:       "min level debug ships everything",
+			minLevel:   slog.LevelDebug,
+			sampleRate: 1,
+			lines:      []string{debugLine, infoLine},
+			expected:   []bool{true, true},
+		},
+		{
+			name:       "errors always shipped",
+			minLevel:   slog.LevelError + 4,
+			sampleRate: 0,
+			lines:      []string{warnLine, errorLine},
+			expected:   []bool{false, true},
+		},
+		{
+			name:       "sampling drops info but not warn",
+			minLevel:   slog.LevelInfo,
+			sampleRate: 0.5,
+			random:     0.75,
+			lines:      []string{infoLine, warnLine},
+			expected:   []bool{false, true},
+		},
+		{
+			name:       "sampling keeps info under rate",
+			minLevel:   slog.LevelInfo,
+			sampleRate: 0.5,
+			random:     0.25,
+			lines:      []string{infoLine},
+			expected:   []bool{true},
+		},
+		{
+			name:       "rate limit per message",
+			minLevel:   slog.LevelInfo,
+			sampleRate: 1,
+			rateLimit:  2,
+			lines:      []string{infoLine, infoLine, warnLine, infoLine, warnLine, errorLine, errorLine, errorLine},
+			expected:   []bool{true, true, true, false, true, true, true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFilter()
+			f.random = func() float64 { return tt.random }
+			f.setMinLevel(tt.minLevel)
+			f.setInfoSampleRate(tt.sampleRate)
+			f.setRateLimit(tt.rateLimit, time.Minute)
+
+			for i, line := range tt.lines {
+				if got := f.allow(parseLine([]byte(line))); got != tt.expected[i] {
+					t.Errorf("line %d (%s): expected %v, got %v", i, line, tt.expected[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestFilter_RateLimitWindowResets(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	f := newFilter()
+	f.now = func() time.Time { return now }
+	f.setRateLimit(1, time.Minute)
+
+	line := parseLine([]byte(`{"level":"INFO","msg":"hello"}`))
+
+	if !f.allow(line) {
+		t.Fatal("first line should be allowed")
+	}
+
+	if f.allow(line) {
+		t.Fatal("second line in the same window should be dropped")
+	}
+
+	now = now.Add(time.Minute)
+
+	if !f.allow(line) {
+		t.Fatal("line in the next window should be allowed")
+	}
+}
+
+func TestFilter_Override(t *testing.T) {
+	debug := parseLine([]byte(`{"level":"DEBUG","msg":"chatter"}`))
+	info := parseLine([]byte(`{"level":"INFO","msg":"hello"}`))
+
+	f := newFilter()
+	f.random = func() float64 { return 0.5 }
+	f.setInfoSampleRate(0.25)
+
+	if f.allow(debug) || f.allow(info) {
+		t.Fatal("expected debug and sampled info lines to be dropped")
+	}
+
+	level, rate := slog.LevelDebug, 2.0
+	f.setOverride(&level, &rate)
+	if !f.allow(debug) || !f.allow(info) {
+		t.Error("expected the override to ship debug and info lines")
+	}
+
+	f.setOverride(nil, nil)
+	if f.allow(debug) || f.allow(info) {
+		t.Error("expected the client's settings back after clearing the override")
+	}
+}
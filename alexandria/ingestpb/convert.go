@@ -0,0 +1,77 @@
+package ingestpb
+
+import (
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromEnvelope converts a protocol v2 envelope into an IngestRequest.
+func FromEnvelope(env *alexandria.Envelope) *IngestRequest {
+	result := &IngestRequest{
+		Kind:    env.Kind,
+		LogId:   env.LogID,
+		Dropped: env.Dropped,
+		Records: make([]*Record, len(env.Records)),
+	}
+
+	if !env.Meta.IsZero() {
+		result.Meta = &Metadata{
+			Service:        env.Meta.Service,
+			ServiceVersion: env.Meta.ServiceVersion,
+			GoVersion:      env.Meta.GoVersion,
+			Os:             env.Meta.OS,
+			Arch:           env.Meta.Arch,
+			HostHash:       env.Meta.HostHash,
+			ClientVersion:  env.Meta.ClientVersion,
+		}
+
+		if !env.Meta.ProcessStart.IsZero() {
+			result.Meta.ProcessStart = timestamppb.New(env.Meta.ProcessStart)
+		}
+	}
+
+	for i, rec := range env.Records {
+		result.Records[i] = &Record{Line: []byte(rec.Line)}
+		if !rec.Time.IsZero() {
+			result.Records[i].Time = timestamppb.New(rec.Time)
+		}
+	}
+
+	return result
+}
+
+// Envelope converts r into a protocol v2 envelope.
+func (r *IngestRequest) Envelope() *alexandria.Envelope {
+	result := &alexandria.Envelope{
+		Version: alexandria.ProtocolV2,
+		Kind:    r.GetKind(),
+		LogID:   r.GetLogId(),
+		Dropped: r.GetDropped(),
+		Records: make([]alexandria.Record, len(r.GetRecords())),
+	}
+
+	if md := r.GetMeta(); md != nil {
+		result.Meta = alexandria.Metadata{
+			Service:        md.GetService(),
+			ServiceVersion: md.GetServiceVersion(),
+			GoVersion:      md.GetGoVersion(),
+			OS:             md.GetOs(),
+			Arch:           md.GetArch(),
+			HostHash:       md.GetHostHash(),
+			ClientVersion:  md.GetClientVersion(),
+		}
+
+		if md.GetProcessStart() != nil {
+			result.Meta.ProcessStart = md.GetProcessStart().AsTime()
+		}
+	}
+
+	for i, rec := range r.GetRecords() {
+		result.Records[i].Line = string(rec.GetLine())
+		if rec.GetTime() != nil {
+			result.Records[i].Time = rec.GetTime().AsTime()
+		}
+	}
+
+	return result
+}
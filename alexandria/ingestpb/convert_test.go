@@ -0,0 +1,60 @@
+package ingestpb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		env  *alexandria.Envelope
+	}{
+		{
+			name: "empty",
+			env: &alexandria.Envelope{
+				Version: alexandria.ProtocolV2,
+				Kind:    "techaro.anubis",
+				LogID:   "anubis_01jz4k5n8v",
+				Records: []alexandria.Record{},
+			},
+		},
+		{
+			name: "full",
+			env: &alexandria.Envelope{
+				Version: alexandria.ProtocolV2,
+				Kind:    "techaro.thoth",
+				LogID:   "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293",
+				Meta: alexandria.Metadata{
+					Service:        "github.com/TecharoHQ/thoth",
+					ServiceVersion: "v1.0.0",
+					GoVersion:      "go1.25.0",
+					OS:             "linux",
+					Arch:           "amd64",
+					HostHash:       "0123456789abcdef",
+					ProcessStart:   ts,
+					ClientVersion:  "v1.2.0",
+				},
+				Dropped: 7,
+				Records: []alexandria.Record{
+					{Time: ts, Line: `{"msg":"hello"}`},
+					{Line: "no time"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FromEnvelope(tt.env).Envelope()
+			if !reflect.DeepEqual(got, tt.env) {
+				t.Errorf("expected %+v, got %+v", tt.env, got)
+			}
+		})
+	}
+}
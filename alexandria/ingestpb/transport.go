@@ -0,0 +1,58 @@
+package ingestpb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys of the directives channel over gRPC. They carry the same
+// values as the HTTP headers of the same names on unary Ingest calls;
+// IngestStream carries no directives.
+var (
+	MetadataDirectives        = strings.ToLower(alexandria.HeaderDirectives)
+	MetadataDirectivesApplied = strings.ToLower(alexandria.HeaderDirectivesApplied)
+)
+
+// Transport sends envelopes to Alexandria over gRPC. Pass it to
+// (*alexandria.WriterWrapper).SetTransport to use it instead of HTTP.
+type Transport struct {
+	client IngestClient
+}
+
+var _ alexandria.DirectivesTransport = (*Transport)(nil)
+
+// NewTransport creates a Transport that uses cc.
+func NewTransport(cc grpc.ClientConnInterface) *Transport {
+	return &Transport{
+		client: NewIngestClient(cc),
+	}
+}
+
+// Send delivers env with a unary Ingest call.
+func (t *Transport) Send(ctx context.Context, env *alexandria.Envelope) error {
+	_, err := t.client.Ingest(ctx, FromEnvelope(env))
+	return err
+}
+
+// SendDirectives delivers env with a unary Ingest call and returns the
+// directives in the response header metadata.
+func (t *Transport) SendDirectives(ctx context.Context, env *alexandria.Envelope, applied int64) (*alexandria.Directives, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, MetadataDirectivesApplied, strconv.FormatInt(applied, 10))
+
+	var md metadata.MD
+	if _, err := t.client.Ingest(ctx, FromEnvelope(env), grpc.Header(&md)); err != nil {
+		return nil, err
+	}
+
+	h := http.Header{}
+	for _, val := range md.Get(MetadataDirectives) {
+		h.Add(alexandria.HeaderDirectives, val)
+	}
+	return alexandria.DirectivesFromHeader(h)
+}
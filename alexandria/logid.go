@@ -0,0 +1,159 @@
+package alexandria
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidLogID is returned when a logID is neither a UUID nor a prefixed ID.
+var ErrInvalidLogID = errors.New("logID must be a UUID or a prefixed ID like anubis_01jz4k5n8v")
+
+// prefixedLogID matches IDs of the form prefix_id, such as anubis_01jz4k5n8v.
+var prefixedLogID = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}_[a-z0-9]{8,64}$`)
+
+// CanonicalLogID validates logID and returns its canonical form. UUIDs are
+// accepted in any form uuid.Parse understands and normalized to lowercase
+// hyphenated form. Prefixed IDs are lowercased. Alexandria rejects uploads
+// for logIDs this rejects.
+func CanonicalLogID(logID string) (string, error) {
+	if id, err := uuid.Parse(logID); err == nil {
+		return id.String(), nil
+	}
+
+	logID = strings.ToLower(logID)
+	if !prefixedLogID.MatchString(logID) {
+		return "", ErrInvalidLogID
+	}
+
+	return logID, nil
+}
+
+const (
+	installationIDFile = "installation-id"
+	stateDirName       = "alexandria"
+)
+
+// InstallationID returns the stable logID of this installation, creating and
+// persisting one in the state directory on first use. Setting the
+// ALEXANDRIA_LOG_ID environment variable overrides the stored value; it is an
+// error if that isn't a valid logID.
+//
+// The state directory is the first entry of $STATE_DIRECTORY when running
+// under systemd, otherwise $XDG_STATE_HOME/alexandria, falling back to
+// ~/.local/state/alexandria.
+func InstallationID() (string, error) {
+	if val, ok := os.LookupEnv("ALEXANDRIA_LOG_ID"); ok && strings.TrimSpace(val) != "" {
+		id, err := CanonicalLogID(strings.TrimSpace(val))
+		if err != nil {
+			return "", fmt.Errorf("invalid ALEXANDRIA_LOG_ID %q: %w", strings.TrimSpace(val), err)
+		}
+		return id, nil
+	}
+
+	path, err := installationIDPath()
+	if err != nil {
+		return "", err
+	}
+
+	return LogIDFromFile(path)
+}
+
+// RotateInstallationID replaces the stored installation ID with a new one and
+// returns it. It doesn't affect ALEXANDRIA_LOG_ID.
+func RotateInstallationID() (string, error) {
+	path, err := installationIDPath()
+	if err != nil {
+		return "", err
+	}
+
+	return newLogIDFile(path)
+}
+
+func installationIDPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, installationIDFile), nil
+}
+
+// stateDir returns the directory Alexandria client state is kept in.
+func stateDir() (string, error) {
+	// systemd sets this to a colon-separated list when StateDirectory= is used
+	if val := os.Getenv("STATE_DIRECTORY"); val != "" {
+		dir, _, _ := strings.Cut(val, ":")
+		return dir, nil
+	}
+
+	if val := os.Getenv("XDG_STATE_HOME"); val != "" {
+		return filepath.Join(val, stateDirName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("can't find a state directory: %w", err)
+	}
+
+	return filepath.Join(home, ".local", "state", stateDirName), nil
+}
+
+// LogIDFromFile returns the canonical form of the logID stored at path. If
+// the file doesn't exist, is empty or doesn't hold a valid logID, a new
+// UUIDv7 is generated and persisted there so that the installation keeps the
+// same logID across restarts.
+func LogIDFromFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if id, err := CanonicalLogID(string(bytes.TrimSpace(data))); err == nil {
+			return id, nil
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", fmt.Errorf("can't read logID from %s: %w", path, err)
+	}
+
+	return newLogIDFile(path)
+}
+
+// newLogIDFile generates a new logID and atomically writes it to path.
+func newLogIDFile(path string) (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", fmt.Errorf("can't generate logID: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("can't create %s: %w", dir, err)
+	}
+
+	fout, err := os.CreateTemp(dir, ".logid-*")
+	if err != nil {
+		return "", fmt.Errorf("can't create temporary file in %s: %w", dir, err)
+	}
+	defer os.Remove(fout.Name())
+
+	if _, err := fmt.Fprintln(fout, id.String()); err != nil {
+		fout.Close()
+		return "", fmt.Errorf("can't write logID: %w", err)
+	}
+
+	if err := fout.Close(); err != nil {
+		return "", fmt.Errorf("can't write logID: %w", err)
+	}
+
+	if err := os.Rename(fout.Name(), path); err != nil {
+		return "", fmt.Errorf("can't persist logID to %s: %w", path, err)
+	}
+
+	return id.String(), nil
+}
@@ -0,0 +1,244 @@
+package alexandria
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestLogIDFromFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents *string
+		keep     bool
+	}{
+		{
+			name:     "missing file",
+			contents: nil,
+		},
+		{
+			name:     "existing id",
+			contents: ptr("0198d7c4-6f1e-7a3b-9c2d-4e5f60718293\n"),
+			keep:     true,
+		},
+		{
+			name:     "existing prefixed id",
+			contents: ptr("anubis_abcd1234\n"),
+			keep:     true,
+		},
+		{
+			name:     "empty file",
+			contents: ptr("\n"),
+		},
+		{
+			name:     "corrupt file",
+			contents: ptr("not a uuid"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state", "logid")
+
+			if tt.contents != nil {
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(*tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := LogIDFromFile(path)
+			if err != nil {
+				t.Fatalf("LogIDFromFile: %v", err)
+			}
+
+			if tt.keep && got != strings.TrimSpace(*tt.contents) {
+				t.Errorf("expected existing logID %q, got %q", strings.TrimSpace(*tt.contents), got)
+			}
+
+			if !tt.keep {
+				id, err := uuid.Parse(got)
+				if err != nil {
+					t.Fatalf("logID %q is not a UUID: %v", got, err)
+				}
+				if id.Version() != 7 {
+					t.Errorf("expected a UUIDv7, got version %d", id.Version())
+				}
+			}
+
+			again, err := LogIDFromFile(path)
+			if err != nil {
+				t.Fatalf("LogIDFromFile again: %v", err)
+			}
+			if again != got {
+				t.Errorf("logID not stable across calls: %q then %q", got, again)
+			}
+		})
+	}
+}
+
+func TestCanonicalLogID(t *testing.T) {
+	tests := []struct {
+		name     string
+		logID    string
+		expected string
+		err      error
+	}{
+		{
+			name:     "canonical uuid",
+			logID:    "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293",
+			expected: "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293",
+		},
+		{
+			name:     "uppercase uuid",
+			logID:    "0198D7C4-6F1E-7A3B-9C2D-4E5F60718293",
+			expected: "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293",
+		},
+		{
+			name:     "unhyphenated uuid",
+			logID:    "0198d7c46f1e7a3b9c2d4e5f60718293",
+			expected: "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293",
+		},
+		{
+			name:     "prefixed id",
+			logID:    "Anubis_01JZ4K5N8V",
+			expected: "anubis_01jz4k5n8v",
+		},
+		{
+			name:  "empty",
+			logID: "",
+			err:   ErrInvalidLogID,
+		},
+		{
+			name:  "garbage",
+			logID: "hello world",
+			err:   ErrInvalidLogID,
+		},
+		{
+			name:  "prefixed id too short",
+			logID: "anubis_1234",
+			err:   ErrInvalidLogID,
+		},
+		{
+			name:  "giant",
+			logID: "anubis_" + strings.Repeat("a", 4096),
+			err:   ErrInvalidLogID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanonicalLogID(tt.logID)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStateDir(t *testing.T) {
+	tests := []struct {
+		name         string
+		stateDir     string
+		xdgStateHome string
+		home         string
+		expected     string
+	}{
+		{
+			name:     "systemd state directory",
+			stateDir: "/var/lib/anubis:/var/lib/other",
+			home:     "/home/anubis",
+			expected: "/var/lib/anubis",
+		},
+		{
+			name:         "xdg state home",
+			xdgStateHome: "/home/anubis/.state",
+			home:         "/home/anubis",
+			expected:     "/home/anubis/.state/alexandria",
+		},
+		{
+			name:     "home fallback",
+			home:     "/home/anubis",
+			expected: "/home/anubis/.local/state/alexandria",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATE_DIRECTORY", tt.stateDir)
+			t.Setenv("XDG_STATE_HOME", tt.xdgStateHome)
+			t.Setenv("HOME", tt.home)
+
+			got, err := stateDir()
+			if err != nil {
+				t.Fatalf("stateDir: %v", err)
+			}
+
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestInstallationID(t *testing.T) {
+	t.Setenv("STATE_DIRECTORY", t.TempDir())
+	t.Setenv("ALEXANDRIA_LOG_ID", "")
+
+	first, err := InstallationID()
+	if err != nil {
+		t.Fatalf("InstallationID: %v", err)
+	}
+
+	again, err := InstallationID()
+	if err != nil {
+		t.Fatalf("InstallationID again: %v", err)
+	}
+	if again != first {
+		t.Errorf("installation ID not stable: %q then %q", first, again)
+	}
+
+	rotated, err := RotateInstallationID()
+	if err != nil {
+		t.Fatalf("RotateInstallationID: %v", err)
+	}
+	if rotated == first {
+		t.Error("rotation should produce a new ID")
+	}
+
+	after, err := InstallationID()
+	if err != nil {
+		t.Fatalf("InstallationID after rotate: %v", err)
+	}
+	if after != rotated {
+		t.Errorf("expected rotated ID %q to persist, got %q", rotated, after)
+	}
+
+	t.Setenv("ALEXANDRIA_LOG_ID", " Anubis_Override1 ")
+	override, err := InstallationID()
+	if err != nil {
+		t.Fatalf("InstallationID with override: %v", err)
+	}
+	if override != "anubis_override1" {
+		t.Errorf("expected environment override, got %q", override)
+	}
+
+	t.Setenv("ALEXANDRIA_LOG_ID", "my server")
+	if _, err := InstallationID(); !errors.Is(err, ErrInvalidLogID) || !strings.Contains(err.Error(), "ALEXANDRIA_LOG_ID") {
+		t.Errorf("expected an invalid override to be reported, got %v", err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
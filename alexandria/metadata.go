@@ -0,0 +1,130 @@
+package alexandria
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const clientModulePath = "github.com/TecharoHQ/alexandria"
+
+// Headers used to carry Metadata on uploads.
+const (
+	HeaderService        = "X-Alexandria-Service"
+	HeaderServiceVersion = "X-Alexandria-Service-Version"
+	HeaderGoVersion      = "X-Alexandria-Go-Version"
+	HeaderOS             = "X-Alexandria-Os"
+	HeaderArch           = "X-Alexandria-Arch"
+	HeaderHostHash       = "X-Alexandria-Host-Hash"
+	HeaderProcessStart   = "X-Alexandria-Process-Start"
+	HeaderClientVersion  = "X-Alexandria-Client-Version"
+)
+
+// maxMetadataValueLen caps how long any single metadata value may be.
+const maxMetadataValueLen = 128
+
+var processStart = time.Now()
+
+// Metadata describes the program that produced a batch of logs.
+type Metadata struct {
+	Service        string    `json:"service,omitempty"`
+	ServiceVersion string    `json:"serviceVersion,omitempty"`
+	GoVersion      string    `json:"goVersion,omitempty"`
+	OS             string    `json:"os,omitempty"`
+	Arch           string    `json:"arch,omitempty"`
+	HostHash       string    `json:"hostHash,omitempty"`
+	ProcessStart   time.Time `json:"processStart,omitzero"`
+	ClientVersion  string    `json:"clientVersion,omitempty"`
+}
+
+// CurrentMetadata returns the metadata of the running process. The hostname
+// is hashed so that it can be correlated without being disclosed.
+func CurrentMetadata() Metadata {
+	result := Metadata{
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		ProcessStart: processStart,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		result.Service = bi.Main.Path
+		result.ServiceVersion = bi.Main.Version
+
+		if bi.Main.Path == clientModulePath {
+			result.ClientVersion = bi.Main.Version
+		}
+
+		for _, dep := range bi.Deps {
+			if dep.Path == clientModulePath {
+				result.ClientVersion = dep.Version
+			}
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		sum := sha256.Sum256([]byte(hostname))
+		result.HostHash = hex.EncodeToString(sum[:8])
+	}
+
+	return result
+}
+
+// IsZero reports whether m carries no information.
+func (m Metadata) IsZero() bool {
+	return m == Metadata{}
+}
+
+// SetHeaders writes m into h.
+func (m Metadata) SetHeaders(h http.Header) {
+	set := func(key, val string) {
+		if val != "" {
+			h.Set(key, val)
+		}
+	}
+
+	set(HeaderService, m.Service)
+	set(HeaderServiceVersion, m.ServiceVersion)
+	set(HeaderGoVersion, m.GoVersion)
+	set(HeaderOS, m.OS)
+	set(HeaderArch, m.Arch)
+	set(HeaderHostHash, m.HostHash)
+	set(HeaderClientVersion, m.ClientVersion)
+
+	if !m.ProcessStart.IsZero() {
+		h.Set(HeaderProcessStart, m.ProcessStart.UTC().Format(time.RFC3339))
+	}
+}
+
+// MetadataFromHeaders reads Metadata from h. Values are trimmed and truncated,
+// and a malformed process start time is ignored.
+func MetadataFromHeaders(h http.Header) Metadata {
+	get := func(key string) string {
+		val := strings.TrimSpace(h.Get(key))
+		if len(val) > maxMetadataValueLen {
+			val = val[:maxMetadataValueLen]
+		}
+		return val
+	}
+
+	result := Metadata{
+		Service:        get(HeaderService),
+		ServiceVersion: get(HeaderServiceVersion),
+		GoVersion:      get(HeaderGoVersion),
+		OS:             get(HeaderOS),
+		Arch:           get(HeaderArch),
+		HostHash:       get(HeaderHostHash),
+		ClientVersion:  get(HeaderClientVersion),
+	}
+
+	if t, err := time.Parse(time.RFC3339, get(HeaderProcessStart)); err == nil {
+		result.ProcessStart = t
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package alexandria
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCurrentMetadata(t *testing.T) {
+	md := CurrentMetadata()
+
+	if md.GoVersion != runtime.Version() {
+		t.Errorf("expected Go version %s, got %s", runtime.Version(), md.GoVersion)
+	}
+
+	if md.OS != runtime.GOOS || md.Arch != runtime.GOARCH {
+		t.Errorf("expected platform %s/%s, got %s/%s", runtime.GOOS, runtime.GOARCH, md.OS, md.Arch)
+	}
+
+	if md.ProcessStart.IsZero() {
+		t.Error("expected process start time to be set")
+	}
+
+	if len(md.HostHash) != 16 {
+		t.Errorf("expected 16 character host hash, got %q", md.HostHash)
+	}
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    Metadata
+		expected Metadata
+	}{
+		{
+			name:     "empty",
+			input:    Metadata{},
+			expected: Metadata{},
+		},
+		{
+			name: "round trip",
+			input: Metadata{
+				Service:        "github.com/TecharoHQ/anubis",
+				ServiceVersion: "v1.21.0",
+				GoVersion:      "go1.25.0",
+				OS:             "linux",
+				Arch:           "arm64",
+				HostHash:       "0123456789abcdef",
+				ProcessStart:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+				ClientVersion:  "v1.2.0",
+			},
+			expected: Metadata{
+				Service:        "github.com/TecharoHQ/anubis",
+				ServiceVersion: "v1.21.0",
+				GoVersion:      "go1.25.0",
+				OS:             "linux",
+				Arch:           "arm64",
+				HostHash:       "0123456789abcdef",
+				ProcessStart:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+				ClientVersion:  "v1.2.0",
+			},
+		},
+		{
+			name:     "oversized value is truncated",
+			input:    Metadata{Service: strings.Repeat("a", 1000)},
+			expected: Metadata{Service: strings.Repeat("a", maxMetadataValueLen)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			tt.input.SetHeaders(h)
+
+			got := MetadataFromHeaders(h)
+			if got != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+
+			if got.IsZero() != tt.expected.IsZero() {
+				t.Errorf("IsZero mismatch")
+			}
+		})
+	}
+}
+
+func TestMetadataFromHeaders_BadProcessStart(t *testing.T) {
+	h := http.Header{}
+	h.Set(HeaderProcessStart, "yesterday")
+	h.Set(HeaderOS, "linux")
+
+	got := MetadataFromHeaders(h)
+	if !got.ProcessStart.IsZero() {
+		t.Errorf("expected malformed process start to be ignored, got %v", got.ProcessStart)
+	}
+	if got.OS != "linux" {
+		t.Errorf("expected other fields to be kept, got %+v", got)
+	}
+}
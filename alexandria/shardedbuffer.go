@@ -0,0 +1,169 @@
+package alexandria
+
+import (
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxShards    = 16
+	minShardSize = 64
+)
+
+// shardedRingBuffer spreads writes across several independently locked ring
+// buffers so that concurrent writers rarely contend on the same mutex. Each
+// entry is stamped with a global sequence number so that drainTo can merge the
+// shards back into write order. Slots reuse their backing arrays between
+// drains, so steady-state writes don't allocate.
+//
+// Writers only take their shard's lock while it has room. Once every shard
+// is full, a write locks them all and evicts the oldest entry of the lowest
+// level in the whole buffer, so an ERROR is never evicted while another
+// shard still holds a DEBUG.
+type shardedRingBuffer struct {
+	shards  []*ringBuffer
+	next    atomic.Uint64
+	seq     atomic.Uint64
+	dropped atomic.Uint64
+
+	// cursor is the next slot drainTo takes from each shard, or -1.
+	cursor []int
+}
+
+func newShardedRingBuffer() *shardedRingBuffer {
+	return newShardedRingBufferN(runtime.GOMAXPROCS(0))
+}
+
+func newShardedRingBufferN(n int) *shardedRingBuffer {
+	n = min(max(n, 1), maxShards, ringBufferSize/minShardSize)
+
+	result := &shardedRingBuffer{
+		shards: make([]*ringBuffer, n),
+		cursor: make([]int, n),
+	}
+
+	for i := range result.shards {
+		result.shards[i] = newRingBufferSize(ringBufferSize / n)
+	}
+
+	return result
+}
+
+func (sb *shardedRingBuffer) add(data []byte, level slog.Level, t time.Time) {
+	start := sb.next.Add(1)
+	n := uint64(len(sb.shards))
+
+	// Prefer a shard nobody else is writing to and that has room
+	for i := range n {
+		shard := sb.shards[(start+i)%n]
+		if !shard.mu.TryLock() {
+			continue
+		}
+		if !shard.full() {
+			shard.insert(data, level, sb.seq.Add(1), t)
+			shard.mu.Unlock()
+			return
+		}
+		shard.mu.Unlock()
+	}
+
+	sb.addSlow(data, level, t)
+}
+
+// addSlow adds an entry with every shard locked, evicting the oldest entry
+// of the lowest level across all shards if they are full.
+func (sb *shardedRingBuffer) addSlow(data []byte, level slog.Level, t time.Time) {
+	for _, shard := range sb.shards {
+		shard.mu.Lock()
+	}
+	defer func() {
+		for _, shard := range sb.shards {
+			shard.mu.Unlock()
+		}
+	}()
+
+	var (
+		victim      *ringBuffer
+		victimLevel slog.Level
+		victimSeq   uint64
+	)
+	for _, shard := range sb.shards {
+		if !shard.full() {
+			shard.insert(data, level, sb.seq.Add(1), t)
+			return
+		}
+
+		lvl, seq, ok := shard.lowest()
+		if ok && (victim == nil || lvl < victimLevel || lvl == victimLevel && seq < victimSeq) {
+			victim, victimLevel, victimSeq = shard, lvl, seq
+		}
+	}
+
+	sb.dropped.Add(1)
+
+	// Everything buffered is more important than this entry, drop it
+	if victim == nil || level < victimLevel {
+		return
+	}
+
+	victim.evictLowest()
+	victim.insert(data, level, sb.seq.Add(1), t)
+}
+
+// takeDropped returns how many entries were lost to overflow since the last
+// call.
+func (sb *shardedRingBuffer) takeDropped() uint64 {
+	return sb.dropped.Swap(0)
+}
+
+// drainTo calls fn with every buffered entry in write order and empties the
+// buffer. The slices passed to fn are only valid until fn returns.
+func (sb *shardedRingBuffer) drainTo(fn func(line []byte, t time.Time)) int {
+	for _, shard := range sb.shards {
+		shard.mu.Lock()
+	}
+
+	for i, shard := range sb.shards {
+		sb.cursor[i] = -1
+		if shard.count > 0 {
+			sb.cursor[i] = shard.tail
+		}
+	}
+
+	result := 0
+	for {
+		best := -1
+		var bestSeq uint64
+
+		for i, shard := range sb.shards {
+			if sb.cursor[i] < 0 {
+				continue
+			}
+
+			seq := shard.seqs[sb.cursor[i]]
+			if best == -1 || seq < bestSeq {
+				best = i
+				bestSeq = seq
+			}
+		}
+
+		if best == -1 {
+			break
+		}
+
+		shard := sb.shards[best]
+		idx := sb.cursor[best]
+		fn(shard.buffer[idx], shard.times[idx])
+		sb.cursor[best] = shard.next[idx]
+		result++
+	}
+
+	for _, shard := range sb.shards {
+		shard.reset()
+		shard.mu.Unlock()
+	}
+
+	return result
+}
@@ -0,0 +1,277 @@
+package alexandria
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func drainAll(sb *shardedRingBuffer) [][]byte {
+	var result [][]byte
+	sb.drainTo(func(line []byte, _ time.Time) {
+		result = append(result, bytes.Clone(line))
+	})
+	return result
+}
+
+func TestNewShardedRingBufferN(t *testing.T) {
+	tests := []struct {
+		name           string
+		n              int
+		expectedShards int
+	}{
+		{name: "zero clamps to one", n: 0, expectedShards: 1},
+		{name: "single shard", n: 1, expectedShards: 1},
+		{name: "four shards", n: 4, expectedShards: 4},
+		{name: "capped", n: 1000, expectedShards: min(maxShards, ringBufferSize/minShardSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := newShardedRingBufferN(tt.n)
+
+			if len(sb.shards) != tt.expectedShards {
+				t.Errorf("expected %d shards, got %d", tt.expectedShards, len(sb.shards))
+			}
+
+			total := 0
+			for _, shard := range sb.shards {
+				total += shard.size
+			}
+			if total > ringBufferSize {
+				t.Errorf("total capacity %d exceeds %d", total, ringBufferSize)
+			}
+		})
+	}
+}
+
+func TestShardedRingBuffer_DrainOrder(t *testing.T) {
+	for _, n := range []int{1, 2, 8} {
+		t.Run(fmt.Sprintf("%d shards", n), func(t *testing.T) {
+			sb := newShardedRingBufferN(n)
+
+			var want [][]byte
+			for i := 0; i < 100; i++ {
+				line := []byte(fmt.Sprintf("line %d", i))
+				want = append(want, line)
+				sb.add(line, slog.LevelInfo, time.Time{})
+			}
+
+			if got := drainAll(sb); !equalByteSlices(got, want) {
+				t.Errorf("drain order mismatch.\nExpected: %q\nGot: %q", want, got)
+			}
+
+			if got := drainAll(sb); got != nil {
+				t.Errorf("expected empty buffer after drain, got %d items", len(got))
+			}
+		})
+	}
+}
+
+func TestShardedRingBuffer_SlotReuse(t *testing.T) {
+	sb := newShardedRingBufferN(1)
+
+	sb.add([]byte("first"), slog.LevelInfo, time.Time{})
+	drainAll(sb)
+	sb.add([]byte("second"), slog.LevelInfo, time.Time{})
+
+	if got := drainAll(sb); !equalByteSlices(got, [][]byte{[]byte("second")}) {
+		t.Errorf("expected reused slot to hold new data, got %q", got)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		sb.add([]byte("steady state"), slog.LevelInfo, time.Time{})
+		sb.drainTo(func([]byte, time.Time) {})
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations in steady state, got %v", allocs)
+	}
+}
+
+func TestShardedRingBuffer_TimesAndDropped(t *testing.T) {
+	sb := newShardedRingBufferN(1)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < ringBufferSize+5; i++ {
+		sb.add([]byte(fmt.Sprint(i)), slog.LevelInfo, base.Add(time.Duration(i)*time.Second))
+	}
+
+	if got := sb.takeDropped(); got != 5 {
+		t.Errorf("expected 5 dropped entries, got %d", got)
+	}
+	if got := sb.takeDropped(); got != 0 {
+		t.Errorf("expected dropped counter to reset, got %d", got)
+	}
+
+	i := 5
+	sb.drainTo(func(line []byte, ts time.Time) {
+		if want := base.Add(time.Duration(i) * time.Second); !ts.Equal(want) {
+			t.Errorf("line %s: expected time %v, got %v", line, want, ts)
+		}
+		i++
+	})
+}
+
+func TestShardedRingBuffer_GlobalEviction(t *testing.T) {
+	sb := newShardedRingBufferN(2)
+
+	// Alternate levels so that one shard holds every DEBUG and the other
+	// every ERROR
+	for i := 0; i < ringBufferSize; i++ {
+		level := slog.LevelDebug
+		if i%2 == 1 {
+			level = slog.LevelError
+		}
+		sb.add([]byte(fmt.Sprint(i)), level, time.Time{})
+	}
+
+	// More ERRORs must evict the DEBUGs, even those written to the shard
+	// full of ERRORs
+	for i := 0; i < ringBufferSize/2; i++ {
+		sb.add([]byte(fmt.Sprint("late ", i)), slog.LevelError, time.Time{})
+	}
+	// Nothing less severe than what is left gets in
+	sb.add([]byte("info"), slog.LevelInfo, time.Time{})
+
+	if got := sb.takeDropped(); got != ringBufferSize/2+1 {
+		t.Errorf("expected %d dropped entries, got %d", ringBufferSize/2+1, got)
+	}
+
+	var want [][]byte
+	for i := 1; i < ringBufferSize; i += 2 {
+		want = append(want, []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < ringBufferSize/2; i++ {
+		want = append(want, []byte(fmt.Sprint("late ", i)))
+	}
+
+	if got := drainAll(sb); !equalByteSlices(got, want) {
+		t.Errorf("expected every ERROR in write order, got %d entries starting with %q", len(got), got[:min(len(got), 4)])
+	}
+}
+
+func TestShardedRingBuffer_ConcurrentAccess(t *testing.T) {
+	sb := newShardedRingBufferN(4)
+	const numGoroutines = 10
+	const itemsPerGoroutine = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < itemsPerGoroutine; j++ {
+				sb.add([]byte{byte(id), byte(j)}, slog.LevelInfo, time.Time{})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got := drainAll(sb)
+	if len(got) != numGoroutines*itemsPerGoroutine {
+		t.Fatalf("expected %d items, got %d", numGoroutines*itemsPerGoroutine, len(got))
+	}
+
+	// Each writer's lines must come out in the order it wrote them
+	last := map[byte]int{}
+	for _, line := range got {
+		if prev, ok := last[line[0]]; ok && int(line[1]) <= prev {
+			t.Fatalf("writer %d out of order: %d after %d", line[0], line[1], prev)
+		}
+		last[line[0]] = int(line[1])
+	}
+}
+
+var benchLine = []byte(`{"time":"2025-01-01T00:00:00Z","level":"INFO","source":{"function":"main.main","file":"main.go","line":42},"msg":"request handled","path":"/","status":200}` + "\n")
+
+// baselineRingBuffer is the client buffer before sharding: one mutex and a
+// bytes.Clone per line. The benchmarks compare against it.
+type baselineRingBuffer struct {
+	mu     sync.Mutex
+	buffer [][]byte
+	head   int
+	tail   int
+	count  int
+}
+
+func newBaselineRingBuffer() *baselineRingBuffer {
+	return &baselineRingBuffer{buffer: make([][]byte, ringBufferSize)}
+}
+
+func (rb *baselineRingBuffer) add(data []byte) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.count == ringBufferSize {
+		rb.tail = (rb.tail + 1) % ringBufferSize
+	} else {
+		rb.count++
+	}
+
+	rb.buffer[rb.head] = bytes.Clone(data)
+	rb.head = (rb.head + 1) % ringBufferSize
+}
+
+func (rb *baselineRingBuffer) drain() [][]byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	result := make([][]byte, rb.count)
+	for i := range rb.count {
+		result[i] = rb.buffer[(rb.tail+i)%ringBufferSize]
+	}
+	rb.count, rb.head, rb.tail = 0, 0, 0
+
+	return result
+}
+
+func BenchmarkBaselineRingBuffer_Add(b *testing.B) {
+	rb := newBaselineRingBuffer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rb.add(benchLine)
+		}
+	})
+}
+
+func BenchmarkShardedRingBuffer_Add(b *testing.B) {
+	sb := newShardedRingBuffer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sb.add(benchLine, slog.LevelInfo, time.Time{})
+		}
+	})
+}
+
+func BenchmarkBaselineRingBuffer_AddDrain(b *testing.B) {
+	rb := newBaselineRingBuffer()
+	buf := bytes.NewBuffer(nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		for range 256 {
+			rb.add(benchLine)
+		}
+		buf.Reset()
+		for _, line := range rb.drain() {
+			buf.Write(line)
+		}
+	}
+}
+
+func BenchmarkShardedRingBuffer_AddDrain(b *testing.B) {
+	sb := newShardedRingBuffer()
+	buf := bytes.NewBuffer(nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		for range 256 {
+			sb.add(benchLine, slog.LevelInfo, time.Time{})
+		}
+		buf.Reset()
+		sb.drainTo(func(line []byte, _ time.Time) { buf.Write(line) })
+	}
+}
@@ -1,7 +1,7 @@
 package alexandria
 
 import (
-	"bytes"
+	"log/slog"
 	"sync"
 	"time"
 )
@@ -9,39 +9,216 @@ import (
 const (
 	defaultAlexandriaURL = "https://alexandria.probably-not-malware.lol"
 	ringBufferSize       = 1024
+	maxPooledLineSize    = 16 << 10
 	flushInterval        = 5 * time.Second
 )
 
-// ringBuffer is a simple ring buffer for storing log entries
+// ringBuffer is a ring buffer for storing log entries. When it is full, the
+// oldest entry of the lowest severity is evicted first.
+//
+// Entries are linked from oldest to newest, and the entries of each level
+// are linked the same way, so an entry can be evicted from the middle without
+// moving the others. An evicted entry's slot is reused right away, so tail is
+// the slot of the oldest entry and head one past the slot of the newest, as
+// in a plain ring buffer.
 type ringBuffer struct {
 	mu     sync.RWMutex
+	size   int
 	buffer [][]byte
-	head   int
-	tail   int
-	count  int
+	levels []slog.Level
+	seqs   []uint64
+	times  []time.Time
+
+	// prev and next link entries in write order, prevLevel and nextLevel
+	// link the entries of one level. -1 ends a list.
+	prev, next           []int
+	prevLevel, nextLevel []int
+	byLevel              map[slog.Level]levelList
+
+	// free is the slot of an evicted entry waiting to be reused, or -1.
+	free int
+
+	head  int
+	tail  int
+	count int
+}
+
+// levelList is the oldest and newest entry of one level.
+type levelList struct {
+	first, last, n int
 }
 
 func newRingBuffer() *ringBuffer {
+	return newRingBufferSize(ringBufferSize)
+}
+
+func newRingBufferSize(size int) *ringBuffer {
 	return &ringBuffer{
-		buffer: make([][]byte, ringBufferSize),
+		size:      size,
+		buffer:    make([][]byte, size),
+		levels:    make([]slog.Level, size),
+		seqs:      make([]uint64, size),
+		times:     make([]time.Time, size),
+		prev:      make([]int, size),
+		next:      make([]int, size),
+		prevLevel: make([]int, size),
+		nextLevel: make([]int, size),
+		byLevel:   map[slog.Level]levelList{},
+		free:      -1,
 	}
 }
 
 func (rb *ringBuffer) add(data []byte) {
+	rb.addLevel(data, parseLine(data).Level)
+}
+
+func (rb *ringBuffer) addLevel(data []byte, level slog.Level) {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
-	if rb.count == ringBufferSize {
-		// Buffer is full, overwrite oldest entry
-		rb.tail = (rb.tail + 1) % ringBufferSize
+	rb.push(data, level, 0, time.Time{})
+}
+
+// push stores a copy of data, evicting the oldest entry of the lowest level
+// if the buffer is full. It reports whether an entry had to be dropped to
+// make room, which is data itself if everything buffered is more severe. The
+// caller must hold rb.mu.
+func (rb *ringBuffer) push(data []byte, level slog.Level, seq uint64, t time.Time) (dropped bool) {
+	if rb.count == rb.size {
+		// Everything buffered is more important than this entry, drop it
+		if lowest, _, _ := rb.lowest(); level < lowest {
+			return true
+		}
+
+		rb.evictLowest()
+		dropped = true
+	}
+
+	rb.insert(data, level, seq, t)
+	return
+}
+
+// full reports whether every slot is taken. The caller must hold rb.mu.
+func (rb *ringBuffer) full() bool {
+	return rb.count == rb.size
+}
+
+// lowest returns the lowest level buffered and the sequence number of its
+// oldest entry, or false if the buffer is empty. The caller must hold rb.mu.
+func (rb *ringBuffer) lowest() (slog.Level, uint64, bool) {
+	found := false
+	var result slog.Level
+	for lvl, l := range rb.byLevel {
+		if l.n > 0 && (!found || lvl < result) {
+			result = lvl
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, 0, false
+	}
+	return result, rb.seqs[rb.byLevel[result].first], true
+}
+
+// evictLowest removes the oldest entry of the lowest level, keeping its slot
+// for the next insert. The caller must hold rb.mu.
+func (rb *ringBuffer) evictLowest() {
+	lvl, _, ok := rb.lowest()
+	if !ok {
+		return
+	}
+
+	slot := rb.byLevel[lvl].first
+	rb.unlink(slot)
+	rb.free = slot
+}
+
+// unlink removes the entry in slot from both of its lists. The caller must
+// hold rb.mu.
+func (rb *ringBuffer) unlink(slot int) {
+	p, n := rb.prev[slot], rb.next[slot]
+	if p >= 0 {
+		rb.next[p] = n
+	} else if n >= 0 {
+		rb.tail = n
+	}
+	if n >= 0 {
+		rb.prev[n] = p
+	} else if p >= 0 {
+		rb.head = (p + 1) % rb.size
+	}
+
+	level := rb.levels[slot]
+	l := rb.byLevel[level]
+	p, n = rb.prevLevel[slot], rb.nextLevel[slot]
+	if p >= 0 {
+		rb.nextLevel[p] = n
+	} else {
+		l.first = n
+	}
+	if n >= 0 {
+		rb.prevLevel[n] = p
+	} else {
+		l.last = p
+	}
+	l.n--
+	rb.byLevel[level] = l
+
+	rb.count--
+}
+
+// insert stores a copy of data as the newest entry, reusing the slot's
+// previous backing array when it has one. The buffer must not be full and
+// the caller must hold rb.mu.
+func (rb *ringBuffer) insert(data []byte, level slog.Level, seq uint64, t time.Time) {
+	// Slots are only freed by eviction, which is always followed by an
+	// insert, so otherwise the taken slots are the first count ones
+	slot := rb.free
+	if slot >= 0 {
+		rb.free = -1
+	} else {
+		slot = rb.count
+	}
+
+	buf := rb.buffer[slot]
+	if cap(buf) > maxPooledLineSize {
+		buf = nil
+	}
+	rb.buffer[slot] = append(buf[:0], data...)
+	rb.levels[slot] = level
+	rb.seqs[slot] = seq
+	rb.times[slot] = t
+
+	rb.next[slot] = -1
+	if rb.count == 0 {
+		rb.prev[slot] = -1
+		rb.tail = slot
+	} else {
+		newest := (rb.head - 1 + rb.size) % rb.size
+		rb.prev[slot] = newest
+		rb.next[newest] = slot
+	}
+	rb.head = (slot + 1) % rb.size
+
+	l, ok := rb.byLevel[level]
+	if !ok || l.n == 0 {
+		l = levelList{first: slot, last: slot}
+		rb.prevLevel[slot] = -1
 	} else {
-		rb.count++
+		rb.prevLevel[slot] = l.last
+		rb.nextLevel[l.last] = slot
+		l.last = slot
 	}
+	rb.nextLevel[slot] = -1
+	l.n++
+	rb.byLevel[level] = l
 
-	rb.buffer[rb.head] = bytes.Clone(data)
-	rb.head = (rb.head + 1) % ringBufferSize
+	rb.count++
 }
 
+// drain removes and returns every buffered entry. Ownership of the returned
+// slices passes to the caller.
 func (rb *ringBuffer) drain() [][]byte {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
@@ -50,15 +227,23 @@ func (rb *ringBuffer) drain() [][]byte {
 		return nil
 	}
 
-	result := make([][]byte, rb.count)
-	for i := 0; i < rb.count; i++ {
-		idx := (rb.tail + i) % ringBufferSize
-		result[i] = rb.buffer[idx]
+	result := make([][]byte, 0, rb.count)
+	for idx := rb.tail; len(result) < rb.count; idx = rb.next[idx] {
+		result = append(result, rb.buffer[idx])
+		rb.buffer[idx] = nil
 	}
 
+	rb.reset()
+
+	return result
+}
+
+// reset empties the buffer while keeping slot backing arrays for reuse. The
+// caller must hold rb.mu.
+func (rb *ringBuffer) reset() {
+	clear(rb.byLevel)
+	rb.free = -1
 	rb.count = 0
 	rb.head = 0
 	rb.tail = 0
-
-	return result
 }
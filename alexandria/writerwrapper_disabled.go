@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"time"
 )
 
 func Writer(kind string, logID string, next io.Writer) *WriterWrapper {
@@ -28,6 +29,14 @@ type WriterWrapper struct {
 
 func (ww *WriterWrapper) SetBaseURL(baseURL string) {}
 
+func (ww *WriterWrapper) SetTransport(t Transport) {}
+
+func (ww *WriterWrapper) SetMinLevel(level slog.Level) {}
+
+func (ww *WriterWrapper) SetInfoSampleRate(rate float64) {}
+
+func (ww *WriterWrapper) SetMessageRateLimit(limit int, window time.Duration) {}
+
 func (ww *WriterWrapper) Write(data []byte) (n int, err error) {
 	return ww.next.Write(data)
 }
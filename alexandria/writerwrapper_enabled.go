@@ -10,6 +10,8 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,7 +35,9 @@ func Writer(kind string, logID string, next io.Writer) *WriterWrapper {
 		kind:    kind,
 		logID:   logID,
 		rawLog:  lg,
-		rb:      newRingBuffer(),
+		rb:      newShardedRingBuffer(),
+		filter:  newFilter(),
+		meta:    CurrentMetadata(),
 		done:    make(chan struct{}),
 	}
 
@@ -46,34 +50,92 @@ func Writer(kind string, logID string, next io.Writer) *WriterWrapper {
 }
 
 type WriterWrapper struct {
-	rb      *ringBuffer
+	rb      *shardedRingBuffer
+	filter  *filter
 	next    io.Writer
 	baseURL string
 	kind    string
 	logID   string
 	rawLog  *slog.Logger
+	meta    Metadata
 	done    chan struct{}
+
+	// protocol is the upload protocol version to use. It starts at v1 and
+	// switches to v2 once the server advertises it.
+	protocol atomic.Int32
+
+	// transport replaces HTTP when set.
+	transport atomic.Pointer[Transport]
+
+	// directives are the server's directives for this logID while they
+	// apply.
+	directives atomic.Pointer[Directives]
 }
 
 func (ww *WriterWrapper) SetBaseURL(baseURL string) {
 	ww.baseURL = baseURL
 }
 
+// SetMinLevel sets the minimum slog level of lines shipped to Alexandria.
+// Lines at or above ERROR are always shipped.
+func (ww *WriterWrapper) SetMinLevel(level slog.Level) {
+	if ww.filter != nil {
+		ww.filter.setMinLevel(level)
+	}
+}
+
+// SetInfoSampleRate sets the fraction (0 to 1) of lines below WARN that are
+// shipped to Alexandria.
+func (ww *WriterWrapper) SetInfoSampleRate(rate float64) {
+	if ww.filter != nil {
+		ww.filter.setInfoSampleRate(rate)
+	}
+}
+
+// SetMessageRateLimit limits how many lines with the same message are shipped
+// to Alexandria per window. A limit of zero disables rate limiting.
+func (ww *WriterWrapper) SetMessageRateLimit(limit int, window time.Duration) {
+	if ww.filter != nil {
+		ww.filter.setRateLimit(limit, window)
+	}
+}
+
+// SetTransport sends logs through t instead of HTTP. Passing nil goes back to
+// HTTP.
+func (ww *WriterWrapper) SetTransport(t Transport) {
+	if t == nil {
+		ww.transport.Store(nil)
+		return
+	}
+	ww.transport.Store(&t)
+}
+
 func (ww *WriterWrapper) Write(data []byte) (n int, err error) {
-	if ww.rb != nil {
-		ww.rb.add(data)
+	if ww.rb != nil && !ww.paused() {
+		if ll := parseLine(data); ww.filter.allow(ll) {
+			t := ll.Time
+			if t.IsZero() {
+				t = time.Now()
+			}
+			ww.rb.add(data, ll.Level, t)
+		}
 	}
 	return ww.next.Write(data)
 }
 
 func (ww *WriterWrapper) flushLoop() {
-	ticker := time.NewTicker(flushInterval)
+	interval := ww.flushInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			ww.flush()
+			if next := ww.flushInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		case <-ww.done:
 			// Final flush before exit
 			ww.flush()
@@ -87,39 +149,245 @@ func (ww *WriterWrapper) Close() error {
 	return nil
 }
 
+// flushInterval is how often buffered lines are uploaded.
+func (ww *WriterWrapper) flushInterval() time.Duration {
+	if d := ww.directives.Load(); d != nil && d.FlushInterval != 0 {
+		return d.FlushInterval
+	}
+	return flushInterval
+}
+
+// paused reports whether the server asked for lines not to be shipped.
+func (ww *WriterWrapper) paused() bool {
+	d := ww.directives.Load()
+	return d != nil && d.Pause
+}
+
+// applyDirectives switches to the server's directives d if they are newer
+// than the ones applied. A nil d leaves the applied directives alone: a
+// server that hasn't seen them yet sends none, so they only end when they
+// expire or newer ones replace them.
+func (ww *WriterWrapper) applyDirectives(d *Directives) {
+	if d == nil || !time.Now().Before(d.Expires) {
+		return
+	}
+	if old := ww.directives.Load(); old != nil && old.Version >= d.Version {
+		return
+	}
+	ww.directives.Store(d)
+	ww.filter.setOverride(d.MinLevel, d.SampleRate)
+
+	if d.empty() {
+		ww.rawLog.Info("alexandria directives cleared, going back to local settings", "version", d.Version)
+		return
+	}
+	ww.rawLog.Info("applying alexandria directives", "version", d.Version, "expires", d.Expires, "minLevel", d.MinLevel, "sampleRate", d.SampleRate, "flushInterval", d.FlushInterval, "pause", d.Pause)
+}
+
+// expireDirectives goes back to the writer's own settings once the applied
+// directives expire.
+func (ww *WriterWrapper) expireDirectives() {
+	d := ww.directives.Load()
+	if d == nil || time.Now().Before(d.Expires) {
+		return
+	}
+	ww.directives.Store(nil)
+	ww.filter.setOverride(nil, nil)
+
+	if !d.empty() {
+		ww.rawLog.Info("alexandria directives expired, going back to local settings", "version", d.Version)
+	}
+}
+
+// handleDirectives applies the directives in the headers of a response.
+func (ww *WriterWrapper) handleDirectives(h http.Header) {
+	d, err := DirectivesFromHeader(h)
+	if err != nil {
+		ww.rawLog.Error("can't apply alexandria directives", "err", err)
+		return
+	}
+	ww.applyDirectives(d)
+}
+
+// appliedDirectives is the version of the directives being applied, or 0 if
+// there are none.
+func (ww *WriterWrapper) appliedDirectives() int64 {
+	if d := ww.directives.Load(); d != nil {
+		return d.Version
+	}
+	return 0
+}
+
+// setDirectivesApplied reports the version of the directives being applied
+// on a request.
+func (ww *WriterWrapper) setDirectivesApplied(h http.Header) {
+	h.Set(HeaderDirectivesApplied, strconv.FormatInt(ww.appliedDirectives(), 10))
+}
+
 func (ww *WriterWrapper) flush() {
-	lines := ww.rb.drain()
-	if len(lines) == 0 {
+	ww.expireDirectives()
+
+	if ww.paused() {
+		ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+		defer cancel()
+		ww.poll(ctx)
+		return
+	}
+
+	transport := ww.transport.Load()
+	useV2 := transport != nil || ww.protocol.Load() == ProtocolV2
+
+	buf := bytes.NewBuffer(nil)
+	var records []Record
+	n := ww.rb.drainTo(func(line []byte, t time.Time) {
+		if useV2 {
+			records = append(records, Record{Time: t, Line: string(bytes.TrimSuffix(line, []byte("\n")))})
+			return
+		}
+		buf.Write(line)
+	})
+	if n == 0 {
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
 	defer cancel()
 
-	ww.submit(ctx, lines)
+	if !useV2 {
+		ww.submit(ctx, buf)
+		return
+	}
+
+	env := &Envelope{
+		Version: ProtocolV2,
+		Kind:    ww.kind,
+		LogID:   ww.logID,
+		Meta:    ww.meta,
+		Dropped: ww.rb.takeDropped(),
+		Records: records,
+	}
+
+	if transport != nil {
+		ww.send(ctx, *transport, env)
+		return
+	}
+
+	if ww.submitV2(ctx, env) {
+		return
+	}
+
+	// The server stopped accepting v2, fall back to v1 for this batch
+	for _, rec := range records {
+		buf.WriteString(rec.Line)
+		buf.WriteByte('\n')
+	}
+	ww.submit(ctx, buf)
 }
 
-func (ww *WriterWrapper) submit(ctx context.Context, lines [][]byte) {
-	buf := bytes.NewBuffer(nil)
+// send delivers env through t, applying the directives it answers with if
+// it carries them.
+func (ww *WriterWrapper) send(ctx context.Context, t Transport, env *Envelope) {
+	dt, ok := t.(DirectivesTransport)
+	if !ok {
+		if err := t.Send(ctx, env); err != nil {
+			ww.rawLog.Error("can't send logs to alexandria", "err", err)
+		}
+		return
+	}
 
-	for _, line := range lines {
-		buf.Write(line)
+	d, err := dt.SendDirectives(ctx, env, ww.appliedDirectives())
+	if err != nil {
+		ww.rawLog.Error("can't send logs to alexandria", "err", err)
+		return
 	}
+	ww.applyDirectives(d)
+}
 
+func (ww *WriterWrapper) submit(ctx context.Context, buf *bytes.Buffer) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/upload/%s/%s", ww.baseURL, ww.kind, ww.logID), buf)
 	if err != nil {
 		ww.rawLog.Error("can't create request to alexandria", "err", err)
 		return
 	}
+	ww.meta.SetHeaders(req.Header)
+	ww.setDirectivesApplied(req.Header)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		ww.rawLog.Error("can't perform request to alexandria", "err", err)
 		return
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		ww.rawLog.Error("wrong alexandria response code", "status", resp.StatusCode, "want", http.StatusOK)
 		return
 	}
+
+	if SupportsProtocol(resp.Header.Get(HeaderProtocols), ProtocolV2) {
+		ww.protocol.Store(ProtocolV2)
+	}
+	ww.handleDirectives(resp.Header)
+}
+
+// submitV2 uploads env with protocol v2. It returns false if the server no
+// longer supports v2, after switching this writer back to v1.
+func (ww *WriterWrapper) submitV2(ctx context.Context, env *Envelope) bool {
+	buf := bytes.NewBuffer(nil)
+	if err := env.Encode(buf); err != nil {
+		ww.rawLog.Error("can't encode envelope for alexandria", "err", err)
+		return true
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ww.baseURL+IngestV2Path, buf)
+	if err != nil {
+		ww.rawLog.Error("can't create request to alexandria", "err", err)
+		return true
+	}
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	ww.setDirectivesApplied(req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ww.rawLog.Error("can't perform request to alexandria", "err", err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ww.handleDirectives(resp.Header)
+		return true
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		ww.protocol.Store(ProtocolV1)
+		return false
+	default:
+		ww.rawLog.Error("wrong alexandria response code", "status", resp.StatusCode, "want", http.StatusOK)
+		return true
+	}
+}
+
+// poll asks the server for directives while paused, since there are no
+// uploads to carry them. It polls over HTTP even when a Transport is set.
+func (ww *WriterWrapper) poll(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s/%s/%s", ww.baseURL, DirectivesPath, ww.kind, ww.logID), nil)
+	if err != nil {
+		ww.rawLog.Error("can't create request to alexandria", "err", err)
+		return
+	}
+	ww.setDirectivesApplied(req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ww.rawLog.Error("can't perform request to alexandria", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		ww.handleDirectives(resp.Header)
+	default:
+		ww.rawLog.Error("wrong alexandria response code", "status", resp.StatusCode, "want", http.StatusOK)
+	}
 }
@@ -0,0 +1,260 @@
+//go:build !limitedsupportability
+
+package alexandria
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriterWrapper_ProtocolNegotiation(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requests  []string
+		envelopes []*Envelope
+		v2Enabled = true
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch {
+		case r.Method == http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			if v2Enabled {
+				w.Header().Set(HeaderProtocols, "1, 2")
+			}
+		case r.Method == http.MethodPost && r.URL.Path == IngestV2Path && v2Enabled:
+			env, err := DecodeEnvelope(r.Body, r.Header.Get("Content-Type"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			envelopes = append(envelopes, env)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ww := Writer("techaro.anubis", "anubis_01jz4k5n8v", io.Discard)
+	defer ww.Close()
+	ww.SetBaseURL(srv.URL)
+
+	line := []byte(`{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"hello"}` + "\n")
+
+	// First flush uses v1 and learns that the server speaks v2
+	ww.Write(line)
+	ww.flush()
+
+	// Second flush uses v2
+	ww.Write(line)
+	ww.flush()
+
+	// Server rolls back, so the client falls back to v1 for the same batch
+	mu.Lock()
+	v2Enabled = false
+	mu.Unlock()
+	ww.Write(line)
+	ww.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{
+		"PUT /upload/techaro.anubis/anubis_01jz4k5n8v",
+		"POST " + IngestV2Path,
+		"POST " + IngestV2Path,
+		"PUT /upload/techaro.anubis/anubis_01jz4k5n8v",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected requests %q, got %q", expected, requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("request %d: expected %q, got %q", i, expected[i], requests[i])
+		}
+	}
+
+	if len(envelopes) != 1 {
+		t.Fatalf("expected 1 envelope, got %d", len(envelopes))
+	}
+
+	env := envelopes[0]
+	if env.Kind != "techaro.anubis" || env.LogID != "anubis_01jz4k5n8v" || env.Version != ProtocolV2 {
+		t.Errorf("unexpected envelope header: %+v", env)
+	}
+	if len(env.Records) != 1 || env.Records[0].Line != string(line[:len(line)-1]) {
+		t.Errorf("unexpected records: %+v", env.Records)
+	}
+	if env.Records[0].Time.IsZero() {
+		t.Error("expected record time to come from the slog line")
+	}
+	if env.Meta.GoVersion == "" {
+		t.Error("expected metadata in envelope")
+	}
+}
+
+func TestWriterWrapper_Directives(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		answer   *Directives
+	)
+
+	paused := &Directives{Version: 3, Expires: time.Now().Add(time.Hour), FlushInterval: 5 * time.Second, Pause: true}
+	stale := &Directives{Version: 2, Expires: time.Now().Add(time.Hour)}
+	cleared := &Directives{Version: 4, Expires: time.Now().Add(time.Hour)}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, r.Method+" "+r.URL.Path+" applied="+r.Header.Get(HeaderDirectivesApplied))
+		io.Copy(io.Discard, r.Body)
+
+		if answer != nil {
+			answer.SetHeader(w.Header())
+		} else if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	setAnswer := func(d *Directives) {
+		mu.Lock()
+		defer mu.Unlock()
+		answer = d
+	}
+
+	ww := Writer("techaro.anubis", "anubis_01jz4k5n8v", io.Discard)
+	defer ww.Close()
+	ww.SetBaseURL(srv.URL)
+
+	line := []byte(`{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"hello"}` + "\n")
+
+	// The upload's response pauses the client
+	setAnswer(paused)
+	ww.Write(line)
+	ww.flush()
+	if !ww.paused() || ww.flushInterval() != 5*time.Second {
+		t.Fatalf("expected directives to be applied, got %+v", ww.directives.Load())
+	}
+
+	// Lines written while paused are dropped and the client polls instead.
+	// Servers that don't know the directives yet or only know older ones
+	// don't end them.
+	ww.Write(line)
+	setAnswer(nil)
+	ww.flush()
+	setAnswer(stale)
+	ww.flush()
+	if !ww.paused() || ww.directives.Load().Version != 3 {
+		t.Fatalf("expected directives to stay applied, got %+v", ww.directives.Load())
+	}
+
+	// The server clears the directives, so the client resumes
+	setAnswer(cleared)
+	ww.flush()
+	if ww.paused() || ww.flushInterval() != flushInterval {
+		t.Fatalf("expected directives to be cleared, got %+v", ww.directives.Load())
+	}
+
+	ww.Write(line)
+	ww.flush()
+
+	// Directives end once they expire
+	ww.directives.Store(&Directives{Version: 5, Expires: time.Now().Add(-time.Second), Pause: true})
+	ww.flush()
+	if ww.directives.Load() != nil {
+		t.Errorf("expected expired directives to end, got %+v", ww.directives.Load())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{
+		"PUT /upload/techaro.anubis/anubis_01jz4k5n8v applied=0",
+		"GET " + DirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v applied=3",
+		"GET " + DirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v applied=3",
+		"GET " + DirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v applied=3",
+		"PUT /upload/techaro.anubis/anubis_01jz4k5n8v applied=4",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected requests %q, got %q", expected, requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("request %d: expected %q, got %q", i, expected[i], requests[i])
+		}
+	}
+}
+
+type directivesTransport struct {
+	applied []int64
+	answer  *Directives
+}
+
+func (dt *directivesTransport) Send(ctx context.Context, env *Envelope) error {
+	_, err := dt.SendDirectives(ctx, env, 0)
+	return err
+}
+
+func (dt *directivesTransport) SendDirectives(_ context.Context, _ *Envelope, applied int64) (*Directives, error) {
+	dt.applied = append(dt.applied, applied)
+	return dt.answer, nil
+}
+
+func TestWriterWrapper_TransportDirectives(t *testing.T) {
+	dt := &directivesTransport{answer: &Directives{Version: 7, Expires: time.Now().Add(time.Hour), FlushInterval: 10 * time.Second}}
+
+	ww := Writer("techaro.anubis", "anubis_01jz4k5n8v", io.Discard)
+	defer ww.Close()
+	ww.SetTransport(dt)
+
+	line := []byte(`{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"hello"}` + "\n")
+	ww.Write(line)
+	ww.flush()
+	ww.Write(line)
+	ww.flush()
+
+	if ww.flushInterval() != 10*time.Second {
+		t.Errorf("expected the transport's directives to be applied, got %+v", ww.directives.Load())
+	}
+	if len(dt.applied) != 2 || dt.applied[0] != 0 || dt.applied[1] != 7 {
+		t.Errorf("expected applied versions [0 7], got %v", dt.applied)
+	}
+}
+
+// BenchmarkWriterWrapper_Write compares Write against the baseline client,
+// which took one lock and cloned every line without parsing it.
+func BenchmarkWriterWrapper_Write(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		rb := newBaselineRingBuffer()
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rb.add(benchLine)
+				io.Discard.Write(benchLine)
+			}
+		})
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		ww := &WriterWrapper{rb: newShardedRingBuffer(), filter: newFilter(), next: io.Discard}
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ww.Write(benchLine)
+			}
+		})
+	})
+}
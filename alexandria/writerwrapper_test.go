@@ -2,6 +2,8 @@ package alexandria
 
 import (
 	"bytes"
+	"fmt"
+	"log/slog"
 	"sync"
 	"testing"
 )
@@ -269,6 +271,126 @@ func TestRingBuffer_AddAfterDrain(t *testing.T) {
 	}
 }
 
+func TestRingBuffer_PriorityEviction(t *testing.T) {
+	tests := []struct {
+		name          string
+		fill          slog.Level
+		special       map[int]slog.Level
+		incoming      slog.Level
+		expectDropped int
+		expectLast    bool
+	}{
+		{
+			name:          "same level evicts oldest",
+			fill:          slog.LevelInfo,
+			incoming:      slog.LevelInfo,
+			expectDropped: 0,
+			expectLast:    true,
+		},
+		{
+			name:          "error at tail survives info flood",
+			fill:          slog.LevelInfo,
+			special:       map[int]slog.Level{0: slog.LevelError},
+			incoming:      slog.LevelInfo,
+			expectDropped: 1,
+			expectLast:    true,
+		},
+		{
+			name:          "oldest debug evicted before info",
+			fill:          slog.LevelInfo,
+			special:       map[int]slog.Level{10: slog.LevelDebug, 20: slog.LevelDebug},
+			incoming:      slog.LevelInfo,
+			expectDropped: 10,
+			expectLast:    true,
+		},
+		{
+			name:          "incoming lower than everything is dropped",
+			fill:          slog.LevelWarn,
+			incoming:      slog.LevelInfo,
+			expectDropped: -1,
+			expectLast:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := newRingBuffer()
+
+			for i := 0; i < ringBufferSize; i++ {
+				level, ok := tt.special[i]
+				if !ok {
+					level = tt.fill
+				}
+				rb.addLevel([]byte(fmt.Sprint(i)), level)
+			}
+
+			rb.addLevel([]byte("incoming"), tt.incoming)
+
+			result := rb.drain()
+			if len(result) != ringBufferSize {
+				t.Fatalf("expected %d items, got %d", ringBufferSize, len(result))
+			}
+
+			// Remaining original entries must be in insertion order without
+			// the evicted one
+			var want [][]byte
+			for i := 0; i < ringBufferSize; i++ {
+				if i != tt.expectDropped {
+					want = append(want, []byte(fmt.Sprint(i)))
+				}
+			}
+			if tt.expectLast {
+				want = append(want, []byte("incoming"))
+			}
+
+			if !equalByteSlices(result, want) {
+				t.Errorf("drain order mismatch: first=%q last=%q", result[0], result[len(result)-1])
+			}
+		})
+	}
+}
+
+func TestRingBuffer_PriorityEvictionWraparound(t *testing.T) {
+	rb := newRingBuffer()
+
+	// Move head and tail away from zero before filling
+	for i := 0; i < 10; i++ {
+		rb.add([]byte("warmup"))
+	}
+	rb.drain()
+	for i := 0; i < ringBufferSize+10; i++ {
+		rb.addLevel([]byte("info"), slog.LevelInfo)
+	}
+
+	rb.addLevel([]byte("error"), slog.LevelError)
+	for i := 0; i < ringBufferSize*2; i++ {
+		rb.addLevel([]byte("info"), slog.LevelInfo)
+	}
+
+	result := rb.drain()
+	if len(result) != ringBufferSize {
+		t.Fatalf("expected %d items, got %d", ringBufferSize, len(result))
+	}
+
+	if !bytes.Equal(result[0], []byte("error")) {
+		t.Errorf("expected error line to survive at the front, got %q", result[0])
+	}
+}
+
+func TestRingBuffer_AddParsesLevel(t *testing.T) {
+	rb := newRingBuffer()
+
+	rb.add([]byte(`{"level":"ERROR","msg":"outage"}`))
+	for i := 0; i < ringBufferSize; i++ {
+		rb.add([]byte(`{"level":"INFO","msg":"noise"}`))
+	}
+
+	result := rb.drain()
+	if !bytes.Equal(result[0], []byte(`{"level":"ERROR","msg":"outage"}`)) {
+		t.Errorf("expected error line to be kept, got %q", result[0])
+	}
+}
+
 // Helper functions
 func generateTestData(count int) [][]byte {
 	result := make([][]byte, count)
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// maxNotificationSize bounds object notification request bodies.
+	maxNotificationSize = 1 << 20
+
+	// analyzeTimeout bounds fetching and analyzing the batches of one
+	// notification.
+	analyzeTimeout = 2 * time.Minute
+)
+
+// objectGetter is the part of *s3.Client the analyze worker uses.
+type objectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// logBatch is a batch written by uploadBatch, read back for analysis.
+type logBatch struct {
+	Bucket  string
+	Key     string
+	Kind    string
+	Entries []batch.Entry
+}
+
+// finding is something an analyzer noticed in a batch.
+type finding struct {
+	Analyzer string         `json:"analyzer"`
+	Kind     string         `json:"kind"`
+	LogID    string         `json:"logID,omitempty"`
+	Severity string         `json:"severity"`
+	Summary  string         `json:"summary"`
+	Details  map[string]any `json:"details,omitempty"`
+	Batch    string         `json:"batch"`
+	Time     time.Time      `json:"time"`
+}
+
+// Finding severities.
+const (
+	severityInfo  = "info"
+	severityWarn  = "warn"
+	severityError = "error"
+)
+
+// analyzer inspects batches and reports findings about them. Analyzers add
+// themselves to the registry with registerAnalyzer from an init function.
+type analyzer interface {
+	Name() string
+	Analyze(ctx context.Context, b *logBatch) ([]finding, error)
+}
+
+var analyzers = map[string]analyzer{}
+
+func registerAnalyzer(a analyzer) {
+	if _, ok := analyzers[a.Name()]; ok {
+		panic("analyzer " + a.Name() + " registered twice")
+	}
+	analyzers[a.Name()] = a
+}
+
+// selectAnalyzers returns the named analyzers, or all of them if names is
+// empty.
+func selectAnalyzers(names string) ([]analyzer, error) {
+	var result []analyzer
+	if strings.TrimSpace(names) == "" {
+		for _, name := range slices.Sorted(maps.Keys(analyzers)) {
+			result = append(result, analyzers[name])
+		}
+		return result, nil
+	}
+
+	for name := range strings.SplitSeq(names, ",") {
+		a, ok := analyzers[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown analyzer %q", name)
+		}
+		result = append(result, a)
+	}
+	return result, nil
+}
+
+// objectNotification is one object created in a bucket.
+type objectNotification struct {
+	Bucket string
+	Key    string
+}
+
+// parseNotifications reads the objects created according to a Tigris or
+// S3-style object notification. Other events are skipped.
+func parseNotifications(body []byte) ([]objectNotification, error) {
+	var msg struct {
+		// Tigris
+		Events []struct {
+			EventName string `json:"eventName"`
+			Bucket    string `json:"bucket"`
+			Object    struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"events"`
+
+		// Amazon S3
+		Records []struct {
+			EventName string `json:"eventName"`
+			S3        struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+
+	var result []objectNotification
+	for _, ev := range msg.Events {
+		if strings.HasPrefix(ev.EventName, "OBJECT_CREATED") {
+			result = append(result, objectNotification{Bucket: ev.Bucket, Key: ev.Object.Key})
+		}
+	}
+
+	for _, rec := range msg.Records {
+		if !strings.HasPrefix(rec.EventName, "ObjectCreated:") {
+			continue
+		}
+
+		// S3 URL-encodes keys in notifications
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("can't unescape key %q: %w", rec.S3.Object.Key, err)
+		}
+		result = append(result, objectNotification{Bucket: rec.S3.Bucket.Name, Key: key})
+	}
+
+	return result, nil
+}
+
+// fetchBatch downloads and decodes a batch.
+func fetchBatch(ctx context.Context, s3c objectGetter, bucket, key, kind string) (*logBatch, error) {
+	obj, err := s3c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	result := &logBatch{Bucket: bucket, Key: key, Kind: kind}
+	for entry, err := range batch.Entries(obj.Body) {
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", key, err)
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+
+	return result, nil
+}
+
+// analyzeWorker runs analyzers over batches as object notifications for
+// them arrive.
+type analyzeWorker struct {
+	s3c       objectGetter
+	token     string
+	analyzers []analyzer
+	sinks     []sink
+}
+
+// authorized checks the credentials the notification was sent with.
+func (aw *analyzeWorker) authorized(r *http.Request) bool {
+	return tokenAuthorized(r, aw.token)
+}
+
+// tokenAuthorized checks that r carries token, either as a bearer token or
+// as the password of basic auth.
+func tokenAuthorized(r *http.Request, token string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	}
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Notify handles an object notification webhook. It answers only once every
+// batch has been analyzed and its findings published, and fails if any of
+// that fails so that the notification is retried. Findings are therefore
+// delivered at least once.
+func (aw *analyzeWorker) Notify(w http.ResponseWriter, r *http.Request) {
+	if !aw.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "can't read request", http.StatusBadRequest)
+		return
+	}
+
+	notifications, err := parseNotifications(body)
+	if err != nil {
+		slog.Error("can't parse object notification", "err", err)
+		http.Error(w, "can't parse notification", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), analyzeTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, n := range notifications {
+		if err := aw.process(ctx, n); err != nil {
+			slog.Error("can't analyze batch", "bucket", n.Bucket, "key", n.Key, "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		http.Error(w, errors.Join(errs...).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// process analyzes the batch named by n, if it is one.
+func (aw *analyzeWorker) process(ctx context.Context, n objectNotification) error {
+	kind, ok := batch.ParseKey(n.Key)
+	if !ok {
+		slog.Debug("ignoring object that isn't a batch", "key", n.Key)
+		return nil
+	}
+
+	b, err := fetchBatch(ctx, aw.s3c, n.Bucket, n.Key, kind)
+	if err != nil {
+		analyzedBatchesTotal.WithLabelValues(kind, "error").Inc()
+		return err
+	}
+
+	var errs []error
+	for _, a := range aw.analyzers {
+		findings, err := a.Analyze(ctx, b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Name(), err))
+			continue
+		}
+
+		for _, f := range findings {
+			f.Analyzer = a.Name()
+			f.Kind = b.Kind
+			f.Batch = b.Key
+			if f.Time.IsZero() {
+				f.Time = time.Now().UTC()
+			}
+
+			findingsTotal.WithLabelValues(a.Name(), f.Severity).Inc()
+			if err := aw.publish(ctx, &f); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		analyzedBatchesTotal.WithLabelValues(kind, "error").Inc()
+		return errors.Join(errs...)
+	}
+
+	analyzedBatchesTotal.WithLabelValues(kind, "ok").Inc()
+	slog.Info("analyzed batch", "kind", kind, "key", n.Key, "entries", len(b.Entries))
+	return nil
+}
+
+// publish sends f to every sink, or logs it if there are none.
+func (aw *analyzeWorker) publish(ctx context.Context, f *finding) error {
+	if len(aw.sinks) == 0 {
+		slog.Info("finding", "analyzer", f.Analyzer, "kind", f.Kind, "logID", f.LogID, "severity", f.Severity, "summary", f.Summary)
+		return nil
+	}
+
+	ev := &sinkEvent{Type: sinkEventFinding, Time: f.Time, Kind: f.Kind, Finding: f}
+
+	var errs []error
+	for _, sk := range aw.sinks {
+		if err := sk.Publish(ctx, ev); err != nil {
+			sinkEventsTotal.WithLabelValues(sk.Name(), "error").Inc()
+			errs = append(errs, fmt.Errorf("can't publish finding to %s: %w", sk.Name(), err))
+			continue
+		}
+		sinkEventsTotal.WithLabelValues(sk.Name(), "ok").Inc()
+	}
+
+	return errors.Join(errs...)
+}
+
+// runAnalyze is the analyze subcommand: a worker that receives object
+// notifications for new batches and runs analyzers over them.
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	bind := fs.String("bind", ":8991", "host:port to receive object notifications on")
+	token := fs.String("notification-token", "", "token object notifications must carry, as a bearer token or basic auth password")
+	names := fs.String("analyzers", "", "comma-separated analyzers to run, empty for all")
+	webhookURL := fs.String("findings-webhook-url", "", "URL to POST findings to")
+	webhookSecret := fs.String("findings-webhook-secret", "", "secret used to sign findings webhook requests")
+	natsURL := fs.String("findings-nats-url", "", "NATS server to publish findings to")
+	natsSubject := fs.String("findings-nats-subject", "alexandria", "subject prefix for findings published to NATS")
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		return errors.New("-notification-token is required so notifications can be verified")
+	}
+
+	selected, err := selectAnalyzers(*names)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	aw := &analyzeWorker{
+		s3c:       s3.NewFromConfig(cfg),
+		token:     *token,
+		analyzers: selected,
+	}
+
+	if *webhookURL != "" {
+		aw.sinks = append(aw.sinks, newWebhookSink(*webhookURL, *webhookSecret))
+	}
+	if *natsURL != "" {
+		ns, err := newNATSSink(*natsURL, *natsSubject)
+		if err != nil {
+			return err
+		}
+		aw.sinks = append(aw.sinks, ns)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "OK") })
+	mux.Handle("POST /notify", http.MaxBytesHandler(http.HandlerFunc(aw.Notify), maxNotificationSize))
+
+	go func() {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", promhttp.Handler())
+
+		slog.Info("listening for metrics over HTTP", "bind", *metricsBind)
+		if err := http.ListenAndServe(*metricsBind, metricsMux); err != nil {
+			slog.Error("can't serve metrics", "err", err)
+		}
+	}()
+
+	slog.Info("listening for object notifications", "bind", *bind, "analyzers", len(selected))
+	return http.ListenAndServe(*bind, mux)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// memBucket serves objects from memory.
+type memBucket map[string][]byte
+
+func (mb memBucket) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := mb[*params.Bucket+"/"+*params.Key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+
+	if params.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+			return nil, fmt.Errorf("bad range %q", *params.Range)
+		}
+		data = data[start : end+1]
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func encodeBatch(t *testing.T, entries ...batch.Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if err := json.NewEncoder(&buf).Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestParseNotifications(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []objectNotification
+		wantErr  bool
+	}{
+		{
+			name: "tigris",
+			body: `{"events":[
+				{"eventName":"OBJECT_CREATED_PUT","bucket":"logs","object":{"key":"inp/techaro.anubis/batch-1.jsonl","size":10}},
+				{"eventName":"OBJECT_DELETED","bucket":"logs","object":{"key":"inp/techaro.anubis/batch-0.jsonl"}}
+			]}`,
+			expected: []objectNotification{{Bucket: "logs", Key: "inp/techaro.anubis/batch-1.jsonl"}},
+		},
+		{
+			name: "s3",
+			body: `{"Records":[
+				{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"inp/techaro.anubis/batch+1%3D.jsonl"}}},
+				{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"logs"},"object":{"key":"x"}}}
+			]}`,
+			expected: []objectNotification{{Bucket: "logs", Key: "inp/techaro.anubis/batch 1=.jsonl"}},
+		},
+		{
+			name:    "garbage",
+			body:    `{`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNotifications([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("expected %v, got %v", tt.expected[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectAnalyzers(t *testing.T) {
+	all, err := selectAnalyzers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(analyzers) {
+		t.Errorf("expected all %d analyzers, got %d", len(analyzers), len(all))
+	}
+
+	one, err := selectAnalyzers("dropped")
+	if err != nil || len(one) != 1 || one[0].Name() != "dropped" {
+		t.Errorf("unexpected selection %v: %v", one, err)
+	}
+
+	if _, err := selectAnalyzers("dropped,nope"); err == nil {
+		t.Error("expected an error for an unknown analyzer")
+	}
+}
+
+func TestAnalyzeWorker_Notify(t *testing.T) {
+	key := "inp/techaro.anubis/batch-1.jsonl"
+	bucket := memBucket{
+		"logs/" + key: encodeBatch(t,
+			batch.Entry{ID: "1", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Dropped: 3},
+			batch.Entry{ID: "2", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Dropped: 2},
+			batch.Entry{ID: "3", Kind: "techaro.anubis", LogID: "anubis_02jz4k5n8v"},
+		),
+	}
+
+	tests := []struct {
+		name     string
+		auth     func(r *http.Request)
+		key      string
+		status   int
+		findings int
+	}{
+		{
+			name:     "bearer token",
+			auth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer hunter2") },
+			key:      key,
+			status:   http.StatusNoContent,
+			findings: 1,
+		},
+		{
+			name:     "basic auth",
+			auth:     func(r *http.Request) { r.SetBasicAuth("tigris", "hunter2") },
+			key:      key,
+			status:   http.StatusNoContent,
+			findings: 1,
+		},
+		{
+			name:   "wrong token",
+			auth:   func(r *http.Request) { r.Header.Set("Authorization", "Bearer hunter3") },
+			key:    key,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "no credentials",
+			auth:   func(r *http.Request) {},
+			key:    key,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "not a batch",
+			auth:   func(r *http.Request) { r.Header.Set("Authorization", "Bearer hunter2") },
+			key:    "compacted/techaro.anubis.jsonl",
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "missing batch is retried",
+			auth:   func(r *http.Request) { r.Header.Set("Authorization", "Bearer hunter2") },
+			key:    "inp/techaro.anubis/batch-2.jsonl",
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := make(chanSink, 10)
+			aw := &analyzeWorker{
+				s3c:       bucket,
+				token:     "hunter2",
+				analyzers: []analyzer{droppedAnalyzer{}},
+				sinks:     []sink{cs},
+			}
+
+			body := `{"events":[{"eventName":"OBJECT_CREATED_PUT","bucket":"logs","object":{"key":"` + tt.key + `"}}]}`
+			r := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+			tt.auth(r)
+			w := httptest.NewRecorder()
+
+			aw.Notify(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if len(cs) != tt.findings {
+				t.Fatalf("expected %d findings, got %d", tt.findings, len(cs))
+			}
+
+			if tt.findings == 0 {
+				return
+			}
+
+			ev := <-cs
+			if ev.Type != sinkEventFinding || ev.Finding == nil {
+				t.Fatalf("unexpected event %+v", ev)
+			}
+
+			f := ev.Finding
+			if f.Analyzer != "dropped" || f.Kind != "techaro.anubis" || f.Batch != key || f.LogID != "anubis_01jz4k5n8v" {
+				t.Errorf("unexpected finding %+v", f)
+			}
+			if f.Details["dropped"] != uint64(5) {
+				t.Errorf("expected 5 dropped lines, got %v", f.Details["dropped"])
+			}
+		})
+	}
+}
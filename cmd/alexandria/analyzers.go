@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+func init() {
+	registerAnalyzer(droppedAnalyzer{})
+	registerAnalyzer(fingerprintsAnalyzer{})
+	registerAnalyzer(anubisCrashesAnalyzer{})
+}
+
+// droppedAnalyzer reports clients that lost log lines to buffer overflow
+// before uploading.
+type droppedAnalyzer struct{}
+
+func (droppedAnalyzer) Name() string { return "dropped" }
+
+func (droppedAnalyzer) Analyze(_ context.Context, b *logBatch) ([]finding, error) {
+	dropped := map[string]uint64{}
+	for _, e := range b.Entries {
+		if e.Dropped != 0 {
+			dropped[e.LogID] += e.Dropped
+		}
+	}
+
+	var result []finding
+	for _, logID := range slices.Sorted(maps.Keys(dropped)) {
+		result = append(result, finding{
+			LogID:    logID,
+			Severity: severityWarn,
+			Summary:  fmt.Sprintf("client dropped %d log lines", dropped[logID]),
+			Details:  map[string]any{"dropped": dropped[logID]},
+		})
+	}
+
+	return result, nil
+}
+
+// errorGroup counts occurrences of one fingerprint for one logID and
+// version.
+type errorGroup struct {
+	first errorOccurrence
+	count int
+}
+
+// groupErrors groups occurrences by fingerprint, logID and version, in the
+// order each group was first seen.
+func groupErrors(occurrences []errorOccurrence) []*errorGroup {
+	type key struct{ fingerprint, logID, version string }
+
+	var result []*errorGroup
+	index := map[key]*errorGroup{}
+	for _, o := range occurrences {
+		k := key{o.Fingerprint, o.LogID, o.Version}
+		g, ok := index[k]
+		if !ok {
+			g = &errorGroup{first: o}
+			index[k] = g
+			result = append(result, g)
+		}
+		g.count++
+	}
+	return result
+}
+
+func (g *errorGroup) details() map[string]any {
+	result := map[string]any{
+		"fingerprint": g.first.Fingerprint,
+		"normalized":  g.first.Normalized,
+		"example":     g.first.text(),
+		"count":       g.count,
+	}
+	if g.first.Version != "" {
+		result["version"] = g.first.Version
+	}
+	if g.first.Category != "" {
+		result["category"] = g.first.Category
+	}
+	return result
+}
+
+// fingerprintsAnalyzer reports each distinct error in a batch, grouped by
+// fingerprint, logID and version.
+type fingerprintsAnalyzer struct{}
+
+func (fingerprintsAnalyzer) Name() string { return "fingerprints" }
+
+func (fingerprintsAnalyzer) Analyze(_ context.Context, b *logBatch) ([]finding, error) {
+	occurrences, err := batchErrors(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []finding
+	for _, g := range groupErrors(occurrences) {
+		severity := severityWarn
+		if g.first.Category == categoryPanic {
+			severity = severityError
+		}
+
+		result = append(result, finding{
+			LogID:    g.first.LogID,
+			Severity: severity,
+			Summary:  fmt.Sprintf("%d× %s", g.count, g.first.Normalized),
+			Details:  g.details(),
+		})
+	}
+
+	return result, nil
+}
+
+// anubisCrashesAnalyzer reports Anubis panics, policy load failures and
+// misconfigured challenges.
+type anubisCrashesAnalyzer struct{}
+
+func (anubisCrashesAnalyzer) Name() string { return "anubis-crashes" }
+
+func (anubisCrashesAnalyzer) Analyze(_ context.Context, b *logBatch) ([]finding, error) {
+	if b.Kind != "techaro.anubis" {
+		return nil, nil
+	}
+
+	occurrences, err := batchErrors(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []finding
+	for _, g := range groupErrors(occurrences) {
+		var severity, what string
+		switch g.first.Category {
+		case categoryPanic:
+			severity, what = severityError, "Anubis crashed"
+		case categoryPolicy:
+			severity, what = severityError, "Anubis can't load its policy"
+		case categoryChallenge:
+			severity, what = severityWarn, "Anubis has a misconfigured challenge"
+		default:
+			continue
+		}
+
+		summary := what
+		if g.first.Version != "" {
+			summary += " (" + g.first.Version + ")"
+		}
+
+		result = append(result, finding{
+			LogID:    g.first.LogID,
+			Severity: severity,
+			Summary:  fmt.Sprintf("%s: %s", summary, g.first.text()),
+			Details:  g.details(),
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/facebookgo/flagenv"
+)
+
+var (
+	adminToken   = flag.String("admin-token", "", "token admin clients must send as a bearer token or basic auth password, empty to disable the admin endpoints")
+	directiveTTL = flag.Duration("directive-ttl", time.Hour, "how long client directives last when set without a duration")
+)
+
+const (
+	// adminDirectivesPath lists the directives of every logID.
+	adminDirectivesPath = "/admin/directives"
+
+	// adminDirectivePath sets or clears the directives of one logID.
+	adminDirectivePath = adminDirectivesPath + "/{kind}/{logID}"
+
+	// maxDirectiveTTL bounds how long directives can last, so a forgotten
+	// pause doesn't silence a client for good.
+	maxDirectiveTTL = 7 * 24 * time.Hour
+
+	// maxDirectiveRequest bounds the size of an admin request body.
+	maxDirectiveRequest = 4 << 10
+
+	// directivesPrefix is where directives are stored in the bucket, at
+	// directives/{kind}/{logID}.json.
+	directivesPrefix = "directives/"
+
+	// directiveRefreshInterval is how often servers read the directives
+	// other servers set from the bucket.
+	directiveRefreshInterval = 15 * time.Second
+)
+
+// directiveRequest is the body of an admin request to set the directives of
+// a logID. Durations are strings such as "30s".
+type directiveRequest struct {
+	MinLevel      *slog.Level `json:"minLevel,omitempty"`
+	SampleRate    *float64    `json:"sampleRate,omitempty"`
+	FlushInterval string      `json:"flushInterval,omitempty"`
+	Pause         bool        `json:"pause,omitempty"`
+
+	// TTL is how long the directives last, -directive-ttl if empty.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// directiveState is the directives of a logID and what its client last
+// reported applying.
+type directiveState struct {
+	alexandria.Directives
+
+	Kind  string `json:"kind"`
+	LogID string `json:"logID"`
+
+	// Cleared is set on the empty directives that replace cleared ones
+	// until those would have expired, so their clients go back to their
+	// own settings.
+	Cleared bool `json:"cleared,omitempty"`
+
+	// Applied is the Version the client last reported running with to this
+	// server, and LastSeen when it did. They aren't stored in the bucket,
+	// so they only cover the requests of Replica and reset when it restarts.
+	Applied  int64     `json:"applied"`
+	LastSeen time.Time `json:"lastSeen,omitzero"`
+	Replica  string    `json:"replica,omitempty"`
+}
+
+// directiveBucket is the part of *s3.Client the directive store uses.
+type directiveBucket interface {
+	bucketReader
+	objectPutter
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// directiveStore holds the directives admins set for logIDs until they
+// expire. Directives are stored in the bucket so every server sends the
+// same ones, and each server keeps a copy it refreshes every
+// directiveRefreshInterval to answer uploads from.
+//
+// A nil *directiveStore has no directives.
+type directiveStore struct {
+	token   string
+	ttl     time.Duration
+	s3c     directiveBucket
+	bucket  string
+	replica string
+
+	mu     sync.Mutex
+	states map[string]*directiveState
+}
+
+func newDirectiveStore(token string, ttl time.Duration, s3c directiveBucket, bucket string) *directiveStore {
+	replica, _ := os.Hostname()
+	return &directiveStore{token: token, ttl: ttl, s3c: s3c, bucket: bucket, replica: replica, states: map[string]*directiveState{}}
+}
+
+// newDirectiveStoreFromFlags returns a directiveStore, or nil if no admin
+// token is set.
+func newDirectiveStoreFromFlags(s3c directiveBucket, bucket string) (*directiveStore, error) {
+	if *adminToken == "" {
+		return nil, nil
+	}
+	if *directiveTTL <= 0 || *directiveTTL > maxDirectiveTTL {
+		return nil, fmt.Errorf("-directive-ttl must be between 0 and %s, got %s", maxDirectiveTTL, *directiveTTL)
+	}
+	return newDirectiveStore(*adminToken, *directiveTTL, s3c, bucket), nil
+}
+
+func directiveTopic(kind, logID string) string {
+	return kind + "/" + logID
+}
+
+// directiveKey is where the directives of logID are stored in the bucket.
+func directiveKey(kind, logID string) string {
+	return directivesPrefix + directiveTopic(kind, logID) + ".json"
+}
+
+// directives converts req to directives that last for req.TTL, or ttl if it
+// is empty. Their version is the current time, so it increases across
+// servers.
+func (req directiveRequest) directives(ttl time.Duration) (alexandria.Directives, error) {
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return alexandria.Directives{}, fmt.Errorf("can't parse ttl: %w", err)
+		}
+		if ttl <= 0 || ttl > maxDirectiveTTL {
+			return alexandria.Directives{}, fmt.Errorf("ttl must be between 0 and %s, got %s", maxDirectiveTTL, ttl)
+		}
+	}
+
+	now := time.Now()
+	d := alexandria.Directives{
+		Version:    now.UnixNano(),
+		Expires:    now.Add(ttl).UTC().Truncate(time.Second),
+		MinLevel:   req.MinLevel,
+		SampleRate: req.SampleRate,
+		Pause:      req.Pause,
+	}
+	if req.FlushInterval != "" {
+		var err error
+		if d.FlushInterval, err = time.ParseDuration(req.FlushInterval); err != nil {
+			return alexandria.Directives{}, fmt.Errorf("can't parse flushInterval: %w", err)
+		}
+	}
+
+	if err := d.Validate(); err != nil {
+		return alexandria.Directives{}, err
+	}
+	return d, nil
+}
+
+// set replaces the directives of logID with d, keeping its version above
+// the one they replace.
+func (ds *directiveStore) set(ctx context.Context, kind, logID string, d alexandria.Directives) (directiveState, error) {
+	state := directiveState{Directives: d, Kind: kind, LogID: logID}
+
+	ds.mu.Lock()
+	if old, ok := ds.states[directiveTopic(kind, logID)]; ok {
+		state.Version = max(state.Version, old.Version+1)
+	}
+	ds.mu.Unlock()
+
+	if err := ds.store(ctx, state); err != nil {
+		return directiveState{}, err
+	}
+	state = ds.remember(state)
+	state.Replica = ds.replica
+
+	slog.Info("set client directives", "kind", kind, "logID", logID, "version", state.Version, "expires", state.Expires)
+	return state, nil
+}
+
+// clear replaces the directives of logID with empty ones that last until
+// they would have expired. It reports whether there were any.
+func (ds *directiveStore) clear(ctx context.Context, kind, logID string) (bool, error) {
+	if err := ds.refresh(ctx); err != nil {
+		return false, err
+	}
+
+	ds.mu.Lock()
+	old, ok := ds.states[directiveTopic(kind, logID)]
+	if !ok || old.Cleared || !time.Now().Before(old.Expires) {
+		ds.mu.Unlock()
+		return false, nil
+	}
+	state := directiveState{
+		Directives: alexandria.Directives{
+			Version: max(time.Now().UnixNano(), old.Version+1),
+			Expires: old.Expires,
+		},
+		Kind:    kind,
+		LogID:   logID,
+		Cleared: true,
+	}
+	ds.mu.Unlock()
+
+	if err := ds.store(ctx, state); err != nil {
+		return false, err
+	}
+	ds.remember(state)
+	return true, nil
+}
+
+// store writes state to the bucket.
+func (ds *directiveStore) store(ctx context.Context, state directiveState) error {
+	state.Applied, state.LastSeen, state.Replica = 0, time.Time{}, ""
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	key := directiveKey(state.Kind, state.LogID)
+	if _, err := ds.s3c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(ds.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(alexandria.ContentTypeJSON),
+	}); err != nil {
+		return fmt.Errorf("can't store directives in %s: %w", key, err)
+	}
+	return nil
+}
+
+// remember caches state unless newer directives for its logID are cached,
+// keeping what its client last reported applying. It returns the cached
+// state.
+func (ds *directiveStore) remember(state directiveState) directiveState {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	topic := directiveTopic(state.Kind, state.LogID)
+	old, ok := ds.states[topic]
+	if ok && old.Version >= state.Version {
+		return *old
+	}
+	if ok {
+		state.Applied, state.LastSeen = old.Applied, old.LastSeen
+	}
+	ds.states[topic] = &state
+	return state
+}
+
+// refresh reads the directives of every logID from the bucket, deleting
+// the ones that expired. A deletion only goes through if the directives
+// weren't replaced since they were read, so that new directives another
+// server stores meanwhile are kept.
+func (ds *directiveStore) refresh(ctx context.Context) error {
+	now := time.Now()
+
+	pages := s3.NewListObjectsV2Paginator(ds.s3c, &s3.ListObjectsV2Input{
+		Bucket: aws.String(ds.bucket),
+		Prefix: aws.String(directivesPrefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("can't list %s: %w", directivesPrefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+
+			data, etag, err := ds.fetch(ctx, key)
+			if err != nil {
+				slog.Error("can't fetch directives", "key", key, "err", err)
+				continue
+			}
+
+			var state directiveState
+			if err := json.Unmarshal(data, &state); err != nil {
+				slog.Error("can't decode directives", "key", key, "err", err)
+				continue
+			}
+
+			if !now.Before(state.Expires) {
+				ds.deleteExpired(ctx, key, etag)
+				continue
+			}
+
+			ds.remember(state)
+		}
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for topic, state := range ds.states {
+		if !now.Before(state.Expires) {
+			delete(ds.states, topic)
+		}
+	}
+	return nil
+}
+
+// fetch downloads the directives at key and returns them with their ETag.
+func (ds *directiveStore) fetch(ctx context.Context, key string) ([]byte, string, error) {
+	obj, err := ds.s3c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(ds.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, aws.ToString(obj.ETag), nil
+}
+
+// deleteExpired deletes the expired directives at key if they still have
+// etag. Without an ETag they are left for a lifecycle rule to delete.
+func (ds *directiveStore) deleteExpired(ctx context.Context, key, etag string) {
+	if etag == "" {
+		return
+	}
+
+	_, err := ds.s3c.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(ds.bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed":
+		slog.Debug("expired directives were replaced before they were deleted", "key", key)
+	default:
+		slog.Error("can't delete expired directives", "key", key, "err", err)
+	}
+}
+
+// refreshLoop refreshes the directives every directiveRefreshInterval.
+func (ds *directiveStore) refreshLoop() {
+	ticker := time.NewTicker(directiveRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), directiveRefreshInterval)
+		if err := ds.refresh(ctx); err != nil {
+			slog.Error("can't refresh directives", "err", err)
+		}
+		cancel()
+
+		<-ticker.C
+	}
+}
+
+// lookup records that the client of logID applies the directives with
+// version applied and returns the directives it should apply, or nil if
+// there are none.
+func (ds *directiveStore) lookup(kind, logID string, applied int64) *alexandria.Directives {
+	if ds == nil {
+		return nil
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	state, ok := ds.states[directiveTopic(kind, logID)]
+	if !ok || !time.Now().Before(state.Expires) {
+		return nil
+	}
+
+	state.Applied, state.LastSeen = applied, time.Now().UTC()
+	d := state.Directives
+	return &d
+}
+
+// list returns the directives that are set and haven't expired, ordered by
+// kind and logID.
+func (ds *directiveStore) list(ctx context.Context) ([]directiveState, error) {
+	if err := ds.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	result := []directiveState{}
+	for _, state := range ds.states {
+		if !state.Cleared {
+			st := *state
+			st.Replica = ds.replica
+			result = append(result, st)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b directiveState) int {
+		return cmp.Or(strings.Compare(a.Kind, b.Kind), strings.Compare(a.LogID, b.LogID))
+	})
+	return result, nil
+}
+
+// setDirectives adds the directives of logID to the headers of w, recording
+// the version its client reported applying in r.
+func (s *Server) setDirectives(w http.ResponseWriter, r *http.Request, kind, logID string) {
+	d := s.directives.lookup(kind, logID, alexandria.AppliedFromHeader(r.Header))
+	if d == nil {
+		return
+	}
+
+	if err := d.SetHeader(w.Header()); err != nil {
+		slog.Error("can't encode directives", "err", err)
+	}
+}
+
+// Directives answers clients that poll for their directives because they
+// are paused: 200 with the directives in the header and body, or 204 if
+// this server has none.
+func (s *Server) Directives(w http.ResponseWriter, r *http.Request) {
+	logID, ok := s.admit(w, r, r.PathValue("kind"), r.PathValue("logID"))
+	if !ok {
+		return
+	}
+
+	d := s.directives.lookup(r.PathValue("kind"), logID, alexandria.AppliedFromHeader(r.Header))
+	if d == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := d.SetHeader(w.Header()); err != nil {
+		slog.Error("can't encode directives", "err", err)
+		http.Error(w, "can't encode directives", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", alexandria.ContentTypeJSON)
+	json.NewEncoder(w).Encode(d)
+}
+
+// adminAuthorized checks the admin token of r, writing an error response
+// if it is missing or wrong.
+func (s *Server) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.directives == nil {
+		http.NotFound(w, r)
+		return false
+	}
+
+	if !tokenAuthorized(r, s.directives.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// adminTarget reads the kind and canonical logID an admin request is for,
+// writing an error response if they are invalid.
+func adminTarget(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	kind := r.PathValue("kind")
+	if !slices.Contains(knownKinds, kind) {
+		http.Error(w, fmt.Sprintf("unknown kind %q", kind), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	logID, err := alexandria.CanonicalLogID(r.PathValue("logID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return kind, logID, true
+}
+
+// ListDirectives returns every logID's directives as JSON.
+func (s *Server) ListDirectives(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	states, err := s.directives.list(r.Context())
+	if err != nil {
+		slog.Error("can't list directives", "err", err)
+		http.Error(w, "can't list directives", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", alexandria.ContentTypeJSON)
+	json.NewEncoder(w).Encode(states)
+}
+
+// SetDirectives replaces the directives of a logID with the directiveRequest
+// in the body and returns the result.
+func (s *Server) SetDirectives(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	kind, logID, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var req directiveRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDirectiveRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("can't decode directives: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	d, err := req.directives(s.directives.ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := s.directives.set(r.Context(), kind, logID, d)
+	if err != nil {
+		slog.Error("can't set directives", "kind", kind, "logID", logID, "err", err)
+		http.Error(w, "can't set directives", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", alexandria.ContentTypeJSON)
+	json.NewEncoder(w).Encode(state)
+}
+
+// ClearDirectives replaces the directives of a logID with empty ones, so its
+// client goes back to its own settings.
+func (s *Server) ClearDirectives(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	kind, logID, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	ok, err := s.directives.clear(r.Context(), kind, logID)
+	if err != nil {
+		slog.Error("can't clear directives", "kind", kind, "logID", logID, "err", err)
+		http.Error(w, "can't clear directives", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	slog.Info("cleared client directives", "kind", kind, "logID", logID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runDirectives is the directives subcommand: it lists, sets and clears the
+// directives an ingestion server sends to clients.
+func runDirectives(args []string) error {
+	fs := flag.NewFlagSet("directives", flag.ExitOnError)
+	server := fs.String("admin-url", "http://localhost:8989", "base URL of the ingestion server")
+	token := fs.String("admin-token", "", "token to authenticate to the server with")
+	minLevel := fs.String("min-level", "", "lowest level the client should ship, empty to leave it as is")
+	sampleRate := fs.Float64("sample-rate", -1, "share of records below warn the client should ship, negative to leave it as is")
+	flushEvery := fs.Duration("flush-interval", 0, "how often the client should upload, 0 to leave it as is")
+	pause := fs.Bool("pause", false, "stop the client from shipping lines")
+	ttl := fs.Duration("for", 0, "how long the directives last, 0 for the server's -directive-ttl")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: alexandria directives list [flags]")
+		fmt.Fprintln(fs.Output(), "       alexandria directives set [flags] kind logID")
+		fmt.Fprintln(fs.Output(), "       alexandria directives clear [flags] kind logID")
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("directives needs an action")
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	wantArgs := 2
+	if action == "list" {
+		wantArgs = 0
+	}
+	if fs.NArg() != wantArgs {
+		fs.Usage()
+		return fmt.Errorf("directives %s needs %d arguments, got %d", action, wantArgs, fs.NArg())
+	}
+
+	u, err := url.JoinPath(*server, append([]string{adminDirectivesPath}, fs.Args()...)...)
+	if err != nil {
+		return fmt.Errorf("can't parse -admin-url: %w", err)
+	}
+
+	var method string
+	var body io.Reader
+	switch action {
+	case "list":
+		method = http.MethodGet
+	case "clear":
+		method = http.MethodDelete
+	case "set":
+		method = http.MethodPut
+
+		req := directiveRequest{Pause: *pause}
+		if *minLevel != "" {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(*minLevel)); err != nil {
+				return fmt.Errorf("can't parse -min-level: %w", err)
+			}
+			req.MinLevel = &level
+		}
+		if *sampleRate >= 0 {
+			req.SampleRate = sampleRate
+		}
+		if *flushEvery != 0 {
+			req.FlushInterval = flushEvery.String()
+		}
+		if *ttl != 0 {
+			req.TTL = ttl.String()
+		}
+
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown directives action %q", action)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", alexandria.ContentTypeJSON)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't connect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("can't %s directives: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	switch action {
+	case "list":
+		var states []directiveState
+		if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+			return fmt.Errorf("can't decode directives: %w", err)
+		}
+		return writeDirectives(os.Stdout, states)
+	case "set":
+		var state directiveState
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			return fmt.Errorf("can't decode directives: %w", err)
+		}
+		return writeDirectives(os.Stdout, []directiveState{state})
+	}
+
+	return nil
+}
+
+// writeDirectives writes states to w as a table, noting which replica the
+// applied versions and last seen times come from.
+func writeDirectives(w io.Writer, states []directiveState) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tLOG ID\tVERSION\tAPPLIED\tMIN LEVEL\tSAMPLE RATE\tFLUSH\tPAUSE\tEXPIRES\tLAST SEEN")
+	for _, st := range states {
+		minLevel, sampleRate, flushEvery, lastSeen := "-", "-", "-", "-"
+		if st.MinLevel != nil {
+			minLevel = st.MinLevel.String()
+		}
+		if st.SampleRate != nil {
+			sampleRate = fmt.Sprint(*st.SampleRate)
+		}
+		if st.FlushInterval != 0 {
+			flushEvery = st.FlushInterval.String()
+		}
+		if !st.LastSeen.IsZero() {
+			lastSeen = st.LastSeen.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%t\t%s\t%s\n", st.Kind, st.LogID, st.Version, st.Applied, minLevel, sampleRate, flushEvery, st.Pause, st.Expires.Format(time.RFC3339), lastSeen)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(states) != 0 && states[0].Replica != "" {
+		_, err := fmt.Fprintf(w, "\nAPPLIED and LAST SEEN only cover the requests replica %s served since it started.\n", states[0].Replica)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// directiveTestBucket is a bucket servers share directives through.
+type directiveTestBucket struct {
+	listBucket
+	putRecorder
+}
+
+func newDirectiveTestBucket() directiveTestBucket {
+	objects := map[string][]byte{}
+	return directiveTestBucket{listBucket: listBucket{memBucket: objects}, putRecorder: objects}
+}
+
+func directiveTestETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func (b directiveTestBucket) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out, err := b.memBucket.GetObject(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	out.ETag = aws.String(directiveTestETag(b.memBucket[*params.Bucket+"/"+*params.Key]))
+	return out, nil
+}
+
+func (b directiveTestBucket) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	name := *params.Bucket + "/" + *params.Key
+	if data, ok := b.putRecorder[name]; ok && params.IfMatch != nil && *params.IfMatch != directiveTestETag(data) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	delete(b.putRecorder, name)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestDirectiveRequest(t *testing.T) {
+	rate := 2.0
+	for _, req := range []directiveRequest{
+		{FlushInterval: "soon"},
+		{FlushInterval: "10ms"},
+		{SampleRate: &rate},
+		{TTL: "-1h"},
+		{TTL: "1000h"},
+	} {
+		if _, err := req.directives(time.Hour); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+
+	d, err := directiveRequest{Pause: true}.directives(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version <= 0 || !d.Pause || time.Until(d.Expires) < 59*time.Minute {
+		t.Errorf("unexpected directives %+v", d)
+	}
+}
+
+func TestDirectiveStore(t *testing.T) {
+	ctx := t.Context()
+	bucket := newDirectiveTestBucket()
+	ds := newDirectiveStore("secret", time.Hour, bucket, "bucket")
+	other := newDirectiveStore("secret", time.Hour, bucket, "bucket")
+
+	d, err := directiveRequest{Pause: true}.directives(ds.ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := ds.set(ctx, "techaro.anubis", "anubis_1", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bucket.putRecorder["bucket/"+directiveKey("techaro.anubis", "anubis_1")]; !ok {
+		t.Error("expected directives to be stored in the bucket")
+	}
+
+	if d := ds.lookup("techaro.anubis", "anubis_2", 0); d != nil {
+		t.Errorf("expected no directives for another logID, got %+v", d)
+	}
+	if d := ds.lookup("techaro.anubis", "anubis_1", st.Version); d == nil || d.Version != st.Version {
+		t.Errorf("expected version %d, got %+v", st.Version, d)
+	}
+
+	// Another server only sees the directives once it refreshes
+	if d := other.lookup("techaro.anubis", "anubis_1", 0); d != nil {
+		t.Errorf("expected no directives before refreshing, got %+v", d)
+	}
+	if err := other.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := other.lookup("techaro.anubis", "anubis_1", 0); d == nil || d.Version != st.Version || !d.Pause {
+		t.Errorf("expected version %d from the bucket, got %+v", st.Version, d)
+	}
+
+	// Newer directives get a higher version even if the clock says otherwise
+	d.Version, d.Pause, d.FlushInterval = 1, false, 30*time.Second
+	next, err := ds.set(ctx, "techaro.anubis", "anubis_1", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Version <= st.Version || next.Pause || next.FlushInterval != 30*time.Second || next.Applied != st.Version {
+		t.Errorf("unexpected directives %+v", next)
+	}
+
+	expired, err := directiveRequest{}.directives(ds.ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Expires = time.Now().Add(-time.Second)
+	if _, err := ds.set(ctx, "techaro.thoth", "thoth_1", expired); err != nil {
+		t.Fatal(err)
+	}
+	if d := ds.lookup("techaro.thoth", "thoth_1", 0); d != nil {
+		t.Errorf("expected expired directives to be dropped, got %+v", d)
+	}
+
+	list, err := ds.list(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LogID != "anubis_1" {
+		t.Errorf("unexpected list %+v", list)
+	}
+	if _, ok := bucket.putRecorder["bucket/"+directiveKey("techaro.thoth", "thoth_1")]; ok {
+		t.Error("expected expired directives to be deleted from the bucket")
+	}
+
+	// Expired directives replaced after they were read aren't deleted
+	if _, err := ds.set(ctx, "techaro.thoth", "thoth_1", expired); err != nil {
+		t.Fatal(err)
+	}
+	key := directiveKey("techaro.thoth", "thoth_1")
+	_, etag, err := ds.fetch(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := directiveRequest{Pause: true}.directives(ds.ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.set(ctx, "techaro.thoth", "thoth_1", replaced); err != nil {
+		t.Fatal(err)
+	}
+	ds.deleteExpired(ctx, key, etag)
+	if err := ds.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := ds.lookup("techaro.thoth", "thoth_1", 0); d == nil || !d.Pause {
+		t.Errorf("expected the replacing directives to be kept, got %+v", d)
+	}
+	if ok, err := ds.clear(ctx, "techaro.thoth", "thoth_1"); !ok || err != nil {
+		t.Fatalf("expected directives to be cleared, got %v, %v", ok, err)
+	}
+
+	// Clearing on one server sends empty directives from every server
+	if ok, err := other.clear(ctx, "techaro.anubis", "anubis_1"); !ok || err != nil {
+		t.Fatalf("expected directives to be cleared, got %v, %v", ok, err)
+	}
+	if ok, err := other.clear(ctx, "techaro.anubis", "anubis_1"); ok || err != nil {
+		t.Errorf("expected nothing left to clear, got %v, %v", ok, err)
+	}
+	if err := ds.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := ds.lookup("techaro.anubis", "anubis_1", 0); d == nil || d.Version <= next.Version || d.Pause || d.FlushInterval != 0 || !d.Expires.Equal(next.Expires) {
+		t.Errorf("expected empty directives with a newer version, got %+v", d)
+	}
+	if list, err := ds.list(ctx); err != nil || len(list) != 0 {
+		t.Errorf("expected cleared directives not to be listed, got %+v, %v", list, err)
+	}
+
+	var nilStore *directiveStore
+	if d := nilStore.lookup("techaro.anubis", "anubis_1", 0); d != nil {
+		t.Errorf("expected no directives from a nil store, got %+v", d)
+	}
+}
+
+func TestServer_Directives(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.directives = newDirectiveStore("secret", time.Hour, newDirectiveTestBucket(), "bucket")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+alexandria.DirectivesPath+"/{kind}/{logID}", s.Directives)
+	mux.HandleFunc("GET "+adminDirectivesPath, s.ListDirectives)
+	mux.HandleFunc("PUT "+adminDirectivePath, s.SetDirectives)
+	mux.HandleFunc("DELETE "+adminDirectivePath, s.ClearDirectives)
+	mux.HandleFunc("PUT /upload/{kind}/{logID}", s.Upload)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path, token, body string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, tt := range []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{method: http.MethodGet, path: adminDirectivesPath, status: http.StatusUnauthorized},
+		{method: http.MethodPut, path: adminDirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v", token: "wrong", body: "{}", status: http.StatusUnauthorized},
+		{method: http.MethodPut, path: adminDirectivesPath + "/techaro.nope/anubis_01jz4k5n8v", token: "secret", body: "{}", status: http.StatusBadRequest},
+		{method: http.MethodPut, path: adminDirectivesPath + "/techaro.anubis/nope", token: "secret", body: "{}", status: http.StatusBadRequest},
+		{method: http.MethodPut, path: adminDirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v", token: "secret", body: `{"sampleRate":2}`, status: http.StatusBadRequest},
+		{method: http.MethodPut, path: adminDirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v", token: "secret", body: `{"volume":11}`, status: http.StatusBadRequest},
+		{method: http.MethodDelete, path: adminDirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v", token: "secret", status: http.StatusNotFound},
+		{method: http.MethodGet, path: alexandria.DirectivesPath + "/techaro.anubis/anubis_01jz4k5n8v", status: http.StatusNoContent},
+	} {
+		if resp := do(tt.method, tt.path, tt.token, tt.body, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s %s with token %q: expected status %d, got %d", tt.method, tt.path, tt.token, tt.status, resp.StatusCode)
+		}
+	}
+
+	resp := do(http.MethodPut, adminDirectivesPath+"/techaro.anubis/anubis_01jz4k5n8v", "secret", `{"minLevel":"WARN","sampleRate":0.5,"flushInterval":"10s","ttl":"30m"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected directives to be set, got status %d", resp.StatusCode)
+	}
+	var set directiveState
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	version := strconv.FormatInt(set.Version, 10)
+
+	applied := http.Header{alexandria.HeaderDirectivesApplied: {version}}
+	resp = do(http.MethodPut, "/upload/techaro.anubis/anubis_01jz4k5n8v", "", "hello\n", applied)
+	d, err := alexandria.DirectivesFromHeader(resp.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Version != set.Version || d.MinLevel == nil || d.MinLevel.String() != "WARN" || *d.SampleRate != 0.5 || d.FlushInterval != 10*time.Second {
+		t.Errorf("unexpected directives on upload %+v", d)
+	}
+
+	resp = do(http.MethodGet, alexandria.DirectivesPath+"/techaro.anubis/anubis_01jz4k5n8v", "", "", applied)
+	var polled alexandria.Directives
+	if err := json.NewDecoder(resp.Body).Decode(&polled); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || polled.Version != set.Version || resp.Header.Get(alexandria.HeaderDirectives) == "" {
+		t.Errorf("unexpected poll response %d %+v", resp.StatusCode, polled)
+	}
+
+	resp = do(http.MethodGet, adminDirectivesPath, "secret", "", nil)
+	var states []directiveState
+	if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if len(states) != 1 || states[0].Applied != set.Version || states[0].LastSeen.IsZero() || states[0].Replica != hostname {
+		t.Errorf("unexpected list %+v", states)
+	}
+
+	var buf bytes.Buffer
+	if err := writeDirectives(&buf, states); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if hostname != "" && (len(rows) != 4 || !strings.Contains(rows[3], "replica "+hostname)) {
+		t.Errorf("expected a note on which replica the table covers:\n%s", buf.String())
+	}
+	if len(rows) < 2 || strings.Join(strings.Fields(rows[1])[:8], " ") != "techaro.anubis anubis_01jz4k5n8v "+version+" "+version+" WARN 0.5 10s false" {
+		t.Errorf("unexpected table:\n%s", buf.String())
+	}
+
+	if resp := do(http.MethodDelete, adminDirectivesPath+"/techaro.anubis/anubis_01jz4k5n8v", "secret", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected directives to be cleared, got status %d", resp.StatusCode)
+	}
+	resp = do(http.MethodPut, "/upload/techaro.anubis/anubis_01jz4k5n8v", "", "hello\n", applied)
+	d, err = alexandria.DirectivesFromHeader(resp.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Version <= set.Version || d.MinLevel != nil || d.SampleRate != nil || d.FlushInterval != 0 {
+		t.Errorf("expected empty directives after clearing them, got %+v", d)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// exportRow is one log line, flattened for analysts. The struct tags name
+// its columns in exportSchema.
+type exportRow struct {
+	ID    string    `parquet:"id"`
+	Kind  string    `parquet:"kind"`
+	LogID string    `parquet:"logID,optional"`
+	Time  time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Level string    `parquet:"level,optional"`
+	Msg   string    `parquet:"msg,optional"`
+
+	// Attrs is the JSON object of every field of a JSON line other than
+	// time, level and msg, or empty for other lines.
+	Attrs string `parquet:"attrs,optional"`
+}
+
+// exportRows flattens every line of b. Lines are dated by their time field,
+// then by when the client recorded them, then by stored.
+func exportRows(b *logBatch, stored time.Time) ([]exportRow, error) {
+	var result []exportRow
+	for _, e := range b.Entries {
+		lines, err := e.Lines()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, line := range lines {
+			row := exportRow{
+				ID:    fmt.Sprintf("%s-%d", e.ID, i),
+				Kind:  b.Kind,
+				LogID: e.LogID,
+				Time:  line.Time,
+				Msg:   string(line.Data),
+			}
+			parseExportFields(&row, line.Data)
+
+			if row.Time.IsZero() {
+				row.Time = stored
+			}
+			row.Time = row.Time.UTC()
+
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+// parseExportFields fills in row from the fields of a JSON line. Other lines
+// are left as they are.
+func parseExportFields(row *exportRow, line []byte) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return
+	}
+
+	str := func(key string) (string, bool) {
+		var s string
+		if err := json.Unmarshal(fields[key], &s); err != nil {
+			return "", false
+		}
+		delete(fields, key)
+		return s, true
+	}
+
+	if s, ok := str("time"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			row.Time = t
+		} else {
+			fields["time"], _ = json.Marshal(s)
+		}
+	}
+	if s, ok := str("level"); ok {
+		row.Level = s
+	}
+	if s, ok := str("msg"); ok {
+		row.Msg = s
+	} else {
+		row.Msg = ""
+	}
+
+	if len(fields) != 0 {
+		attrs, _ := json.Marshal(fields)
+		row.Attrs = string(attrs)
+	}
+}
+
+// exportSchema is the schema of exported Parquet files, with a column per
+// field of exportRow. Empty optional values are stored as nulls. It is
+// spelled out because struct tags can't make a JSON column optional.
+var exportSchema = parquet.NewSchema("exportRow", parquet.Group{
+	"id":        parquet.String(),
+	"kind":      parquet.Encoded(parquet.String(), &parquet.RLEDictionary),
+	"logID":     parquet.Optional(parquet.Encoded(parquet.String(), &parquet.RLEDictionary)),
+	"timestamp": parquet.Timestamp(parquet.Millisecond),
+	"level":     parquet.Optional(parquet.Encoded(parquet.String(), &parquet.RLEDictionary)),
+	"msg":       parquet.Optional(parquet.String()),
+	"attrs":     parquet.Optional(parquet.JSON()),
+})
+
+// exportRowGroupSize is the most rows written to one row group of an
+// exported file, which bounds how many rows are buffered before encoding.
+const exportRowGroupSize = 64 << 10
+
+// exportKey is where the rows of kind dated on day are exported to,
+// partitioned Hive-style by kind and date. Rows can be dated on a day before
+// the batch holding them was stored, so files are named after the day they
+// were exported from to keep one day's export from overwriting another's.
+func exportKey(prefix, kind, day, storedDay string) string {
+	return prefix + path.Join("kind="+kind, "date="+day, "stored-"+storedDay+".parquet")
+}
+
+// exportBucket is the part of *s3.Client export uses.
+type exportBucket interface {
+	bucketReader
+	objectPutter
+}
+
+// exporter converts batches to Parquet files.
+type exporter struct {
+	s3c       exportBucket
+	bucket    string
+	outBucket string
+	outPrefix string
+	codec     compress.Codec
+
+	// tempDir is where files are written before they are uploaded, or
+	// empty for the default directory for temporary files.
+	tempDir string
+}
+
+// exportPartition is a kind and the UTC day its rows are dated on.
+type exportPartition struct {
+	kind, day string
+}
+
+// exportFile is a Parquet file being written to a temporary file, so that
+// only the row group being encoded is held in memory.
+type exportFile struct {
+	f *os.File
+	w *parquet.GenericWriter[exportRow]
+}
+
+// exportBatch appends the rows of the batch at key to the files of the days
+// they are dated on. It returns the number of rows exported.
+func (ex *exporter) exportBatch(ctx context.Context, files map[exportPartition]*exportFile, key, kind string, stored time.Time) (int, error) {
+	b, err := fetchBatch(ctx, ex.s3c, ex.bucket, key, kind)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := exportRows(b, stored)
+	if err != nil {
+		return 0, fmt.Errorf("can't read %s: %w", key, err)
+	}
+
+	for _, row := range rows {
+		part := exportPartition{kind: kind, day: row.Time.Format(time.DateOnly)}
+		f, ok := files[part]
+		if !ok {
+			tmp, err := os.CreateTemp(ex.tempDir, "alexandria-export-*.parquet")
+			if err != nil {
+				return 0, fmt.Errorf("can't create file for %s for %s: %w", part.kind, part.day, err)
+			}
+
+			f = &exportFile{f: tmp}
+			f.w = parquet.NewGenericWriter[exportRow](tmp, exportSchema,
+				parquet.Compression(ex.codec),
+				parquet.MaxRowsPerRowGroup(exportRowGroupSize),
+				parquet.CreatedBy("alexandria", "", ""),
+			)
+			files[part] = f
+		}
+
+		if _, err := f.w.Write([]exportRow{row}); err != nil {
+			return 0, fmt.Errorf("can't encode %s: %w", key, err)
+		}
+	}
+
+	return len(rows), nil
+}
+
+// exportDay exports every batch under prefix stored on day, writing one
+// Parquet file per kind and day the rows are dated on.
+func (ex *exporter) exportDay(ctx context.Context, prefix string, day time.Time) (batches, rows int, err error) {
+	start := day.UTC().Truncate(24 * time.Hour)
+	end := start.AddDate(0, 0, 1)
+
+	files := map[exportPartition]*exportFile{}
+	defer func() {
+		for _, f := range files {
+			f.f.Close()
+			os.Remove(f.f.Name())
+		}
+	}()
+
+	err = listBatches(ctx, ex.s3c, ex.bucket, prefix, start, end, func(key, kind string, stored time.Time) error {
+		n, err := ex.exportBatch(ctx, files, key, kind, stored)
+		if err != nil {
+			return err
+		}
+		batches++
+		rows += n
+		return nil
+	})
+	if err != nil {
+		return batches, rows, err
+	}
+
+	parts := slices.SortedFunc(maps.Keys(files), func(a, b exportPartition) int {
+		return cmp.Or(cmp.Compare(a.kind, b.kind), cmp.Compare(a.day, b.day))
+	})
+	for _, part := range parts {
+		f := files[part]
+		if err := f.w.Close(); err != nil {
+			return batches, rows, fmt.Errorf("can't encode %s for %s: %w", part.kind, part.day, err)
+		}
+		if _, err := f.f.Seek(0, io.SeekStart); err != nil {
+			return batches, rows, fmt.Errorf("can't read back %s for %s: %w", part.kind, part.day, err)
+		}
+
+		outKey := exportKey(ex.outPrefix, part.kind, part.day, start.Format(time.DateOnly))
+		if _, err := ex.s3c.PutObject(ctx, &s3.PutObjectInput{
+			Body:        f.f,
+			Bucket:      aws.String(ex.outBucket),
+			Key:         aws.String(outKey),
+			ContentType: aws.String("application/vnd.apache.parquet"),
+		}); err != nil {
+			return batches, rows, fmt.Errorf("can't store %s: %w", outKey, err)
+		}
+	}
+
+	return batches, rows, nil
+}
+
+// runExport is the export subcommand: it converts a day of batches to
+// Parquet files for querying with tools like DuckDB.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	bucketName := fs.String("bucket", *bucket, "bucket to read batches from")
+	prefix := fs.String("prefix", batch.KeyPrefix, "key prefix of the batches to export")
+	dayStr := fs.String("day", time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly), "UTC day whose batches to export, as YYYY-MM-DD")
+	outBucket := fs.String("out-bucket", "", "bucket to write Parquet files to, empty for the one batches are read from")
+	outPrefix := fs.String("out-prefix", "export/", "key prefix to write Parquet files under")
+	compression := fs.String("compression", "snappy", "compression of Parquet files: snappy or none")
+	tempDir := fs.String("temp-dir", "", "directory to write Parquet files to before uploading them, empty for the system default")
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(time.DateOnly, *dayStr)
+	if err != nil {
+		return fmt.Errorf("can't parse -day: %w", err)
+	}
+
+	var codec compress.Codec
+	switch *compression {
+	case "snappy":
+		codec = &parquet.Snappy
+	case "none":
+		codec = &parquet.Uncompressed
+	default:
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ex := &exporter{
+		s3c:       s3.NewFromConfig(cfg),
+		bucket:    *bucketName,
+		outBucket: cmp.Or(*outBucket, *bucketName),
+		outPrefix: *outPrefix,
+		codec:     codec,
+		tempDir:   *tempDir,
+	}
+
+	batches, rows, err := ex.exportDay(ctx, *prefix, day)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("exported batches", "day", *dayStr, "batches", batches, "rows", rows, "bucket", ex.outBucket, "prefix", *outPrefix)
+	return nil
+}
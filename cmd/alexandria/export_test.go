@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportRows(t *testing.T) {
+	stored := time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC)
+	recorded := time.Date(2025, 1, 7, 23, 0, 0, 0, time.UTC)
+
+	v1 := batch.Entry{ID: "1", LogID: "anubis_01jz4k5n8v"}
+	v1.SetData([]byte(`{"time":"2025-01-08T10:00:00.5+01:00","level":"ERROR","msg":"can't serve","err":"broken pipe","source":{"line":42}}
+panic: oops
+{"time":"yesterday","msg":"odd time"}
+`))
+
+	v2 := batch.Entry{ID: "2", LogID: "anubis_01jz4k5n8v", Times: []time.Time{recorded}}
+	v2.SetData([]byte(`{"level":"INFO","msg":"listening"}` + "\n"))
+
+	rows, err := exportRows(&logBatch{Kind: "techaro.anubis", Entries: []batch.Entry{v1, v2}}, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []exportRow{
+		{
+			ID:    "1-0",
+			Kind:  "techaro.anubis",
+			LogID: "anubis_01jz4k5n8v",
+			Time:  time.Date(2025, 1, 8, 9, 0, 0, 5e8, time.UTC),
+			Level: "ERROR",
+			Msg:   "can't serve",
+			Attrs: `{"err":"broken pipe","source":{"line":42}}`,
+		},
+		{ID: "1-1", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Time: stored, Msg: "panic: oops"},
+		{ID: "1-2", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Time: stored, Msg: "odd time", Attrs: `{"time":"yesterday"}`},
+		{ID: "2-0", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Time: recorded, Level: "INFO", Msg: "listening"},
+	}
+
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows, got %d: %+v", len(expected), len(rows), rows)
+	}
+	for i := range rows {
+		if rows[i] != expected[i] {
+			t.Errorf("row %d: expected %+v, got %+v", i, expected[i], rows[i])
+		}
+	}
+}
+
+func TestExportKey(t *testing.T) {
+	expected := "export/kind=techaro.anubis/date=2025-01-07/stored-2025-01-08.parquet"
+	if got := exportKey("export/", "techaro.anubis", "2025-01-07", "2025-01-08"); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+// exportTestBucket is a listBucket that records the objects put to it.
+type exportTestBucket struct {
+	listBucket
+	putRecorder
+}
+
+func TestExporter_ExportDay(t *testing.T) {
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	e := batch.Entry{ID: "1", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"}
+	e.SetData([]byte(`{"time":"2025-01-07T23:59:59Z","level":"INFO","msg":"late"}
+{"time":"2025-01-08T00:00:01Z","msg":"on time","path":"/"}
+`))
+	data := encodeBatch(t, e)
+
+	first := batchKey(t, "techaro.anubis", day.Add(time.Minute))
+	next := batchKey(t, "techaro.anubis", day.AddDate(0, 0, 1))
+	second := batchKey(t, "techaro.anubis", day.Add(time.Hour))
+	// IDs far outside the day aren't listed, even if they claim to be
+	// stored on it.
+	early := batchKey(t, "techaro.anubis", day.AddDate(0, 0, -30))
+
+	eb := exportTestBucket{
+		listBucket: listBucket{
+			memBucket: memBucket{
+				"logs/" + first:  data,
+				"logs/" + next:   data,
+				"logs/" + second: data,
+				"logs/" + early:  []byte("{nope"),
+			},
+			modified: map[string]time.Time{
+				"logs/" + first:  day.Add(time.Minute),
+				"logs/" + next:   day.AddDate(0, 0, 1),
+				"logs/" + second: day.Add(time.Hour),
+				"logs/" + early:  day.Add(time.Hour),
+			},
+		},
+		putRecorder: putRecorder{},
+	}
+
+	tempDir := t.TempDir()
+	ex := &exporter{s3c: eb, bucket: "logs", outBucket: "analytics", outPrefix: "export/", codec: &parquet.Snappy, tempDir: tempDir}
+	batches, rows, err := ex.exportDay(context.Background(), batch.KeyPrefix, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if left, err := os.ReadDir(tempDir); err != nil || len(left) != 0 {
+		t.Errorf("expected temporary files to be removed, got %v, %v", left, err)
+	}
+	if batches != 2 || rows != 4 {
+		t.Errorf("expected 2 batches of 4 rows, got %d batches of %d rows", batches, rows)
+	}
+	if len(eb.putRecorder) != 2 {
+		t.Errorf("expected one file per day, got %d files", len(eb.putRecorder))
+	}
+
+	for key, expected := range map[string]exportRow{
+		"analytics/export/kind=techaro.anubis/date=2025-01-07/stored-2025-01-08.parquet": {
+			ID:    "1-0",
+			Kind:  "techaro.anubis",
+			LogID: "anubis_01jz4k5n8v",
+			Time:  time.Date(2025, 1, 7, 23, 59, 59, 0, time.UTC),
+			Level: "INFO",
+			Msg:   "late",
+		},
+		"analytics/export/kind=techaro.anubis/date=2025-01-08/stored-2025-01-08.parquet": {
+			ID:    "1-1",
+			Kind:  "techaro.anubis",
+			LogID: "anubis_01jz4k5n8v",
+			Time:  time.Date(2025, 1, 8, 0, 0, 1, 0, time.UTC),
+			Msg:   "on time",
+			Attrs: `{"path":"/"}`,
+		},
+	} {
+		file, ok := eb.putRecorder[key]
+		if !ok {
+			t.Errorf("expected a file at %s", key)
+			continue
+		}
+
+		got, err := parquet.Read[exportRow](bytes.NewReader(file), int64(len(file)))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("%s: expected a row from each batch stored that day, got %d", key, len(got))
+		}
+		for i, row := range got {
+			row.Time = row.Time.UTC()
+			if row != expected {
+				t.Errorf("%s row %d: expected %+v, got %+v", key, i, expected, row)
+			}
+		}
+	}
+}
+
+func TestExporter_ExportDay_Schema(t *testing.T) {
+	e := batch.Entry{ID: "1", Kind: "techaro.anubis"}
+	e.SetData([]byte("panic: oops\n"))
+
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+	key := "logs/" + batchKey(t, "techaro.anubis", day)
+	eb := exportTestBucket{
+		listBucket: listBucket{
+			memBucket: memBucket{key: encodeBatch(t, e)},
+			modified:  map[string]time.Time{key: day},
+		},
+		putRecorder: putRecorder{},
+	}
+
+	ex := &exporter{s3c: eb, bucket: "logs", outBucket: "analytics", outPrefix: "export/", codec: &parquet.Uncompressed}
+	if _, _, err := ex.exportDay(context.Background(), batch.KeyPrefix, day); err != nil {
+		t.Fatal(err)
+	}
+
+	data := eb.putRecorder["analytics/export/kind=techaro.anubis/date=2025-01-08/stored-2025-01-08.parquet"]
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]parquet.Field{}
+	for _, field := range f.Schema().Fields() {
+		fields[field.Name()] = field
+	}
+
+	for name, want := range map[string]struct {
+		optional bool
+		logical  string
+	}{
+		"id":        {logical: "STRING"},
+		"kind":      {logical: "STRING"},
+		"logID":     {optional: true, logical: "STRING"},
+		"timestamp": {logical: "TIMESTAMP(isAdjustedToUTC=true,unit=MILLIS)"},
+		"level":     {optional: true, logical: "STRING"},
+		"msg":       {optional: true, logical: "STRING"},
+		"attrs":     {optional: true, logical: "JSON"},
+	} {
+		field, ok := fields[name]
+		if !ok {
+			t.Errorf("no %s column", name)
+			continue
+		}
+		if field.Optional() != want.optional {
+			t.Errorf("%s: expected optional %v", name, want.optional)
+		}
+		if got := field.Type().LogicalType().String(); got != want.logical {
+			t.Errorf("%s: expected logical type %s, got %s", name, want.logical, got)
+		}
+	}
+
+	// empty optional values are stored as nulls
+	rows := make([]parquet.Row, 1)
+	rr := f.RowGroups()[0].Rows()
+	defer rr.Close()
+	if n, _ := rr.ReadRows(rows); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+	for _, v := range rows[0] {
+		name := f.Schema().Fields()[v.Column()].Name()
+		if isNull := v.IsNull(); isNull != (name == "logID" || name == "level" || name == "attrs") {
+			t.Errorf("%s: unexpected null %v: %v", name, isNull, v)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+// normalizers replace the parts of error messages that vary between
+// occurrences of the same error, in order.
+var normalizers = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`"(?:[^"\\]|\\.)*"`), `"<str>"`},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){2,7}[0-9a-fA-F]{1,4}\b`), "<ip>"},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "<hex>"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8,}\b`), "<hex>"},
+	{regexp.MustCompile(`\b\d+(?:\.\d+)?[a-zµ]*\b`), "<n>"},
+}
+
+// normalizeMessage rewrites msg so that occurrences of the same error that
+// differ only in IDs, addresses, numbers or quoted values are identical.
+func normalizeMessage(msg string) string {
+	for _, n := range normalizers {
+		msg = n.re.ReplaceAllString(msg, n.repl)
+	}
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+// fingerprint identifies a normalized error message within a category.
+func fingerprint(category, normalized string) string {
+	sum := sha256.Sum256([]byte(category + "\x00" + normalized))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Categories of Anubis errors worth calling out.
+const (
+	categoryPanic     = "panic"
+	categoryPolicy    = "policy"
+	categoryChallenge = "challenge"
+)
+
+var (
+	policyFailure    = regexp.MustCompile(`(?i)polic(y|ies).*(fail|can't|cannot|couldn't|error|invalid|load|pars)|(fail|can't|cannot|couldn't|error|invalid|load|pars).*polic(y|ies)`)
+	challengeFailure = regexp.MustCompile(`(?i)challenge.*(invalid|unknown|misconfigur|no such|not found|unsupported)|(invalid|unknown|misconfigur|no such|unsupported).*challenge`)
+)
+
+// anubisCategory classifies an Anubis error, or returns "" if it is nothing
+// in particular.
+func anubisCategory(el errorLine) string {
+	text := el.text()
+	switch {
+	case el.Panic || strings.Contains(strings.ToLower(el.Msg), "panic"):
+		return categoryPanic
+	case policyFailure.MatchString(text):
+		return categoryPolicy
+	case challengeFailure.MatchString(text):
+		return categoryChallenge
+	default:
+		return ""
+	}
+}
+
+// errorLine is a log line at ERROR or above, or a Go runtime crash.
+type errorLine struct {
+	Msg string
+	Err string
+
+	// Panic is set for panic and fatal error output from the Go runtime.
+	Panic bool
+}
+
+// text is the message and error of the line, as fingerprinted.
+func (el errorLine) text() string {
+	if el.Err == "" {
+		return el.Msg
+	}
+	return el.Msg + ": " + el.Err
+}
+
+// parseErrorLine reports whether line is an error and extracts it. JSON
+// lines are read as slog output; anything else only counts if it is the
+// first line of a Go crash.
+func parseErrorLine(line []byte) (errorLine, bool) {
+	var rec struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Err   any    `json:"err"`
+		Error any    `json:"error"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		s := string(line)
+		if strings.HasPrefix(s, "panic: ") || strings.HasPrefix(s, "fatal error: ") {
+			return errorLine{Msg: s, Panic: true}, true
+		}
+		return errorLine{}, false
+	}
+
+	// slog writes levels above ERROR as ERROR+n
+	if !strings.HasPrefix(rec.Level, "ERROR") {
+		return errorLine{}, false
+	}
+
+	result := errorLine{Msg: rec.Msg}
+	for _, v := range []any{rec.Err, rec.Error} {
+		if s, ok := v.(string); ok && s != "" {
+			result.Err = s
+			break
+		}
+	}
+
+	return result, true
+}
+
+// errorOccurrence is an error seen in a batch, fingerprinted.
+type errorOccurrence struct {
+	errorLine
+
+	LogID       string
+	Version     string
+	Category    string
+	Normalized  string
+	Fingerprint string
+}
+
+// batchErrors fingerprints every error in b. Anubis errors are also
+// categorized.
+func batchErrors(b *logBatch) ([]errorOccurrence, error) {
+	var result []errorOccurrence
+	for _, e := range b.Entries {
+		lines, err := e.Lines()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range lines {
+			el, ok := parseErrorLine(line.Data)
+			if !ok {
+				continue
+			}
+
+			result = append(result, newErrorOccurrence(e, el))
+		}
+	}
+	return result, nil
+}
+
+func newErrorOccurrence(e batch.Entry, el errorLine) errorOccurrence {
+	result := errorOccurrence{
+		errorLine:  el,
+		LogID:      e.LogID,
+		Normalized: normalizeMessage(el.text()),
+	}
+
+	if e.Meta != nil {
+		result.Version = e.Meta.ServiceVersion
+	}
+
+	if e.Kind == "techaro.anubis" {
+		result.Category = anubisCategory(el)
+	}
+
+	result.Fingerprint = fingerprint(result.Category, result.Normalized)
+	return result
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+func TestNormalizeMessage(t *testing.T) {
+	tests := []struct {
+		msg      string
+		expected string
+	}{
+		{msg: "can't connect to 10.0.0.4:6379", expected: "can't connect to <ip>"},
+		{msg: "can't connect to 2001:db8:0:0:0:0:0:1", expected: "can't connect to <ip>"},
+		{msg: `no such challenge "metarefresh2"`, expected: `no such challenge "<str>"`},
+		{msg: "request 0198d7c4-5f2a-7c3e-9b1d-4e2f8a6b0c1d failed", expected: "request <uuid> failed"},
+		{msg: "timed out after 30s waiting for 3 workers", expected: "timed out after <n> waiting for <n> workers"},
+		{msg: "bad pointer 0xc000123456", expected: "bad pointer <hex>"},
+		{msg: "hash deadbeefcafe mismatch", expected: "hash <hex> mismatch"},
+		{msg: "  lots   of\tspace ", expected: "lots of space"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := normalizeMessage(tt.msg); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := fingerprint("", normalizeMessage("timed out after 30s"))
+	b := fingerprint("", normalizeMessage("timed out after 45s"))
+	if a != b {
+		t.Errorf("expected errors differing in a number to share a fingerprint, got %s and %s", a, b)
+	}
+
+	if c := fingerprint(categoryPanic, normalizeMessage("timed out after 30s")); c == a {
+		t.Error("expected the category to change the fingerprint")
+	}
+
+	if len(a) != 12 {
+		t.Errorf("expected a 12 character fingerprint, got %q", a)
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected errorLine
+		ok       bool
+	}{
+		{
+			name:     "slog error",
+			line:     `{"time":"2025-01-01T00:00:00Z","level":"ERROR","msg":"can't serve","err":"broken pipe"}`,
+			expected: errorLine{Msg: "can't serve", Err: "broken pipe"},
+			ok:       true,
+		},
+		{
+			name:     "error field",
+			line:     `{"level":"ERROR+4","msg":"can't serve","error":"broken pipe"}`,
+			expected: errorLine{Msg: "can't serve", Err: "broken pipe"},
+			ok:       true,
+		},
+		{
+			name: "slog info",
+			line: `{"level":"INFO","msg":"listening"}`,
+		},
+		{
+			name:     "panic",
+			line:     "panic: runtime error: invalid memory address or nil pointer dereference",
+			expected: errorLine{Msg: "panic: runtime error: invalid memory address or nil pointer dereference", Panic: true},
+			ok:       true,
+		},
+		{
+			name:     "fatal error",
+			line:     "fatal error: concurrent map writes",
+			expected: errorLine{Msg: "fatal error: concurrent map writes", Panic: true},
+			ok:       true,
+		},
+		{
+			name: "plain text",
+			line: "goroutine 1 [running]:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseErrorLine([]byte(tt.line))
+			if ok != tt.ok || got != tt.expected {
+				t.Errorf("expected %+v, %v; got %+v, %v", tt.expected, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestAnubisCategory(t *testing.T) {
+	tests := []struct {
+		el       errorLine
+		expected string
+	}{
+		{el: errorLine{Msg: "panic: oops", Panic: true}, expected: categoryPanic},
+		{el: errorLine{Msg: "recovered from panic", Err: "oops"}, expected: categoryPanic},
+		{el: errorLine{Msg: "can't parse policy file", Err: "yaml: line 3"}, expected: categoryPolicy},
+		{el: errorLine{Msg: "failed to load policies"}, expected: categoryPolicy},
+		{el: errorLine{Msg: "unknown challenge method", Err: "metarefresh2"}, expected: categoryChallenge},
+		{el: errorLine{Msg: "can't serve", Err: "broken pipe"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.el.text(), func(t *testing.T) {
+			if got := anubisCategory(tt.el); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func errorBatch(kind string) *logBatch {
+	meta := &alexandria.Metadata{ServiceVersion: "v1.21.0"}
+
+	a := batch.Entry{ID: "1", Kind: kind, LogID: "anubis_01jz4k5n8v", Meta: meta}
+	a.SetData([]byte(`{"level":"ERROR","msg":"can't serve","err":"write tcp 10.0.0.4:8923: broken pipe"}
+{"level":"INFO","msg":"listening"}
+{"level":"ERROR","msg":"can't serve","err":"write tcp 10.0.0.5:8923: broken pipe"}
+{"level":"ERROR","msg":"can't parse policy file","err":"yaml: line 3"}
+`))
+
+	b := batch.Entry{ID: "2", Kind: kind, LogID: "anubis_02jz4k5n8v"}
+	b.SetData([]byte("panic: runtime error: index out of range [3] with length 3\n\ngoroutine 1 [running]:\n"))
+
+	return &logBatch{Kind: kind, Entries: []batch.Entry{a, b}}
+}
+
+func TestBatchErrors(t *testing.T) {
+	occurrences, err := batchErrors(errorBatch("techaro.anubis"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(occurrences) != 4 {
+		t.Fatalf("expected 4 errors, got %d", len(occurrences))
+	}
+
+	if occurrences[0].Fingerprint != occurrences[1].Fingerprint {
+		t.Errorf("expected broken pipes from different addresses to share a fingerprint: %+v", occurrences[:2])
+	}
+	if occurrences[0].Version != "v1.21.0" {
+		t.Errorf("expected the version from the metadata, got %q", occurrences[0].Version)
+	}
+	if occurrences[2].Category != categoryPolicy || occurrences[3].Category != categoryPanic {
+		t.Errorf("unexpected categories %q and %q", occurrences[2].Category, occurrences[3].Category)
+	}
+
+	occurrences, err = batchErrors(errorBatch("techaro.other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range occurrences {
+		if o.Category != "" {
+			t.Errorf("expected only Anubis errors to be categorized, got %q", o.Category)
+		}
+	}
+}
+
+func TestFingerprintsAnalyzer(t *testing.T) {
+	findings, err := fingerprintsAnalyzer{}.Analyze(context.Background(), errorBatch("techaro.anubis"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(findings) != 3 {
+		t.Fatalf("expected 3 findings, got %d: %+v", len(findings), findings)
+	}
+
+	if findings[0].Details["count"] != 2 || findings[0].Details["version"] != "v1.21.0" {
+		t.Errorf("unexpected details %v", findings[0].Details)
+	}
+	if findings[2].Severity != severityError || findings[2].LogID != "anubis_02jz4k5n8v" {
+		t.Errorf("expected the panic to be an error, got %+v", findings[2])
+	}
+}
+
+func TestAnubisCrashesAnalyzer(t *testing.T) {
+	findings, err := anubisCrashesAnalyzer{}.Analyze(context.Background(), errorBatch("techaro.anubis"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %d: %+v", len(findings), findings)
+	}
+	if findings[0].Details["category"] != categoryPolicy || findings[1].Details["category"] != categoryPanic {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+
+	findings, err = anubisCrashesAnalyzer{}.Analyze(context.Background(), errorBatch("techaro.other"))
+	if err != nil || findings != nil {
+		t.Errorf("expected no findings for other kinds, got %+v, %v", findings, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/ingestpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// maxStreamSize bounds the log bytes one IngestStream call may carry, since
+// they are held until the stream is closed.
+const maxStreamSize = 8 * maxEnvelopeSize
+
+// grpcIngest serves the Ingest gRPC service on top of a Server.
+type grpcIngest struct {
+	ingestpb.UnimplementedIngestServer
+	s *Server
+}
+
+// NewGRPCServer creates a gRPC server exposing the Ingest service.
+func NewGRPCServer(s *Server) *grpc.Server {
+	result := grpc.NewServer(grpc.MaxRecvMsgSize(maxEnvelopeSize))
+	ingestpb.RegisterIngestServer(result, &grpcIngest{s: s})
+	return result
+}
+
+func (g *grpcIngest) Ingest(ctx context.Context, req *ingestpb.IngestRequest) (*ingestpb.IngestResponse, error) {
+	logID, err := g.ingest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	g.setDirectives(ctx, req.GetKind(), logID)
+
+	return &ingestpb.IngestResponse{Accepted: uint64(len(req.GetRecords()))}, nil
+}
+
+// IngestStream collects every batch of the stream, then admits them all
+// before ingesting any, so that a client retrying a rejected stream doesn't
+// store its first batches twice. Streams carrying more than maxStreamSize
+// bytes of log lines are refused.
+func (g *grpcIngest) IngestStream(stream grpc.ClientStreamingServer[ingestpb.IngestRequest, ingestpb.IngestResponse]) error {
+	var (
+		envs    []*alexandria.Envelope
+		size    int
+		records uint64
+	)
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		env := req.Envelope()
+		slog.Info("got request for", "kind", env.Kind, "logID", env.LogID, "records", len(env.Records), "dropped", env.Dropped, "transport", "grpc-stream")
+
+		// Refused batches would be refused again on retry, so the whole
+		// stream fails before taking any tokens
+		if _, rej := g.s.validate(env.Kind, env.LogID); rej != nil {
+			return rejectionStatus(rej)
+		}
+
+		if size += envelopeSize(env); size > maxStreamSize {
+			rejectedRequestsTotal.WithLabelValues(rejectTooLarge).Inc()
+			return status.Errorf(codes.InvalidArgument, "stream carries more than %d bytes of logs, split it", maxStreamSize)
+		}
+		envs = append(envs, env)
+		records += uint64(len(env.Records))
+	}
+
+	admitted, _, limited := g.s.admitAll(envs, peerIP(stream.Context()))
+	if limited != nil {
+		return rejectionStatus(limited)
+	}
+
+	if _, err := g.s.ingestAll(admitted); err != nil {
+		return status.Error(codes.Unavailable, "can't accept logs right now")
+	}
+
+	return stream.SendAndClose(&ingestpb.IngestResponse{Accepted: records})
+}
+
+// ingest stores the records of req and returns its canonical logID.
+func (g *grpcIngest) ingest(ctx context.Context, req *ingestpb.IngestRequest) (string, error) {
+	env := req.Envelope()
+	slog.Info("got request for", "kind", env.Kind, "logID", env.LogID, "records", len(env.Records), "dropped", env.Dropped, "transport", "grpc")
+
+	logID, rej := g.s.check(env.Kind, env.LogID, peerIP(ctx))
+	if rej != nil {
+		return "", rejectionStatus(rej)
+	}
+
+	if rej := g.s.checkQuota(env.Kind, logID, envelopeSize(env)); rej != nil {
+		return "", rejectionStatus(rej)
+	}
+
+	if err := g.s.ingestEnvelope(env, logID); err != nil {
+		slog.Error("can't publish logs", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBundler).Inc()
+		return "", status.Error(codes.Unavailable, "can't accept logs right now")
+	}
+
+	return logID, nil
+}
+
+// setDirectives adds the directives of logID to the response header
+// metadata of a unary call, recording the version its client reported
+// applying in the request metadata.
+func (g *grpcIngest) setDirectives(ctx context.Context, kind, logID string) {
+	applied := alexandria.AppliedFromHeader(http.Header{
+		alexandria.HeaderDirectivesApplied: metadata.ValueFromIncomingContext(ctx, ingestpb.MetadataDirectivesApplied),
+	})
+
+	d := g.s.directives.lookup(kind, logID, applied)
+	if d == nil {
+		return
+	}
+
+	h := http.Header{}
+	if err := d.SetHeader(h); err != nil {
+		slog.Error("can't encode directives", "err", err)
+		return
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(ingestpb.MetadataDirectives, h.Get(alexandria.HeaderDirectives))); err != nil {
+		slog.Error("can't send directives", "err", err)
+	}
+}
+
+// rejectionStatus records rej and converts it to a gRPC status.
+func rejectionStatus(rej *rejection) error {
+	rejectedRequestsTotal.WithLabelValues(rej.reason).Inc()
+
+	code := codes.InvalidArgument
+	if rej.status == http.StatusTooManyRequests {
+		code = codes.ResourceExhausted
+	}
+
+	return status.Error(code, rej.Error())
+}
+
+// peerIP returns the IP address of the gRPC client.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
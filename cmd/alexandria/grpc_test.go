@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/ingestpb"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCIngest(t *testing.T) {
+	s := NewServer(nil, "bucket")
+
+	ln := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(s)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	client := ingestpb.NewIngestClient(cc)
+
+	tests := []struct {
+		name     string
+		env      *alexandria.Envelope
+		code     codes.Code
+		accepted uint64
+	}{
+		{
+			name: "accepted",
+			env: &alexandria.Envelope{
+				Kind:    "techaro.anubis",
+				LogID:   "ANUBIS_01JZ4K5N8V",
+				Records: []alexandria.Record{{Line: "one"}, {Line: "two"}},
+			},
+			code:     codes.OK,
+			accepted: 2,
+		},
+		{
+			name: "unknown kind",
+			env: &alexandria.Envelope{
+				Kind:  "techaro.nope",
+				LogID: "anubis_01jz4k5n8v",
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "invalid logID",
+			env: &alexandria.Envelope{
+				Kind:  "techaro.anubis",
+				LogID: "hello world",
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Ingest(t.Context(), ingestpb.FromEnvelope(tt.env))
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("expected code %v, got %v (%v)", tt.code, got, err)
+			}
+
+			if err == nil && resp.GetAccepted() != tt.accepted {
+				t.Errorf("expected %d accepted, got %d", tt.accepted, resp.GetAccepted())
+			}
+		})
+	}
+
+	stream, err := client.IngestStream(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := stream.Send(ingestpb.FromEnvelope(&alexandria.Envelope{
+			Kind:    "techaro.thoth",
+			LogID:   "anubis_01jz4k5n8v",
+			Records: []alexandria.Record{{Line: "line"}},
+		})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAccepted() != 3 {
+		t.Errorf("expected 3 accepted from stream, got %d", resp.GetAccepted())
+	}
+
+	if s.buffered["techaro.anubis"].Load() == 0 || s.buffered["techaro.thoth"].Load() == 0 {
+		t.Error("expected accepted records to reach the bundlers")
+	}
+}
+
+func TestGRPCIngest_Directives(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.directives = newDirectiveStore("secret", time.Hour, newDirectiveTestBucket(), "bucket")
+
+	d, err := directiveRequest{FlushInterval: "10s"}.directives(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := s.directives.set(t.Context(), "techaro.anubis", "anubis_01jz4k5n8v", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := ingestpb.NewTransport(grpcTestConn(t, s))
+	env := &alexandria.Envelope{
+		Kind:    "techaro.anubis",
+		LogID:   "ANUBIS_01JZ4K5N8V",
+		Records: []alexandria.Record{{Line: "one"}},
+	}
+
+	got, err := tr.SendDirectives(t.Context(), env, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Version != set.Version || got.FlushInterval != 10*time.Second {
+		t.Errorf("expected version %d in the response, got %+v", set.Version, got)
+	}
+
+	list, err := s.directives.list(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Applied != 42 {
+		t.Errorf("expected the applied version to be recorded, got %+v", list)
+	}
+
+	env.Kind = "techaro.thoth"
+	if got, err := tr.SendDirectives(t.Context(), env, 0); got != nil || err != nil {
+		t.Errorf("expected no directives for another kind, got %+v, %v", got, err)
+	}
+}
+
+// grpcTestConn serves s over an in-memory listener and connects to it.
+func grpcTestConn(t *testing.T, s *Server) *grpc.ClientConn {
+	t.Helper()
+
+	ln := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(s)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func TestGRPCIngestStream_AllOrNothing(t *testing.T) {
+	good := &alexandria.Envelope{Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v", Records: []alexandria.Record{{Line: "line"}}}
+
+	tests := []struct {
+		name string
+		envs []*alexandria.Envelope
+		code codes.Code
+	}{
+		{
+			name: "rate limited",
+			envs: []*alexandria.Envelope{good, good, {Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8w", Records: []alexandria.Record{{Line: "line"}}}},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "refused",
+			envs: []*alexandria.Envelope{good, {Kind: "techaro.nope", LogID: "anubis_01jz4k5n8v"}},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, "bucket")
+			s.limits = &uploadLimits{byIP: newKeyedLimiter(rate.Limit(0.001), 1)}
+			client := ingestpb.NewIngestClient(grpcTestConn(t, s))
+
+			stream, err := client.IngestStream(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, env := range tt.envs {
+				if err := stream.Send(ingestpb.FromEnvelope(env)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = stream.CloseAndRecv()
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("expected code %v, got %v (%v)", tt.code, got, err)
+			}
+			for kind, n := range s.buffered {
+				if got := n.Load(); got != 0 {
+					t.Errorf("%s: expected nothing buffered so a retry can't duplicate records, got %d bytes", kind, got)
+				}
+			}
+
+			// The tokens the stream took were put back
+			if _, err := client.Ingest(t.Context(), ingestpb.FromEnvelope(good)); err != nil {
+				t.Errorf("expected the rejected stream's tokens to be refunded, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// Livez reports that the process is up and serving HTTP.
+func (s *Server) Livez(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// Readyz reports whether this instance can currently persist uploads. It
+// returns 503 with the failing checks when it can't.
+//
+// Accepted entries only wait in the in-memory bundlers before going to the
+// bucket, so there is no local disk to check. A spool or WAL needs its own
+// check here when one is added.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := s.ready(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+func (s *Server) ready(ctx context.Context) error {
+	var errs []error
+
+	if _, err := s.s3c.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("can't reach bucket %s: %w", s.bucket, err))
+	}
+
+	// Stop taking traffic a bit before the bundler starts rejecting adds so
+	// that in-flight requests still have room.
+	for kind, b := range s.bundlers {
+		buffered := s.buffered[kind].Load()
+		if limit := int64(b.BufferedByteLimit); buffered >= limit*9/10 {
+			errs = append(errs, fmt.Errorf("bundler for %s is nearly full: %d of %d bytes buffered", kind, buffered, limit))
+		}
+	}
+
+	return errors.Join(errs...)
+}
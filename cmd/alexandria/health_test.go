@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_Livez(t *testing.T) {
+	s := NewServer(ingestTestBucket{headErr: errors.New("bucket is gone")}, "logs")
+
+	w := httptest.NewRecorder()
+	s.Livez(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected liveness to ignore the bucket, got status %d", w.Code)
+	}
+}
+
+func TestServer_Readyz(t *testing.T) {
+	const kind = "techaro.anubis"
+	limit := NewServer(nil, "logs").bundlers[kind].BufferedByteLimit
+
+	tests := []struct {
+		name     string
+		headErr  error
+		buffered int
+		status   int
+		body     string
+	}{
+		{name: "ready", status: http.StatusOK, body: "OK"},
+		{name: "bundler has room", buffered: limit / 2, status: http.StatusOK, body: "OK"},
+		{name: "bucket unreachable", headErr: errors.New("no such bucket"), status: http.StatusServiceUnavailable, body: "can't reach bucket logs: no such bucket"},
+		{name: "bundler nearly full", buffered: limit * 9 / 10, status: http.StatusServiceUnavailable, body: "bundler for techaro.anubis is nearly full"},
+		{name: "bundler full", buffered: limit, status: http.StatusServiceUnavailable, body: "bundler for techaro.anubis is nearly full"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(ingestTestBucket{headErr: tt.headErr}, "logs")
+			s.trackBuffered(kind, tt.buffered)
+			defer s.trackBuffered(kind, -tt.buffered)
+
+			w := httptest.NewRecorder()
+			s.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("expected body to contain %q, got %q", tt.body, w.Body.String())
+			}
+		})
+	}
+}
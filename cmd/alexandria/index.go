@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+)
+
+const (
+	// indexPrefix is where search indexes are stored in the bucket, at
+	// index/{kind}/{day}.json.gz.
+	indexPrefix = "index/"
+
+	// indexRangeGap is the largest gap between wanted entries of a batch
+	// that are still read with a single ranged request.
+	indexRangeGap = 64 << 10
+
+	// maxTokenLen is the length of the longest token indexed, in bytes.
+	maxTokenLen = 64
+)
+
+// indexedColumns are the columns of the logs table whose words are indexed.
+var indexedColumns = []string{"level", "msg", "attrs"}
+
+// searchTokens splits text into the lowercase words search matches on.
+// Words of one character and very long ones aren't tokens.
+func searchTokens(text string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for word := range strings.FieldsFuncSeq(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		word = strings.ToLower(word)
+		if utf8.RuneCountInString(word) < 2 || len(word) > maxTokenLen || seen[word] {
+			continue
+		}
+		seen[word] = true
+		result = append(result, word)
+	}
+	return result
+}
+
+// searchIndex is the inverted index of the batches of a kind stored on a
+// day. Tokens and log IDs map to ascending positions in Entries.
+type searchIndex struct {
+	Kind    string           `json:"kind"`
+	Day     string           `json:"day"`
+	Batches []indexedBatch   `json:"batches"`
+	Entries []indexedEntry   `json:"entries"`
+	Tokens  map[string][]int `json:"tokens"`
+	LogIDs  map[string][]int `json:"logIDs"`
+}
+
+// indexedBatch is a batch covered by an index.
+type indexedBatch struct {
+	Key    string    `json:"key"`
+	Stored time.Time `json:"stored"`
+
+	// Ranged is set if the batch is uncompressed, so its entries can be
+	// read by byte range.
+	Ranged bool `json:"ranged"`
+}
+
+// indexedEntry is where an entry is stored. Offset and Length are only set
+// for entries of ranged batches.
+type indexedEntry struct {
+	Batch int `json:"batch"`
+	// Entry is the position of the entry in its batch.
+	Entry  int   `json:"entry"`
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+}
+
+func newSearchIndex(kind, day string) *searchIndex {
+	return &searchIndex{
+		Kind:   kind,
+		Day:    day,
+		Tokens: map[string][]int{},
+		LogIDs: map[string][]int{},
+	}
+}
+
+// indexKey is where the index of the batches of kind stored on day is
+// stored.
+func indexKey(kind, day string) string {
+	return indexPrefix + kind + "/" + day + ".json.gz"
+}
+
+// parseIndexKey returns the kind and day of the index stored at key, or
+// false if key isn't an index.
+func parseIndexKey(key string) (kind, day string, ok bool) {
+	rest, ok := strings.CutPrefix(key, indexPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	kind, name, ok := strings.Cut(rest, "/")
+	if !ok || kind == "" {
+		return "", "", false
+	}
+
+	day, ok = strings.CutSuffix(name, ".json.gz")
+	if _, err := time.Parse(time.DateOnly, day); !ok || err != nil {
+		return "", "", false
+	}
+	return kind, day, true
+}
+
+// add indexes the batch stored at key, given its content.
+func (si *searchIndex) add(key string, stored time.Time, data []byte) error {
+	b := len(si.Batches)
+	ranged := !batch.Compressed(data)
+	si.Batches = append(si.Batches, indexedBatch{Key: key, Stored: stored, Ranged: ranged})
+
+	if !ranged {
+		i := 0
+		for e, err := range batch.Entries(bytes.NewReader(data)) {
+			if err != nil {
+				return fmt.Errorf("can't read %s: %w", key, err)
+			}
+			if err := si.addEntry(indexedEntry{Batch: b, Entry: i}, e); err != nil {
+				return fmt.Errorf("can't read %s: %w", key, err)
+			}
+			i++
+		}
+		return nil
+	}
+
+	var offset int64
+	i := 0
+	for rest := data; len(rest) != 0; {
+		line, after, _ := bytes.Cut(rest, []byte("\n"))
+		start := offset
+		offset += int64(len(rest) - len(after))
+		rest = after
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var e batch.Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("can't decode entry %d of %s: %w", i, key, err)
+		}
+		if err := si.addEntry(indexedEntry{Batch: b, Entry: i, Offset: start, Length: int64(len(line))}, e); err != nil {
+			return fmt.Errorf("can't read %s: %w", key, err)
+		}
+		i++
+	}
+
+	return nil
+}
+
+func (si *searchIndex) addEntry(ie indexedEntry, e batch.Entry) error {
+	rows, err := exportRows(&logBatch{Kind: si.Kind, Entries: []batch.Entry{e}}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	n := len(si.Entries)
+	si.Entries = append(si.Entries, ie)
+
+	tokens := map[string]bool{}
+	for _, row := range rows {
+		for _, token := range rowTokens(row) {
+			tokens[token] = true
+		}
+	}
+	for token := range tokens {
+		si.Tokens[token] = append(si.Tokens[token], n)
+	}
+
+	if e.LogID != "" {
+		si.LogIDs[e.LogID] = append(si.LogIDs[e.LogID], n)
+	}
+
+	return nil
+}
+
+// rowTokens returns the tokens of the indexed columns of row.
+func rowTokens(row exportRow) []string {
+	return searchTokens(row.Level + " " + row.Msg + " " + row.Attrs)
+}
+
+// lookup returns the positions of the entries holding every token in
+// terms, restricted to those of logIDs unless it is nil.
+func (si *searchIndex) lookup(terms, logIDs []string) []int {
+	var result []int
+	if len(terms) == 0 {
+		result = make([]int, len(si.Entries))
+		for i := range result {
+			result[i] = i
+		}
+	}
+
+	for i, term := range terms {
+		if i == 0 {
+			result = si.Tokens[term]
+			continue
+		}
+		result = intersectPostings(result, si.Tokens[term])
+	}
+
+	if logIDs != nil {
+		var ofLogIDs []int
+		for _, logID := range logIDs {
+			ofLogIDs = append(ofLogIDs, si.LogIDs[logID]...)
+		}
+		slices.Sort(ofLogIDs)
+		result = intersectPostings(result, slices.Compact(ofLogIDs))
+	}
+
+	return result
+}
+
+// intersectPostings returns the positions in both of the ascending lists a
+// and b.
+func intersectPostings(a, b []int) []int {
+	var result []int
+	for len(a) != 0 && len(b) != 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			result = append(result, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return result
+}
+
+// encode returns the index as gzipped JSON.
+func (si *searchIndex) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gw).Encode(si); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadIndex downloads and decodes the index stored at key.
+func loadIndex(ctx context.Context, s3c objectGetter, bucket, key string) (*searchIndex, error) {
+	obj, err := s3c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	gr, err := gzip.NewReader(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress %s: %w", key, err)
+	}
+	defer gr.Close()
+
+	var result searchIndex
+	if err := json.NewDecoder(gr).Decode(&result); err != nil {
+		return nil, fmt.Errorf("can't decode %s: %w", key, err)
+	}
+	return &result, nil
+}
+
+// indexer builds the search indexes of the batches in a bucket.
+type indexer struct {
+	s3c    exportBucket
+	bucket string
+}
+
+// indexDay indexes every batch stored on day and stores one index per
+// kind, replacing any built before.
+func (ix *indexer) indexDay(ctx context.Context, day time.Time) (map[string]*searchIndex, error) {
+	start := day.UTC().Truncate(24 * time.Hour)
+	end := start.AddDate(0, 0, 1)
+	dayStr := start.Format(time.DateOnly)
+
+	indexes := map[string]*searchIndex{}
+	err := listBatches(ctx, ix.s3c, ix.bucket, batch.KeyPrefix, start, end, func(key, kind string, stored time.Time) error {
+		data, err := fetchRange(ctx, ix.s3c, ix.bucket, key, "")
+		if err != nil {
+			return err
+		}
+
+		si, ok := indexes[kind]
+		if !ok {
+			si = newSearchIndex(kind, dayStr)
+			indexes[kind] = si
+		}
+		return si.add(key, stored, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range slices.Sorted(maps.Keys(indexes)) {
+		data, err := indexes[kind].encode()
+		if err != nil {
+			return nil, fmt.Errorf("can't encode index of %s: %w", kind, err)
+		}
+
+		key := indexKey(kind, dayStr)
+		if _, err := ix.s3c.PutObject(ctx, &s3.PutObjectInput{
+			Body:        bytes.NewReader(data),
+			Bucket:      aws.String(ix.bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String("application/gzip"),
+		}); err != nil {
+			return nil, fmt.Errorf("can't store %s: %w", key, err)
+		}
+	}
+
+	return indexes, nil
+}
+
+// fetchRange downloads an object, or the byte range rng of it if that
+// isn't empty.
+func fetchRange(ctx context.Context, s3c objectGetter, bucket, key, rng string) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+
+	obj, err := s3c.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// scanIndexes calls fn with the rows of the entries the indexes matching
+// plan point to, until fn returns false. It returns the keys of the batches
+// the indexes cover, which don't have to be scanned again.
+func (qe *queryEngine) scanIndexes(ctx context.Context, plan queryPlan, fn func(*queryRow) (bool, error)) (map[string]bool, bool, error) {
+	covered := map[string]bool{}
+
+	prefixes := []string{indexPrefix}
+	if plan.kinds != nil {
+		prefixes = nil
+		for _, kind := range plan.kinds {
+			prefixes = append(prefixes, indexPrefix+kind+"/")
+		}
+	}
+
+	for _, prefix := range prefixes {
+		pages := s3.NewListObjectsV2Paginator(qe.s3c, &s3.ListObjectsV2Input{
+			Bucket: aws.String(qe.bucket),
+			Prefix: aws.String(prefix),
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, false, fmt.Errorf("can't list %s: %w", prefix, err)
+			}
+
+			for _, obj := range page.Contents {
+				key := aws.ToString(obj.Key)
+				_, day, ok := parseIndexKey(key)
+				if !ok || !plan.storedOn(day) {
+					continue
+				}
+
+				si, err := loadIndex(ctx, qe.s3c, qe.bucket, key)
+				if err != nil {
+					return nil, false, err
+				}
+				for _, b := range si.Batches {
+					covered[b.Key] = true
+				}
+
+				more, err := qe.scanIndex(ctx, plan, si, fn)
+				if err != nil || !more {
+					return covered, false, err
+				}
+			}
+		}
+	}
+
+	return covered, true, nil
+}
+
+// scanIndex reads the entries of si matching plan, batch by batch.
+func (qe *queryEngine) scanIndex(ctx context.Context, plan queryPlan, si *searchIndex, fn func(*queryRow) (bool, error)) (bool, error) {
+	byBatch := map[int][]indexedEntry{}
+	for _, n := range si.lookup(plan.terms, plan.logIDs) {
+		ie := si.Entries[n]
+		byBatch[ie.Batch] = append(byBatch[ie.Batch], ie)
+	}
+
+	for _, b := range slices.Sorted(maps.Keys(byBatch)) {
+		ib := si.Batches[b]
+		entries, err := qe.readEntries(ctx, ib, byBatch[b])
+		if err != nil {
+			return false, err
+		}
+
+		rows, err := exportRows(&logBatch{Kind: si.Kind, Entries: entries}, ib.Stored)
+		if err != nil {
+			return false, fmt.Errorf("can't read %s: %w", ib.Key, err)
+		}
+
+		for _, row := range rows {
+			more, err := fn(&queryRow{exportRow: row, Date: si.Day, Batch: ib.Key})
+			if err != nil || !more {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// readEntries reads the wanted entries of a batch, which are in the order
+// they are stored in. Entries of ranged batches are read with as few ranged
+// requests as they are close together; other batches are read whole.
+func (qe *queryEngine) readEntries(ctx context.Context, ib indexedBatch, wanted []indexedEntry) ([]batch.Entry, error) {
+	var result []batch.Entry
+
+	if !ib.Ranged {
+		kind, _ := batch.ParseKey(ib.Key)
+		b, err := fetchBatch(ctx, qe.s3c, qe.bucket, ib.Key, kind)
+		if err != nil {
+			return nil, err
+		}
+		qe.fetched++
+
+		for _, ie := range wanted {
+			if ie.Entry >= len(b.Entries) {
+				return nil, fmt.Errorf("%s changed since it was indexed", ib.Key)
+			}
+			result = append(result, b.Entries[ie.Entry])
+		}
+		return result, nil
+	}
+
+	for len(wanted) != 0 {
+		n := 1
+		end := wanted[0].Offset + wanted[0].Length
+		for n < len(wanted) && wanted[n].Offset-end <= indexRangeGap {
+			end = wanted[n].Offset + wanted[n].Length
+			n++
+		}
+
+		start := wanted[0].Offset
+		data, err := fetchRange(ctx, qe.s3c, qe.bucket, ib.Key, fmt.Sprintf("bytes=%d-%d", start, end-1))
+		if err != nil {
+			return nil, err
+		}
+		qe.ranges++
+
+		for _, ie := range wanted[:n] {
+			from, to := ie.Offset-start, ie.Offset-start+ie.Length
+			if to > int64(len(data)) {
+				return nil, fmt.Errorf("%s changed since it was indexed", ib.Key)
+			}
+
+			var e batch.Entry
+			if err := json.Unmarshal(data[from:to], &e); err != nil {
+				return nil, fmt.Errorf("can't decode entry %d of %s: %w", ie.Entry, ib.Key, err)
+			}
+			result = append(result, e)
+		}
+		wanted = wanted[n:]
+	}
+
+	return result, nil
+}
+
+// runIndex is the index subcommand: it builds the search indexes of a day
+// of batches, which query uses for MATCH conditions.
+func runIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	bucketName := fs.String("bucket", *bucket, "bucket to index batches in")
+	dayStr := fs.String("day", time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly), "UTC day whose batches to index, as YYYY-MM-DD")
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(time.DateOnly, *dayStr)
+	if err != nil {
+		return fmt.Errorf("can't parse -day: %w", err)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ix := &indexer{s3c: s3.NewFromConfig(cfg), bucket: *bucketName}
+	indexes, err := ix.indexDay(ctx, day)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range slices.Sorted(maps.Keys(indexes)) {
+		si := indexes[kind]
+		slog.Info("indexed batches", "day", *dayStr, "kind", kind, "batches", len(si.Batches), "entries", len(si.Entries), "tokens", len(si.Tokens))
+	}
+	return nil
+}
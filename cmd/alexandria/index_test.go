@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+func TestSearchTokens(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{text: "", expected: nil},
+		{text: "Can't load policy: bad regex", expected: []string{"can", "load", "policy", "bad", "regex"}},
+		{text: `{"err":"broken pipe","source":{"line":42}}`, expected: []string{"err", "broken", "pipe", "source", "line", "42"}},
+		{text: "policy POLICY Policy", expected: []string{"policy"}},
+		{text: "Straße überall", expected: []string{"straße", "überall"}},
+		{text: "a " + string(make([]byte, maxTokenLen+1)), expected: nil},
+	}
+
+	for _, tt := range tests {
+		if got := searchTokens(tt.text); !slices.Equal(got, tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
+
+func TestParseIndexKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		kind string
+		day  string
+		ok   bool
+	}{
+		{key: indexKey("techaro.anubis", "2025-01-08"), kind: "techaro.anubis", day: "2025-01-08", ok: true},
+		{key: "index/techaro.anubis/2025-01-08.json"},
+		{key: "index/techaro.anubis/latest.json.gz"},
+		{key: "index/2025-01-08.json.gz"},
+		{key: "inp/techaro.anubis/2025-01-08.json.gz"},
+	}
+
+	for _, tt := range tests {
+		kind, day, ok := parseIndexKey(tt.key)
+		if kind != tt.kind || day != tt.day || ok != tt.ok {
+			t.Errorf("%s: expected %q, %q, %v, got %q, %q, %v", tt.key, tt.kind, tt.day, tt.ok, kind, day, ok)
+		}
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSearchIndex(t *testing.T) {
+	entry := func(id, logID, data string) batch.Entry {
+		e := batch.Entry{ID: id, LogID: logID}
+		e.SetData([]byte(data))
+		return e
+	}
+
+	plain := encodeBatch(t,
+		entry("a", "anubis_1", `{"level":"ERROR","msg":"broken pipe"}`+"\n"),
+		entry("b", "anubis_2", "plain text about a broken policy\n"),
+		entry("c", "anubis_1", `{"level":"INFO","msg":"listening","addr":":8923"}`+"\n"),
+	)
+	compressed := gzipData(t, encodeBatch(t, entry("d", "anubis_1", `{"msg":"policy pipe"}`+"\n")))
+
+	si := newSearchIndex("techaro.anubis", "2025-01-08")
+	stored := time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC)
+	if err := si.add("inp/techaro.anubis/batch-1.jsonl", stored, plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.add("inp/techaro.anubis/batch-2.jsonl.gz", stored, compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	if !si.Batches[0].Ranged || si.Batches[1].Ranged {
+		t.Errorf("expected only the plain batch to be ranged, got %+v", si.Batches)
+	}
+
+	for i, ie := range si.Entries[:3] {
+		var e batch.Entry
+		if err := json.Unmarshal(plain[ie.Offset:ie.Offset+ie.Length], &e); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if e.ID != string(rune('a'+i)) || ie.Entry != i {
+			t.Errorf("entry %d: range %d+%d holds entry %s", i, ie.Offset, ie.Length, e.ID)
+		}
+	}
+	if ie := si.Entries[3]; ie.Batch != 1 || ie.Entry != 0 || ie.Length != 0 {
+		t.Errorf("unexpected entry of compressed batch %+v", ie)
+	}
+
+	tests := []struct {
+		terms    []string
+		logIDs   []string
+		expected []int
+	}{
+		{terms: []string{"broken"}, expected: []int{0, 1}},
+		{terms: []string{"broken", "pipe"}, expected: []int{0}},
+		{terms: []string{"pipe"}, logIDs: []string{"anubis_1"}, expected: []int{0, 3}},
+		{terms: []string{"policy"}, logIDs: []string{"anubis_3"}},
+		{terms: []string{"8923", "info", "addr"}, expected: []int{2}},
+		{terms: []string{"nope", "pipe"}},
+		{terms: []string{}, logIDs: []string{"anubis_2", "anubis_1"}, expected: []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.terms, tt.logIDs), func(t *testing.T) {
+			if got := si.lookup(tt.terms, tt.logIDs); !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueryEngine_Search(t *testing.T) {
+	lb := queryTestBucket(t)
+	thoth := "logs/inp/techaro.thoth/batch-3.jsonl"
+	lb.memBucket[thoth] = gzipData(t, lb.memBucket[thoth])
+
+	// IDs far outside the day aren't listed, even if they claim to be
+	// stored on it.
+	early := "logs/" + batchKey(t, "techaro.anubis", time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC))
+	lb.memBucket[early] = []byte("{nope")
+	lb.modified[early] = time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	ib := exportTestBucket{listBucket: lb, putRecorder: putRecorder{}}
+	ix := &indexer{s3c: ib, bucket: "logs"}
+	if _, err := ix.indexDay(context.Background(), time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	delete(lb.memBucket, early)
+	delete(lb.modified, early)
+
+	for _, key := range []string{"logs/index/techaro.anubis/2025-01-08.json.gz", "logs/index/techaro.thoth/2025-01-08.json.gz"} {
+		data, ok := ib.putRecorder[key]
+		if !ok {
+			t.Fatalf("expected an index at %s", key)
+		}
+		lb.memBucket[key] = data
+	}
+
+	tests := []struct {
+		name    string
+		sql     string
+		rows    string
+		fetched int
+		ranges  int
+	}{
+		{
+			name:    "unindexed days are scanned",
+			sql:     "SELECT id FROM logs WHERE MATCH (msg) AGAINST ('Policy') ORDER BY id",
+			rows:    "[[a-0] [c-1] [d-0] [e-0]]",
+			fetched: 2,
+			ranges:  1,
+		},
+		{
+			name:   "indexed days only",
+			sql:    "SELECT id, kind FROM logs WHERE MATCH (msg, attrs) AGAINST ('missing file') AND date = '2025-01-08'",
+			rows:   "[[c-1 techaro.anubis]]",
+			ranges: 1,
+		},
+		{
+			name:   "logID and kind",
+			sql:    "SELECT id FROM logs WHERE kind = 'techaro.anubis' AND date >= '2025-01-07' AND MATCH (msg) AGAINST ('policy') AND logID = 'anubis_3'",
+			rows:   "[[d-0]]",
+			ranges: 1,
+		},
+		{
+			name:    "unindexed columns",
+			sql:     "SELECT id FROM logs WHERE MATCH (kind) AGAINST ('thoth') AND date = '2025-01-08'",
+			rows:    "[[e-0]]",
+			fetched: 2,
+		},
+		{
+			name: "no matches",
+			sql:  "SELECT count(*) FROM logs WHERE MATCH (msg) AGAINST ('nothing') AND date = '2025-01-08'",
+			rows: "[[0]]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qe := &queryEngine{s3c: lb, bucket: "logs"}
+			res, err := qe.run(context.Background(), tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(res.Rows); got != tt.rows {
+				t.Errorf("expected rows %s, got %s", tt.rows, got)
+			}
+			if qe.fetched != tt.fetched || qe.ranges != tt.ranges {
+				t.Errorf("expected %d batches and %d ranges fetched, got %d and %d", tt.fetched, tt.ranges, qe.fetched, qe.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+// supportedProtocols is advertised to clients in alexandria.HeaderProtocols.
+var supportedProtocols = fmt.Sprintf("%d, %d", alexandria.ProtocolV1, alexandria.ProtocolV2)
+
+// maxEnvelopeSize leaves room for JSON framing and per-record timestamps on
+// top of maxLogSize bytes of log lines.
+const maxEnvelopeSize = 2 * maxLogSize
+
+// IngestV2 accepts a protocol v2 envelope as JSON or NDJSON.
+func (s *Server) IngestV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(alexandria.HeaderProtocols, supportedProtocols)
+
+	defer r.Body.Close()
+	env, err := alexandria.DecodeEnvelope(r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		if mbe := (*http.MaxBytesError)(nil); errors.As(err, &mbe) {
+			s.rejectRead(err)
+			http.Error(w, "envelope too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		slog.Error("can't decode envelope", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if env.Version != alexandria.ProtocolV2 {
+		rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+		http.Error(w, fmt.Sprintf("unsupported envelope version %d", env.Version), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("got request for", "kind", env.Kind, "logID", env.LogID, "records", len(env.Records), "dropped", env.Dropped)
+
+	logID, ok := s.admit(w, r, env.Kind, env.LogID)
+	if !ok {
+		return
+	}
+	s.setDirectives(w, r, env.Kind, logID)
+
+	if rej := s.checkQuota(env.Kind, logID, envelopeSize(env)); rej != nil {
+		s.reject(w, rej)
+		return
+	}
+
+	if err := s.ingestEnvelope(env, logID); err != nil {
+		slog.Error("can't publish logs", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBundler).Inc()
+		http.Error(w, "can't accept logs right now", http.StatusServiceUnavailable)
+		return
+	}
+}
+
+// envelopeSize is the number of log bytes in env, as counted against quotas.
+func envelopeSize(env *alexandria.Envelope) int {
+	result := 0
+	for _, rec := range env.Records {
+		result += len(rec.Line) + 1
+	}
+	return result
+}
+
+// ingestEnvelope stores the records in env as one entry under the
+// already-canonicalized logID.
+func (s *Server) ingestEnvelope(env *alexandria.Envelope, logID string) error {
+	var buf bytes.Buffer
+	times := make([]time.Time, len(env.Records))
+	for i, rec := range env.Records {
+		buf.WriteString(rec.Line)
+		buf.WriteByte('\n')
+		times[i] = rec.Time
+	}
+
+	entry := batch.Entry{
+		Kind:    env.Kind,
+		LogID:   logID,
+		Times:   times,
+		Dropped: env.Dropped,
+	}
+	entry.SetData(buf.Bytes())
+	if !env.Meta.IsZero() {
+		entry.Meta = &env.Meta
+	}
+
+	if err := s.enqueue(entry); err != nil {
+		return err
+	}
+
+	uploadsTotal.WithLabelValues(env.Kind).Inc()
+	uploadBytesTotal.WithLabelValues(env.Kind).Add(float64(buf.Len()))
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stream labels used to route Loki pushes.
+const (
+	lokiKindLabel  = "alexandria_kind"
+	lokiLogIDLabel = "alexandria_log_id"
+)
+
+const (
+	lokiPushPath = "/loki/api/v1/push"
+	maxLokiSize  = 4 << 20
+
+	// maxLokiDecodedSize bounds how large a snappy-compressed push may claim
+	// to be once decompressed.
+	maxLokiDecodedSize = 4 * maxLokiSize
+)
+
+// lokiStream is one stream of a Loki push request.
+type lokiStream struct {
+	Labels  map[string]string
+	Entries []alexandria.Record
+}
+
+// LokiPush accepts pushes in the format of Loki's /loki/api/v1/push, so that
+// Promtail and Grafana Agent can ship logs here directly. Like Loki, bodies
+// are snappy-compressed protobuf unless the content type is
+// application/json.
+//
+// Each stream is routed by its alexandria_kind and alexandria_log_id labels,
+// falling back to service_name or job for the kind and a logID derived from
+// the host or the stream's labels.
+func (s *Server) LokiPush(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	defer r.Body.Close()
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gr.Close()
+		body = http.MaxBytesReader(w, io.NopCloser(gr), maxLokiSize)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		s.rejectRead(err)
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "can't read request", http.StatusBadRequest)
+		}
+		return
+	}
+
+	var streams []lokiStream
+	if mediaType == alexandria.ContentTypeJSON {
+		streams, err = decodeLokiJSON(data)
+	} else {
+		streams, err = decodeLokiProto(data)
+	}
+	if err != nil {
+		slog.Error("can't decode Loki push", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+		http.Error(w, "can't decode request", http.StatusBadRequest)
+		return
+	}
+
+	ip := r.RemoteAddr
+	if s.limits != nil {
+		ip = s.limits.clientIP(r)
+	}
+
+	envs := make([]*alexandria.Envelope, len(streams))
+	for i, stream := range streams {
+		envs[i] = lokiEnvelope(stream)
+		slog.Info("got request for", "kind", envs[i].Kind, "logID", envs[i].LogID, "records", len(envs[i].Records), "transport", "loki")
+	}
+
+	admitted, refused, limited := s.admitAll(envs, ip)
+	if limited != nil {
+		s.reject(w, limited)
+		return
+	}
+
+	var reasons []string
+	for _, rej := range refused {
+		reasons = append(reasons, rej.Error())
+	}
+
+	// Promtail retries the whole push on 5xx, so once some streams are
+	// stored the rest are refused instead.
+	if n, err := s.ingestAll(admitted); err != nil {
+		if n == 0 {
+			http.Error(w, "can't accept logs right now", http.StatusServiceUnavailable)
+			return
+		}
+		reasons = append(reasons, "can't accept logs right now")
+	}
+
+	// Loki answers 400 when some streams were refused; the rest are kept.
+	if len(reasons) != 0 {
+		http.Error(w, strings.Join(slices.Compact(reasons), "; "), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lokiEnvelope converts a Loki stream into an envelope.
+func lokiEnvelope(stream lokiStream) *alexandria.Envelope {
+	labels := stream.Labels
+
+	result := &alexandria.Envelope{
+		Version: alexandria.ProtocolV2,
+		Kind:    labels[lokiKindLabel],
+		LogID:   labels[lokiLogIDLabel],
+		Meta: alexandria.Metadata{
+			Service: cmp.Or(labels["service_name"], labels["job"]),
+		},
+		Records: stream.Entries,
+	}
+
+	if result.Kind == "" {
+		result.Kind = result.Meta.Service
+	}
+	if result.LogID == "" {
+		result.LogID = lokiLogID(labels)
+	}
+
+	return result
+}
+
+// lokiLogID derives a stable logID for a stream from its host label, or from
+// all of its labels if it has none.
+func lokiLogID(labels map[string]string) string {
+	key := cmp.Or(labels["host"], labels["hostname"], labels["instance"])
+	if key == "" {
+		var sb strings.Builder
+		for _, name := range slices.Sorted(maps.Keys(labels)) {
+			fmt.Fprintf(&sb, "%s=%q,", name, labels[name])
+		}
+		key = sb.String()
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return "loki_" + hex.EncodeToString(sum[:8])
+}
+
+// decodeLokiJSON decodes a JSON push request:
+//
+//	{"streams":[{"stream":{"job":"anubis"},"values":[["<unix nanos>","line"]]}]}
+func decodeLokiJSON(data []byte) ([]lokiStream, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]lokiStream, 0, len(req.Streams))
+	for _, st := range req.Streams {
+		stream := lokiStream{Labels: st.Stream}
+		for _, val := range st.Values {
+			if len(val) < 2 {
+				return nil, fmt.Errorf("entry has %d values, want at least 2", len(val))
+			}
+
+			var ts, line string
+			if err := json.Unmarshal(val[0], &ts); err != nil {
+				return nil, fmt.Errorf("can't decode timestamp: %w", err)
+			}
+			if err := json.Unmarshal(val[1], &line); err != nil {
+				return nil, fmt.Errorf("can't decode line: %w", err)
+			}
+
+			nanos, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse timestamp %q: %w", ts, err)
+			}
+
+			stream.Entries = append(stream.Entries, alexandria.Record{Time: time.Unix(0, nanos).UTC(), Line: line})
+		}
+		result = append(result, stream)
+	}
+
+	return result, nil
+}
+
+// Field numbers from Loki's push.proto.
+const (
+	lokiPushStreams      protowire.Number = 1 // PushRequest.streams
+	lokiStreamLabels     protowire.Number = 1 // StreamAdapter.labels
+	lokiStreamEntries    protowire.Number = 2 // StreamAdapter.entries
+	lokiEntryTimestamp   protowire.Number = 1 // EntryAdapter.timestamp
+	lokiEntryLine        protowire.Number = 2 // EntryAdapter.line
+	lokiTimestampSeconds protowire.Number = 1 // google.protobuf.Timestamp.seconds
+	lokiTimestampNanos   protowire.Number = 2 // google.protobuf.Timestamp.nanos
+)
+
+// decodeLokiProto decodes a snappy-compressed protobuf push request. The
+// schema is small and stable, so it is read with protowire rather than
+// vendoring Loki's generated code.
+func decodeLokiProto(data []byte) ([]lokiStream, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress: %w", err)
+	}
+	if n > maxLokiDecodedSize {
+		return nil, fmt.Errorf("decompressed request is %d bytes, limit is %d", n, maxLokiDecodedSize)
+	}
+
+	data, err = snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress: %w", err)
+	}
+
+	var result []lokiStream
+	err = eachField(data, func(num protowire.Number, b []byte, _ uint64) error {
+		if num != lokiPushStreams {
+			return nil
+		}
+
+		stream, err := decodeLokiStream(b)
+		if err != nil {
+			return err
+		}
+		result = append(result, stream)
+		return nil
+	})
+
+	return result, err
+}
+
+func decodeLokiStream(data []byte) (lokiStream, error) {
+	var result lokiStream
+	err := eachField(data, func(num protowire.Number, b []byte, _ uint64) error {
+		switch num {
+		case lokiStreamLabels:
+			labels, err := parseLokiLabels(string(b))
+			if err != nil {
+				return err
+			}
+			result.Labels = labels
+		case lokiStreamEntries:
+			var rec alexandria.Record
+			err := eachField(b, func(num protowire.Number, b []byte, _ uint64) error {
+				switch num {
+				case lokiEntryTimestamp:
+					var secs, nanos int64
+					err := eachField(b, func(num protowire.Number, _ []byte, v uint64) error {
+						switch num {
+						case lokiTimestampSeconds:
+							secs = int64(v)
+						case lokiTimestampNanos:
+							nanos = int64(int32(v))
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					rec.Time = time.Unix(secs, nanos).UTC()
+				case lokiEntryLine:
+					rec.Line = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result.Entries = append(result.Entries, rec)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// eachField calls fn for every field in the protobuf message data, with the
+// payload of length-delimited fields or the value of varint fields. Fields of
+// other wire types are skipped.
+func eachField(data []byte, fn func(num protowire.Number, b []byte, v uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := fn(num, b, 0); err != nil {
+				return err
+			}
+			data = data[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := fn(num, nil, v); err != nil {
+				return err
+			}
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+
+	return nil
+}
+
+// parseLokiLabels parses a label set in Prometheus syntax, such as
+// {job="anubis", host="edge01"}.
+func parseLokiLabels(s string) (map[string]string, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(s), "{")
+	if !ok {
+		return nil, fmt.Errorf("label set %q doesn't start with {", s)
+	}
+
+	result := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if after, ok := strings.CutPrefix(rest, "}"); ok {
+			if strings.TrimSpace(after) != "" {
+				return nil, fmt.Errorf("trailing data after label set %q", s)
+			}
+			return result, nil
+		}
+
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed label set %q", s)
+		}
+
+		quoted, err := strconv.QuotedPrefix(strings.TrimSpace(after))
+		if err != nil {
+			return nil, fmt.Errorf("malformed value for label %q: %w", name, err)
+		}
+		val, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("malformed value for label %q: %w", name, err)
+		}
+
+		result[strings.TrimSpace(name)] = val
+		rest = strings.TrimSpace(after)[len(quoted):]
+	}
+}
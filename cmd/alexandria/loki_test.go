@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/golang/snappy"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiProtoPush builds a snappy-compressed push request with one entry per
+// stream, as Promtail sends it.
+func lokiProtoPush(t time.Time, line string, labels ...string) []byte {
+	var req []byte
+	for _, ls := range labels {
+		var ts []byte
+		ts = protowire.AppendTag(ts, lokiTimestampSeconds, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+		ts = protowire.AppendTag(ts, lokiTimestampNanos, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(t.Nanosecond()))
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, lokiEntryTimestamp, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, ts)
+		entry = protowire.AppendTag(entry, lokiEntryLine, protowire.BytesType)
+		entry = protowire.AppendString(entry, line)
+
+		var stream []byte
+		stream = protowire.AppendTag(stream, lokiStreamLabels, protowire.BytesType)
+		stream = protowire.AppendString(stream, ls)
+		stream = protowire.AppendTag(stream, lokiStreamEntries, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+		// StreamAdapter.hash, which is ignored
+		stream = protowire.AppendTag(stream, 3, protowire.VarintType)
+		stream = protowire.AppendVarint(stream, 42)
+
+		req = protowire.AppendTag(req, lokiPushStreams, protowire.BytesType)
+		req = protowire.AppendBytes(req, stream)
+	}
+
+	return snappy.Encode(nil, req)
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			val:      "{}",
+			expected: map[string]string{},
+		},
+		{
+			name:     "two labels",
+			val:      `{job="anubis", host="edge01"}`,
+			expected: map[string]string{"job": "anubis", "host": "edge01"},
+		},
+		{
+			name:     "escaped value",
+			val:      `{path="C:\\logs", msg="say \"hi\""}`,
+			expected: map[string]string{"path": `C:\logs`, "msg": `say "hi"`},
+		},
+		{
+			name:    "no braces",
+			val:     `job="anubis"`,
+			wantErr: true,
+		},
+		{
+			name:    "unquoted value",
+			val:     `{job=anubis}`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated",
+			val:     `{job="anubis"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLokiLabels(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for k, v := range tt.expected {
+				if got[k] != v {
+					t.Errorf("%s: expected %q, got %q", k, v, got[k])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeLokiProto(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 123, time.UTC)
+
+	streams, err := decodeLokiProto(lokiProtoPush(ts, "hello", `{job="anubis"}`, `{job="thoth"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(streams))
+	}
+	if got := streams[1].Labels["job"]; got != "thoth" {
+		t.Errorf("expected job thoth, got %q", got)
+	}
+
+	entries := streams[0].Entries
+	if len(entries) != 1 || entries[0].Line != "hello" || !entries[0].Time.Equal(ts) {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	if _, err := decodeLokiProto([]byte("not snappy")); err == nil {
+		t.Error("expected an error for a body that isn't snappy")
+	}
+}
+
+func TestDecodeLokiJSON(t *testing.T) {
+	streams, err := decodeLokiJSON([]byte(`{"streams":[{"stream":{"job":"anubis"},"values":[["1735689600000000123","hello",{"trace_id":"abc"}]]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(streams) != 1 || len(streams[0].Entries) != 1 {
+		t.Fatalf("unexpected streams %+v", streams)
+	}
+
+	entry := streams[0].Entries[0]
+	if want := time.Date(2025, 1, 1, 0, 0, 0, 123, time.UTC); !entry.Time.Equal(want) {
+		t.Errorf("expected time %v, got %v", want, entry.Time)
+	}
+	if entry.Line != "hello" {
+		t.Errorf("expected line hello, got %q", entry.Line)
+	}
+
+	for _, bad := range []string{
+		`{"streams":[{"stream":{},"values":[["1"]]}]}`,
+		`{"streams":[{"stream":{},"values":[["yesterday","hi"]]}]}`,
+	} {
+		if _, err := decodeLokiJSON([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestLokiLogID(t *testing.T) {
+	a := lokiLogID(map[string]string{"job": "anubis", "host": "edge01", "filename": "/var/log/a"})
+	b := lokiLogID(map[string]string{"job": "anubis", "host": "edge01", "filename": "/var/log/b"})
+	if a != b {
+		t.Errorf("streams from one host should share a logID, got %s and %s", a, b)
+	}
+
+	if _, err := alexandria.CanonicalLogID(a); err != nil {
+		t.Errorf("derived logID isn't valid: %v", err)
+	}
+
+	c := lokiLogID(map[string]string{"job": "anubis", "filename": "/var/log/a"})
+	d := lokiLogID(map[string]string{"job": "anubis", "filename": "/var/log/b"})
+	if c == d {
+		t.Error("streams without a host label should get a logID per label set")
+	}
+}
+
+func TestLokiPush(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		status      int
+	}{
+		{
+			name:        "protobuf",
+			body:        lokiProtoPush(ts, "hello", `{service_name="techaro.anubis", host="edge01"}`),
+			contentType: contentTypeProtobuf,
+			status:      http.StatusNoContent,
+		},
+		{
+			name:        "json",
+			body:        []byte(`{"streams":[{"stream":{"alexandria_kind":"techaro.thoth","alexandria_log_id":"thoth_01jz4k5n8v"},"values":[["1735689600000000000","hello"]]}]}`),
+			contentType: "application/json",
+			status:      http.StatusNoContent,
+		},
+		{
+			name:        "some streams refused",
+			body:        lokiProtoPush(ts, "hello", `{job="techaro.anubis"}`, `{job="promtail"}`),
+			contentType: contentTypeProtobuf,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "garbage",
+			body:        []byte("{"),
+			contentType: "application/json",
+			status:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, "bucket")
+
+			r := httptest.NewRequest(http.MethodPost, lokiPushPath, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+
+			s.LokiPush(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			total := int64(0)
+			for _, n := range s.buffered {
+				total += n.Load()
+			}
+			if tt.name != "garbage" && total == 0 {
+				t.Error("expected accepted streams to reach the bundlers")
+			}
+		})
+	}
+}
+
+func postLoki(t *testing.T, s *Server, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, lokiPushPath, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentTypeProtobuf)
+	w := httptest.NewRecorder()
+
+	s.LokiPush(w, r)
+	return w
+}
+
+func TestLokiPush_RateLimitedStoresNothing(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.limits = &uploadLimits{byIP: newKeyedLimiter(rate.Limit(0.001), 1)}
+
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := `{service_name="techaro.anubis", host="edge01"}`
+	second := `{service_name="techaro.anubis", host="edge02"}`
+
+	if w := postLoki(t, s, lokiProtoPush(ts, "hello", first, second)); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body.String())
+	}
+
+	for kind, n := range s.buffered {
+		if got := n.Load(); got != 0 {
+			t.Errorf("%s: expected nothing buffered so a retry can't duplicate entries, got %d bytes", kind, got)
+		}
+	}
+
+	// The token edge01's logID took was put back
+	if w := postLoki(t, s, lokiProtoPush(ts, "hello", first)); w.Code != http.StatusNoContent {
+		t.Errorf("expected the rejected push's tokens to be refunded, got status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLokiPush_ManyStreamsPerHost(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.limits = &uploadLimits{byLogID: newKeyedLimiter(rate.Limit(0.001), 10)}
+
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var streams []string
+	for i := range 11 {
+		streams = append(streams, fmt.Sprintf(`{service_name="techaro.anubis", host="edge01", filename="/var/log/%d"}`, i))
+	}
+
+	if w := postLoki(t, s, lokiProtoPush(ts, "hello", streams...)); w.Code != http.StatusNoContent {
+		t.Fatalf("expected one request token for edge01's logID, got status %d: %s", w.Code, w.Body.String())
+	}
+	if s.buffered["techaro.anubis"].Load() == 0 {
+		t.Error("expected entries to reach the bundler")
+	}
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 
+	"github.com/TecharoHQ/alexandria/alexandria"
 	"github.com/TecharoHQ/alexandria/web"
 	"github.com/TecharoHQ/alexandria/web/xess"
 	"github.com/a-h/templ"
@@ -15,19 +16,47 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/facebookgo/flagenv"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	bind   = flag.String("bind", ":8989", "host:port to bind http to")
-	bucket = flag.String("bucket", "techaro-anubis-logs", "bucket to store logs into")
+	bind        = flag.String("bind", ":8989", "host:port to bind http to")
+	bucket      = flag.String("bucket", "techaro-anubis-logs", "bucket to store logs into")
+	metricsBind = flag.String("metrics-bind", ":9090", "host:port to bind metrics to")
+	grpcBind    = flag.String("grpc-bind", ":8990", "host:port to bind gRPC ingestion to, empty to disable")
 )
 
 const maxLogSize = 2 << 16 // 65536 bytes should be enough for anyone
 
+// subcommands run instead of the ingestion server when named as the first
+// argument.
+var subcommands = map[string]func(args []string) error{
+	"analyze":    runAnalyze,
+	"directives": runDirectives,
+	"export":     runExport,
+	"index":      runIndex,
+	"report":     runReport,
+	"query":      runQuery,
+	"samples":    runSamples,
+	"tail":       runTail,
+}
+
 func main() {
 	flagenv.Parse()
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		cmd, ok := subcommands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("unknown subcommand %q", flag.Arg(0))
+		}
+
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	ctx := context.Background()
 
 	mux := http.NewServeMux()
@@ -42,11 +71,55 @@ func main() {
 
 	s := NewServer(s3Client, *bucket)
 
-	mux.Handle("GET /healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "OK")
-	}))
+	limits, err := newUploadLimitsFromFlags()
+	if err != nil {
+		log.Fatalf("failed to configure upload limits: %v", err)
+	}
+	s.limits = limits
+	go limits.cleanupLoop()
+
+	sinks, err := newFanoutFromFlags()
+	if err != nil {
+		log.Fatalf("failed to configure sinks: %v", err)
+	}
+	s.sinks = sinks
+
+	schemas, err := newSchemaValidatorFromFlags()
+	if err != nil {
+		log.Fatalf("failed to load schemas: %v", err)
+	}
+	s.schemas = schemas
+
+	tails, err := newTailHubFromFlags()
+	if err != nil {
+		log.Fatalf("failed to configure tailing: %v", err)
+	}
+	s.tails = tails
+
+	directives, err := newDirectiveStoreFromFlags(s3Client, *bucket)
+	if err != nil {
+		log.Fatalf("failed to configure directives: %v", err)
+	}
+	s.directives = directives
+	if directives != nil {
+		go directives.refreshLoop()
+	}
+
+	mux.HandleFunc("GET /healthz", s.Livez)
+	mux.HandleFunc("GET /livez", s.Livez)
+	mux.HandleFunc("GET /readyz", s.Readyz)
+
+	mux.HandleFunc("GET "+tailPath, s.Tail)
+
+	mux.HandleFunc("GET "+alexandria.DirectivesPath+"/{kind}/{logID}", s.Directives)
+	mux.HandleFunc("GET "+adminDirectivesPath, s.ListDirectives)
+	mux.HandleFunc("PUT "+adminDirectivePath, s.SetDirectives)
+	mux.HandleFunc("DELETE "+adminDirectivePath, s.ClearDirectives)
 
 	mux.Handle("PUT /upload/{kind}/{logID}", http.MaxBytesHandler(http.HandlerFunc(s.Upload), maxLogSize))
+	mux.Handle("POST "+alexandria.IngestV2Path, http.MaxBytesHandler(http.HandlerFunc(s.IngestV2), maxEnvelopeSize))
+	mux.Handle("POST "+otlpPath, http.MaxBytesHandler(http.HandlerFunc(s.OTLPLogs), maxOTLPSize))
+	mux.Handle("POST "+lokiPushPath, http.MaxBytesHandler(http.HandlerFunc(s.LokiPush), maxLokiSize))
 
 	xess.Mount(mux)
 
@@ -59,6 +132,30 @@ func main() {
 
 	mux.HandleFunc("/", xess.NotFound)
 
+	go func() {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", promhttp.Handler())
+
+		slog.Info("listening for metrics over HTTP", "bind", *metricsBind)
+		log.Fatal(http.ListenAndServe(*metricsBind, metricsMux))
+	}()
+
+	if *grpcBind != "" {
+		go func() {
+			ln, err := net.Listen("tcp", *grpcBind)
+			if err != nil {
+				log.Fatalf("can't listen for gRPC: %v", err)
+			}
+
+			slog.Info("listening over gRPC", "bind", *grpcBind)
+			log.Fatal(NewGRPCServer(s).Serve(ln))
+		}()
+	}
+
+	if err := serveSyslog(s); err != nil {
+		log.Fatalf("can't start syslog listener: %v", err)
+	}
+
 	slog.Info("listening over HTTP", "bind", *bind)
 	log.Fatal(http.ListenAndServe(*bind, mux))
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_uploads_total",
+		Help: "Number of accepted log uploads by kind.",
+	}, []string{"kind"})
+
+	uploadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_upload_bytes_total",
+		Help: "Number of log bytes received by kind.",
+	}, []string{"kind"})
+
+	rejectedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_rejected_requests_total",
+		Help: "Number of rejected upload requests by reason.",
+	}, []string{"reason"})
+
+	bundlerBufferedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "alexandria_bundler_buffered_bytes",
+		Help: "Number of bytes waiting in each kind's bundler.",
+	}, []string{"kind"})
+
+	batchItems = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alexandria_batch_items",
+		Help:    "Number of log entries per uploaded batch.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"kind"})
+
+	batchBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alexandria_batch_bytes",
+		Help:    "Size in bytes of each uploaded batch.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"kind"})
+
+	s3PutDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alexandria_s3_put_duration_seconds",
+		Help:    "Latency of S3 PutObject calls for batches.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	s3PutFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_s3_put_failures_total",
+		Help: "Number of failed S3 PutObject calls for batches.",
+	}, []string{"kind"})
+
+	sinkEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_sink_events_total",
+		Help: "Number of events handed to secondary sinks by sink and result (ok, error, dropped).",
+	}, []string{"sink", "result"})
+
+	analyzedBatchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_analyzed_batches_total",
+		Help: "Number of batches the analyze worker processed by kind and result (ok, error).",
+	}, []string{"kind", "result"})
+
+	findingsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_findings_total",
+		Help: "Number of findings reported by analyzer and severity.",
+	}, []string{"analyzer", "severity"})
+
+	schemaInvalidLinesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_schema_invalid_lines_total",
+		Help: "Number of log lines that didn't match their kind's schema by kind and schema mode (warn, enforce).",
+	}, []string{"kind", "mode"})
+
+	tailSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "alexandria_tail_subscribers",
+		Help: "Number of clients tailing a logID.",
+	})
+
+	tailDroppedEntriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alexandria_tail_dropped_entries_total",
+		Help: "Number of entries not sent to tail clients that fell behind by kind.",
+	}, []string{"kind"})
+)
+
+// Reasons an upload can be rejected, used as the reason label of
+// alexandria_rejected_requests_total.
+const (
+	rejectUnknownKind  = "unknown_kind"
+	rejectInvalidLogID = "invalid_logid"
+	rejectTooLarge     = "too_large"
+	rejectReadError    = "read_error"
+	rejectBundler      = "bundler"
+	rejectRateLimited  = "rate_limited"
+	rejectQuota        = "quota_exceeded"
+	rejectBadEnvelope  = "bad_envelope"
+	rejectBadMessage   = "bad_message"
+)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ingestTestBucket records batches and answers HeadBucket with headErr.
+type ingestTestBucket struct {
+	putRecorder
+	headErr error
+}
+
+func (ib ingestTestBucket) HeadBucket(context.Context, *s3.HeadBucketInput, ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, ib.headErr
+}
+
+// histogramCount returns how many observations h has seen and their sum.
+func histogramCount(t *testing.T, h prometheus.Observer) (uint64, float64) {
+	t.Helper()
+
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestMetrics_Upload(t *testing.T) {
+	const kind = "techaro.thoth"
+	bucket := ingestTestBucket{putRecorder: putRecorder{}}
+	s := NewServer(bucket, "logs")
+
+	upload := func(logID, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/upload/"+kind+"/"+logID, strings.NewReader(body))
+		req.SetPathValue("kind", kind)
+		req.SetPathValue("logID", logID)
+		w := httptest.NewRecorder()
+		s.Upload(w, req)
+		return w.Code
+	}
+
+	uploads := testutil.ToFloat64(uploadsTotal.WithLabelValues(kind))
+	uploadBytes := testutil.ToFloat64(uploadBytesTotal.WithLabelValues(kind))
+	rejected := testutil.ToFloat64(rejectedRequestsTotal.WithLabelValues(rejectInvalidLogID))
+	items, itemsSum := histogramCount(t, batchItems.WithLabelValues(kind))
+	sizes, _ := histogramCount(t, batchBytes.WithLabelValues(kind))
+	puts, _ := histogramCount(t, s3PutDuration.WithLabelValues(kind))
+
+	const body = "first\nsecond\n"
+	if code := upload("thoth_01jz4k5n8v", body); code != http.StatusOK {
+		t.Fatalf("expected upload to succeed, got status %d", code)
+	}
+	if code := upload("thoth_01jz4k5n8w", body); code != http.StatusOK {
+		t.Fatalf("expected upload to succeed, got status %d", code)
+	}
+	if code := upload("nope", body); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid logID to be rejected, got status %d", code)
+	}
+
+	if got := testutil.ToFloat64(uploadsTotal.WithLabelValues(kind)) - uploads; got != 2 {
+		t.Errorf("expected 2 more uploads, got %v", got)
+	}
+	if got := testutil.ToFloat64(uploadBytesTotal.WithLabelValues(kind)) - uploadBytes; got != 2*float64(len(body)) {
+		t.Errorf("expected %d more upload bytes, got %v", 2*len(body), got)
+	}
+	if got := testutil.ToFloat64(rejectedRequestsTotal.WithLabelValues(rejectInvalidLogID)) - rejected; got != 1 {
+		t.Errorf("expected 1 more rejection, got %v", got)
+	}
+	if got := testutil.ToFloat64(bundlerBufferedBytes.WithLabelValues(kind)); got <= 0 {
+		t.Errorf("expected buffered bytes while the bundler holds the entries, got %v", got)
+	}
+
+	s.bundlers[kind].Flush()
+
+	if len(bucket.putRecorder) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(bucket.putRecorder))
+	}
+	if got := testutil.ToFloat64(bundlerBufferedBytes.WithLabelValues(kind)); got != 0 {
+		t.Errorf("expected no buffered bytes after flushing, got %v", got)
+	}
+	if n, sum := histogramCount(t, batchItems.WithLabelValues(kind)); n-items != 1 || sum-itemsSum != 2 {
+		t.Errorf("expected 1 more batch of 2 items, got %d more batches with %v items", n-items, sum-itemsSum)
+	}
+	if n, _ := histogramCount(t, batchBytes.WithLabelValues(kind)); n-sizes != 1 {
+		t.Errorf("expected 1 more batch size, got %d", n-sizes)
+	}
+	if n, _ := histogramCount(t, s3PutDuration.WithLabelValues(kind)); n-puts != 1 {
+		t.Errorf("expected 1 more PutObject timing, got %d", n-puts)
+	}
+
+	// The names dashboards and alerts use must not drift
+	for name, c := range map[string]prometheus.Collector{
+		"alexandria_uploads_total":           uploadsTotal,
+		"alexandria_upload_bytes_total":      uploadBytesTotal,
+		"alexandria_rejected_requests_total": rejectedRequestsTotal,
+		"alexandria_bundler_buffered_bytes":  bundlerBufferedBytes,
+		"alexandria_batch_items":             batchItems,
+		"alexandria_batch_bytes":             batchBytes,
+		"alexandria_s3_put_duration_seconds": s3PutDuration,
+	} {
+		if testutil.CollectAndCount(c, name) == 0 {
+			t.Errorf("expected %s to have series", name)
+		}
+
+		problems, err := testutil.CollectAndLint(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range problems {
+			t.Errorf("%s: %s", p.Metric, p.Text)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink publishes each event as JSON to <prefix>.<type>.<kind>, such as
+// alexandria.batch.techaro.anubis, so consumers can subscribe to one kind
+// or use wildcards.
+type natsSink struct {
+	nc     *nats.Conn
+	prefix string
+}
+
+func newNATSSink(url, prefix string) (*natsSink, error) {
+	nc, err := natsConnect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSink{nc: nc, prefix: prefix}, nil
+}
+
+func natsConnect(url string) (*nats.Conn, error) {
+	nc, err := nats.Connect(url,
+		nats.Name("alexandria"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Error("disconnected from NATS", "err", err)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to NATS: %w", err)
+	}
+
+	return nc, nil
+}
+
+func (ns *natsSink) Name() string { return "nats" }
+
+func (ns *natsSink) Publish(_ context.Context, ev *sinkEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("can't marshal event: %w", err)
+	}
+
+	return ns.nc.Publish(natsSubject(ns.prefix, ev), data)
+}
+
+func natsSubject(prefix string, ev *sinkEvent) string {
+	return prefix + "." + ev.Type + "." + ev.Kind
+}
+
+// natsTailBus shares tailed entries between replicas as JSON on
+// <prefix>.tail.<kind>.<logID>. Replicas only subscribe to the logIDs their
+// clients tail, so NATS drops the entries nobody is tailing instead of
+// sending every entry to every replica.
+type natsTailBus struct {
+	nc     *nats.Conn
+	prefix string
+}
+
+func newNATSTailBus(url, prefix string) (*natsTailBus, error) {
+	nc, err := natsConnect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsTailBus{nc: nc, prefix: prefix}, nil
+}
+
+func (nb *natsTailBus) subject(kind, logID string) string {
+	return nb.prefix + ".tail." + kind + "." + logID
+}
+
+func (nb *natsTailBus) publish(entry batch.Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("can't marshal entry: %w", err)
+	}
+
+	return nb.nc.Publish(nb.subject(entry.Kind, entry.LogID), data)
+}
+
+func (nb *natsTailBus) subscribe(kind, logID string, deliver func(batch.Entry)) (func(), error) {
+	sub, err := nb.nc.Subscribe(nb.subject(kind, logID), func(msg *nats.Msg) {
+		var entry batch.Entry
+		if err := json.Unmarshal(msg.Data, &entry); err != nil {
+			slog.Error("can't decode tailed entry", "subject", msg.Subject, "err", err)
+			return
+		}
+		deliver(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the server to have the subscription, so that entries
+	// published once the client is told the stream is ready reach it.
+	if err := nb.nc.Flush(); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+
+	return func() {
+		if err := sub.Unsubscribe(); err != nil {
+			slog.Error("can't unsubscribe from tailed entries", "subject", sub.Subject, "err", err)
+		}
+	}, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Resource attributes used to route OTLP logs.
+const (
+	otlpKindAttr  = "alexandria.kind"
+	otlpLogIDAttr = "alexandria.log_id"
+)
+
+const (
+	otlpPath            = "/v1/logs"
+	maxOTLPSize         = 4 << 20
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// OTLPLogs accepts OpenTelemetry logs over OTLP/HTTP, as protobuf or JSON.
+//
+// Each resource is routed by its alexandria.kind and alexandria.log_id
+// attributes, falling back to service.name and service.instance.id. Records
+// are rendered as slog-style JSON lines and stored like a protocol v2 upload.
+func (s *Server) OTLPLogs(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != contentTypeProtobuf && mediaType != alexandria.ContentTypeJSON) {
+		rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+		http.Error(w, "content type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	defer r.Body.Close()
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gr.Close()
+		body = http.MaxBytesReader(w, io.NopCloser(gr), maxOTLPSize)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		s.rejectRead(err)
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "can't read request", http.StatusBadRequest)
+		}
+		return
+	}
+
+	var req collogspb.ExportLogsServiceRequest
+	if mediaType == contentTypeProtobuf {
+		err = proto.Unmarshal(data, &req)
+	} else {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, &req)
+	}
+	if err != nil {
+		slog.Error("can't decode OTLP request", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBadEnvelope).Inc()
+		http.Error(w, "can't decode request", http.StatusBadRequest)
+		return
+	}
+
+	ip := r.RemoteAddr
+	if s.limits != nil {
+		ip = s.limits.clientIP(r)
+	}
+
+	var envs []*alexandria.Envelope
+	var total int64
+	for _, rl := range req.GetResourceLogs() {
+		env := otlpEnvelope(rl)
+		slog.Info("got request for", "kind", env.Kind, "logID", env.LogID, "records", len(env.Records), "transport", "otlp")
+		envs = append(envs, env)
+		total += int64(len(env.Records))
+	}
+
+	admitted, refused, limited := s.admitAll(envs, ip)
+	if limited != nil {
+		s.reject(w, limited)
+		return
+	}
+
+	var reasons []string
+	for _, rej := range refused {
+		reasons = append(reasons, rej.Error())
+	}
+
+	// Once some resources are stored, a retry would store them again, so
+	// the ones that fail after that are reported as rejected instead.
+	n, err := s.ingestAll(admitted)
+	if err != nil {
+		if n == 0 {
+			http.Error(w, "can't accept logs right now", http.StatusServiceUnavailable)
+			return
+		}
+		reasons = append(reasons, "can't accept logs right now")
+	}
+
+	rejected := total
+	for _, ae := range admitted[:n] {
+		rejected -= int64(len(ae.env.Records))
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: rejected,
+			ErrorMessage:       strings.Join(slices.Compact(reasons), "; "),
+		}
+	}
+
+	var out []byte
+	if mediaType == contentTypeProtobuf {
+		out, err = proto.Marshal(resp)
+	} else {
+		out, err = protojson.Marshal(resp)
+	}
+	if err != nil {
+		slog.Error("can't encode OTLP response", "err", err)
+		http.Error(w, "can't encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(out)
+}
+
+// otlpEnvelope converts the records of one OTLP resource into an envelope.
+func otlpEnvelope(rl *logspb.ResourceLogs) *alexandria.Envelope {
+	attrs := rl.GetResource().GetAttributes()
+
+	result := &alexandria.Envelope{
+		Version: alexandria.ProtocolV2,
+		Kind:    otlpAttr(attrs, otlpKindAttr),
+		LogID:   otlpAttr(attrs, otlpLogIDAttr),
+		Meta: alexandria.Metadata{
+			Service:        otlpAttr(attrs, "service.name"),
+			ServiceVersion: otlpAttr(attrs, "service.version"),
+			OS:             otlpAttr(attrs, "os.type"),
+			Arch:           otlpAttr(attrs, "host.arch"),
+		},
+	}
+
+	if result.Kind == "" {
+		result.Kind = result.Meta.Service
+	}
+	if result.LogID == "" {
+		result.LogID = otlpAttr(attrs, "service.instance.id")
+	}
+
+	for _, sl := range rl.GetScopeLogs() {
+		for _, lr := range sl.GetLogRecords() {
+			result.Records = append(result.Records, otlpRecord(lr))
+		}
+	}
+
+	return result
+}
+
+// otlpRecord renders an OTLP log record as a slog-style JSON line.
+func otlpRecord(lr *logspb.LogRecord) alexandria.Record {
+	ts := lr.GetTimeUnixNano()
+	if ts == 0 {
+		ts = lr.GetObservedTimeUnixNano()
+	}
+
+	var t time.Time
+	if ts != 0 {
+		t = time.Unix(0, int64(ts)).UTC()
+	}
+
+	line := map[string]any{
+		"level": otlpLevel(lr.GetSeverityNumber()).String(),
+		"msg":   otlpValue(lr.GetBody()),
+	}
+	if !t.IsZero() {
+		line["time"] = t
+	}
+	for _, kv := range lr.GetAttributes() {
+		if _, ok := line[kv.GetKey()]; !ok {
+			line[kv.GetKey()] = otlpValue(kv.GetValue())
+		}
+	}
+	if len(lr.GetTraceId()) != 0 {
+		line["trace_id"] = fmt.Sprintf("%x", lr.GetTraceId())
+	}
+	if len(lr.GetSpanId()) != 0 {
+		line["span_id"] = fmt.Sprintf("%x", lr.GetSpanId())
+	}
+
+	// otlpValue only produces JSON-safe values, so this can't fail
+	data, _ := json.Marshal(line)
+
+	return alexandria.Record{Time: t, Line: string(data)}
+}
+
+// otlpLevel maps an OTLP severity number onto slog levels. OTLP INFO (9),
+// WARN (13) and ERROR (17) line up with slog's INFO (0), WARN (4) and
+// ERROR (8), so the mapping is a fixed offset. Unset severities are INFO.
+func otlpLevel(sev logspb.SeverityNumber) slog.Level {
+	if sev == logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		return slog.LevelInfo
+	}
+	return slog.Level(int(sev) - int(logspb.SeverityNumber_SEVERITY_NUMBER_INFO))
+}
+
+func otlpAttr(attrs []*commonpb.KeyValue, key string) string {
+	for _, kv := range attrs {
+		if kv.GetKey() == key {
+			return kv.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+// otlpValue converts an OTLP AnyValue into a value encoding/json can marshal.
+func otlpValue(v *commonpb.AnyValue) any {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		// JSON has no NaN or infinities
+		if math.IsNaN(v.DoubleValue) || math.IsInf(v.DoubleValue, 0) {
+			return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+		}
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		result := make([]any, len(v.ArrayValue.GetValues()))
+		for i, elem := range v.ArrayValue.GetValues() {
+			result[i] = otlpValue(elem)
+		}
+		return result
+	case *commonpb.AnyValue_KvlistValue:
+		result := make(map[string]any, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			result[kv.GetKey()] = otlpValue(kv.GetValue())
+		}
+		return result
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpString(key, val string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: val}}}
+}
+
+func otlpRequest(resources ...[]*commonpb.KeyValue) *collogspb.ExportLogsServiceRequest {
+	result := &collogspb.ExportLogsServiceRequest{}
+	for _, attrs := range resources {
+		result.ResourceLogs = append(result.ResourceLogs, &logspb.ResourceLogs{
+			Resource: &resourcepb.Resource{Attributes: attrs},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{{
+					TimeUnixNano:   1735689600000000000,
+					SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+					Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "policy reload failed"}},
+					Attributes:     []*commonpb.KeyValue{otlpString("path", "/etc/anubis/policy.yaml")},
+				}},
+			}},
+		})
+	}
+	return result
+}
+
+func TestOTLPLogs(t *testing.T) {
+	good := []*commonpb.KeyValue{
+		otlpString(otlpKindAttr, "techaro.anubis"),
+		otlpString(otlpLogIDAttr, "anubis_01jz4k5n8v"),
+	}
+	fallback := []*commonpb.KeyValue{
+		otlpString("service.name", "techaro.thoth"),
+		otlpString("service.instance.id", "0198d7c4-6f1e-7a3b-9c2d-4e5f60718293"),
+	}
+	bad := []*commonpb.KeyValue{
+		otlpString(otlpKindAttr, "techaro.nope"),
+		otlpString(otlpLogIDAttr, "anubis_01jz4k5n8v"),
+	}
+
+	tests := []struct {
+		name        string
+		req         *collogspb.ExportLogsServiceRequest
+		contentType string
+		gzip        bool
+		status      int
+		rejected    int64
+	}{
+		{
+			name:        "protobuf",
+			req:         otlpRequest(good),
+			contentType: contentTypeProtobuf,
+			status:      http.StatusOK,
+		},
+		{
+			name:        "json",
+			req:         otlpRequest(good, fallback),
+			contentType: "application/json",
+			status:      http.StatusOK,
+		},
+		{
+			name:        "gzip protobuf",
+			req:         otlpRequest(fallback),
+			contentType: contentTypeProtobuf,
+			gzip:        true,
+			status:      http.StatusOK,
+		},
+		{
+			name:        "partial success",
+			req:         otlpRequest(good, bad),
+			contentType: contentTypeProtobuf,
+			status:      http.StatusOK,
+			rejected:    1,
+		},
+		{
+			name:        "unsupported content type",
+			req:         otlpRequest(good),
+			contentType: "text/plain",
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, "bucket")
+
+			var body []byte
+			var err error
+			if tt.contentType == "application/json" {
+				body, err = protojson.Marshal(tt.req)
+			} else {
+				body, err = proto.Marshal(tt.req)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.gzip {
+				var buf bytes.Buffer
+				gw := gzip.NewWriter(&buf)
+				gw.Write(body)
+				gw.Close()
+				body = buf.Bytes()
+			}
+
+			r := httptest.NewRequest(http.MethodPost, otlpPath, bytes.NewReader(body))
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.gzip {
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+
+			s.OTLPLogs(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var resp collogspb.ExportLogsServiceResponse
+			if tt.contentType == "application/json" {
+				err = protojson.Unmarshal(w.Body.Bytes(), &resp)
+			} else {
+				err = proto.Unmarshal(w.Body.Bytes(), &resp)
+			}
+			if err != nil {
+				t.Fatalf("can't decode response: %v", err)
+			}
+
+			if got := resp.GetPartialSuccess().GetRejectedLogRecords(); got != tt.rejected {
+				t.Errorf("expected %d rejected records, got %d", tt.rejected, got)
+			}
+
+			total := int64(0)
+			for _, n := range s.buffered {
+				total += n.Load()
+			}
+			if total == 0 {
+				t.Error("expected records to reach the bundlers")
+			}
+		})
+	}
+}
+
+func postOTLP(t *testing.T, s *Server, resources ...[]*commonpb.KeyValue) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := proto.Marshal(otlpRequest(resources...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, otlpPath, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentTypeProtobuf)
+	w := httptest.NewRecorder()
+
+	s.OTLPLogs(w, r)
+	return w
+}
+
+func TestOTLPLogs_RateLimitedStoresNothing(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.limits = &uploadLimits{byIP: newKeyedLimiter(rate.Limit(0.001), 1)}
+
+	first := []*commonpb.KeyValue{
+		otlpString(otlpKindAttr, "techaro.anubis"),
+		otlpString(otlpLogIDAttr, "anubis_01jz4k5n8v"),
+	}
+	second := []*commonpb.KeyValue{
+		otlpString(otlpKindAttr, "techaro.anubis"),
+		otlpString(otlpLogIDAttr, "anubis_01jz4k5n8w"),
+	}
+
+	if w := postOTLP(t, s, first, second); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body.String())
+	}
+
+	for kind, n := range s.buffered {
+		if got := n.Load(); got != 0 {
+			t.Errorf("%s: expected nothing buffered so a retry can't duplicate records, got %d bytes", kind, got)
+		}
+	}
+
+	// The token the first logID took was put back
+	if w := postOTLP(t, s, first); w.Code != http.StatusOK {
+		t.Errorf("expected the rejected request's tokens to be refunded, got status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOTLPLogs_ManyResourcesPerLogID(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.limits = &uploadLimits{byLogID: newKeyedLimiter(rate.Limit(0.001), 10)}
+
+	resources := make([][]*commonpb.KeyValue, 11)
+	for i := range resources {
+		resources[i] = []*commonpb.KeyValue{
+			otlpString(otlpKindAttr, "techaro.anubis"),
+			otlpString(otlpLogIDAttr, "anubis_01jz4k5n8v"),
+			otlpString("service.instance.id", strconv.Itoa(i)),
+		}
+	}
+
+	if w := postOTLP(t, s, resources...); w.Code != http.StatusOK {
+		t.Fatalf("expected one request token for the logID, got status %d: %s", w.Code, w.Body.String())
+	}
+	if s.buffered["techaro.anubis"].Load() == 0 {
+		t.Error("expected records to reach the bundler")
+	}
+}
+
+func TestOTLPLevel(t *testing.T) {
+	tests := []struct {
+		sev      logspb.SeverityNumber
+		expected slog.Level
+	}{
+		{logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, slog.LevelInfo},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG, slog.LevelDebug},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_INFO, slog.LevelInfo},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_WARN, slog.LevelWarn},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, slog.LevelError},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_FATAL, slog.LevelError + 4},
+	}
+
+	for _, tt := range tests {
+		if got := otlpLevel(tt.sev); got != tt.expected {
+			t.Errorf("otlpLevel(%v) = %v, want %v", tt.sev, got, tt.expected)
+		}
+	}
+}
+
+func TestOTLPRecord(t *testing.T) {
+	rec := otlpRecord(otlpRequest(nil).ResourceLogs[0].ScopeLogs[0].LogRecords[0])
+
+	var line map[string]any
+	if err := json.Unmarshal([]byte(rec.Line), &line); err != nil {
+		t.Fatalf("record line isn't JSON: %v", err)
+	}
+
+	expected := map[string]any{
+		"time":  "2025-01-01T00:00:00Z",
+		"level": "WARN",
+		"msg":   "policy reload failed",
+		"path":  "/etc/anubis/policy.yaml",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, line[k])
+		}
+	}
+
+	if rec.Time.Unix() != 1735689600 {
+		t.Errorf("unexpected record time %v", rec.Time)
+	}
+}
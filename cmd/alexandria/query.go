@@ -0,0 +1,850 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+	"github.com/xwb1989/sqlparser"
+	"modernc.org/sqlite"
+)
+
+// queryTable is the name of the table stored log lines are exposed as.
+const queryTable = "logs"
+
+// queryColumns are the columns of the logs table, in the order SELECT *
+// returns them.
+var queryColumns = []string{"id", "kind", "logID", "date", "timestamp", "level", "msg", "attrs", "batch"}
+
+// queryRow is one log line of the logs table.
+type queryRow struct {
+	exportRow
+
+	// Date is the UTC day the line's batch was stored on, which is what the
+	// bucket can be listed by.
+	Date  string
+	Batch string
+}
+
+// queryTimeFormat is how timestamps are stored in the logs table: UTC
+// RFC 3339 text with a fixed number of digits, so that it sorts and compares
+// as text and SQLite's date and time functions understand it.
+const queryTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// values returns the row's values in the order of queryColumns.
+func (r *queryRow) values() []any {
+	orNull := func(s string) any {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	return []any{
+		r.ID,
+		r.Kind,
+		orNull(r.LogID),
+		r.Date,
+		r.Time.UTC().Format(queryTimeFormat),
+		orNull(r.Level),
+		orNull(r.Msg),
+		orNull(r.Attrs),
+		r.Batch,
+	}
+}
+
+// queryPlan is what a query's WHERE clause says about which batches can
+// hold matching rows. Rows are still filtered by the whole clause; the plan
+// only avoids listing and fetching batches that can't match.
+type queryPlan struct {
+	// kinds are the kinds to list, or nil for every kind.
+	kinds []string
+	// logIDs are the log IDs whose entries to read, or nil for all.
+	logIDs []string
+	// from and to bound the UTC days batches were stored on, inclusive.
+	// They are empty when unbounded.
+	from, to string
+	// terms are the tokens a MATCH on indexed columns requires, or nil if
+	// the search indexes can't be used.
+	terms []string
+}
+
+// planQuery pushes the conditions on kind, logID, date and timestamp that
+// every matching row has to meet down into a plan.
+func planQuery(where *sqlparser.Where) queryPlan {
+	var p queryPlan
+	if where == nil {
+		return p
+	}
+
+	for _, cond := range conjuncts(where.Expr) {
+		switch cond := cond.(type) {
+		case *sqlparser.ComparisonExpr:
+			p.pushComparison(cond)
+		case *sqlparser.MatchExpr:
+			p.pushMatch(cond)
+		case *sqlparser.RangeCond:
+			col, ok := cond.Left.(*sqlparser.ColName)
+			if !ok || cond.Operator != sqlparser.BetweenStr {
+				continue
+			}
+			from, ok1 := queryLiteral(cond.From)
+			to, ok2 := queryLiteral(cond.To)
+			if ok1 && ok2 {
+				p.pushBound(col.Name.Lowered(), sqlparser.GreaterEqualStr, from)
+				p.pushBound(col.Name.Lowered(), sqlparser.LessEqualStr, to)
+			}
+		}
+	}
+
+	return p
+}
+
+// conjuncts splits expr into the conditions ANDed together in it.
+func conjuncts(expr sqlparser.Expr) []sqlparser.Expr {
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr:
+		return append(conjuncts(expr.Left), conjuncts(expr.Right)...)
+	case *sqlparser.ParenExpr:
+		return conjuncts(expr.Expr)
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// flippedOperators are the operators that mean the same with their operands
+// swapped.
+var flippedOperators = map[string]string{
+	sqlparser.EqualStr:        sqlparser.EqualStr,
+	sqlparser.LessThanStr:     sqlparser.GreaterThanStr,
+	sqlparser.LessEqualStr:    sqlparser.GreaterEqualStr,
+	sqlparser.GreaterThanStr:  sqlparser.LessThanStr,
+	sqlparser.GreaterEqualStr: sqlparser.LessEqualStr,
+}
+
+func (p *queryPlan) pushComparison(cond *sqlparser.ComparisonExpr) {
+	left, right, op := cond.Left, cond.Right, cond.Operator
+	if _, ok := left.(*sqlparser.ColName); !ok {
+		flipped, ok := flippedOperators[op]
+		if !ok {
+			return
+		}
+		left, right, op = right, left, flipped
+	}
+
+	col, ok := left.(*sqlparser.ColName)
+	if !ok {
+		return
+	}
+	name := col.Name.Lowered()
+
+	var values []string
+	switch op {
+	case sqlparser.EqualStr:
+		v, ok := queryLiteral(right)
+		if !ok {
+			return
+		}
+		values = []string{v}
+	case sqlparser.InStr:
+		tuple, ok := right.(sqlparser.ValTuple)
+		if !ok {
+			return
+		}
+		for _, e := range tuple {
+			v, ok := queryLiteral(e)
+			if !ok {
+				return
+			}
+			values = append(values, v)
+		}
+	default:
+		if v, ok := queryLiteral(right); ok {
+			p.pushBound(name, op, v)
+		}
+		return
+	}
+
+	switch name {
+	case "kind":
+		p.kinds = intersect(p.kinds, values)
+	case "logid":
+		p.logIDs = intersect(p.logIDs, values)
+	case "date", "timestamp":
+		if len(values) == 1 {
+			p.pushBound(name, sqlparser.GreaterEqualStr, values[0])
+			p.pushBound(name, sqlparser.LessEqualStr, values[0])
+		}
+	}
+}
+
+// pushMatch uses the search indexes for a MATCH on indexed columns only.
+func (p *queryPlan) pushMatch(cond *sqlparser.MatchExpr) {
+	for _, se := range cond.Columns {
+		ae, ok := se.(*sqlparser.AliasedExpr)
+		if !ok {
+			return
+		}
+		col, ok := ae.Expr.(*sqlparser.ColName)
+		if !ok || !slices.Contains(indexedColumns, col.Name.Lowered()) {
+			return
+		}
+	}
+
+	text, ok := queryLiteral(cond.Expr)
+	if !ok {
+		return
+	}
+
+	if p.terms == nil {
+		p.terms = []string{}
+	}
+	p.terms = append(p.terms, searchTokens(text)...)
+}
+
+// pushBound narrows the days batches are listed for by a comparison of
+// column with v.
+//
+// A line is never stored before it happened, so a lower bound on timestamp
+// is also one on date. Upper bounds on timestamp say nothing about when a
+// line was stored, and strict bounds are widened to inclusive ones.
+func (p *queryPlan) pushBound(column, op, v string) {
+	var day string
+	switch column {
+	case "date":
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return
+		}
+		day = t.Format(time.DateOnly)
+	case "timestamp":
+		t, ok := queryTime(v)
+		if !ok || op == sqlparser.LessThanStr || op == sqlparser.LessEqualStr {
+			return
+		}
+		day = t.UTC().Format(time.DateOnly)
+	default:
+		return
+	}
+
+	switch op {
+	case sqlparser.GreaterThanStr, sqlparser.GreaterEqualStr:
+		p.from = max(p.from, day)
+	case sqlparser.LessThanStr, sqlparser.LessEqualStr:
+		if p.to == "" || day < p.to {
+			p.to = day
+		}
+	}
+}
+
+// intersect returns the values in both a and b, treating nil as every value.
+func intersect(a, b []string) []string {
+	if a == nil {
+		return slices.Clip(b)
+	}
+
+	result := []string{}
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// queryLiteral returns the value of a string or number literal.
+func queryLiteral(expr sqlparser.Expr) (string, bool) {
+	v, ok := expr.(*sqlparser.SQLVal)
+	if !ok || v.Type != sqlparser.StrVal && v.Type != sqlparser.IntVal {
+		return "", false
+	}
+	return string(v.Val), true
+}
+
+// prefixes returns the key prefixes to list batches under.
+func (p queryPlan) prefixes() []string {
+	if p.kinds == nil {
+		return []string{batch.KeyPrefix}
+	}
+
+	result := make([]string, len(p.kinds))
+	for i, kind := range p.kinds {
+		result[i] = batch.KeyPrefix + kind + "/"
+	}
+	return result
+}
+
+// storedOn reports whether batches stored on day can hold matching rows.
+func (p queryPlan) storedOn(day string) bool {
+	return (p.from == "" || day >= p.from) && (p.to == "" || day <= p.to)
+}
+
+// queryResult is the output of a query.
+type queryResult struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// queryEngine runs SELECT statements over the batches in a bucket. The rows
+// of the batches the query's plan allows are loaded into an in-memory SQLite
+// database, which runs the query itself.
+type queryEngine struct {
+	s3c    bucketReader
+	bucket string
+
+	// fetched counts the batches read whole so far, and ranges the ranged
+	// requests for entries found in search indexes.
+	fetched int
+	ranges  int
+}
+
+// parseQuery parses sql, which has to be a single SELECT from the logs
+// table.
+func parseQuery(sql string) (*sqlparser.Select, error) {
+	if err := checkQueryOperators(sql); err != nil {
+		return nil, err
+	}
+
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse query: %w", err)
+	}
+
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return nil, errors.New("only SELECT statements are supported")
+	}
+
+	if len(sel.From) != 1 {
+		return nil, fmt.Errorf("queries must select from the %s table only", queryTable)
+	}
+	ate, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return nil, fmt.Errorf("queries must select from the %s table only", queryTable)
+	}
+	table, ok := ate.Expr.(sqlparser.TableName)
+	if !ok || !strings.EqualFold(table.Name.String(), queryTable) || !table.Qualifier.IsEmpty() {
+		return nil, fmt.Errorf("unknown table %s, only %s is supported", sqlparser.String(ate.Expr), queryTable)
+	}
+
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch node := node.(type) {
+		case *sqlparser.Subquery:
+			return false, errors.New("subqueries are not supported")
+		case *sqlparser.MatchExpr:
+			if node.Option != "" {
+				return false, fmt.Errorf("MATCH doesn't support%s", node.Option)
+			}
+			for _, se := range node.Columns {
+				if _, ok := se.(*sqlparser.AliasedExpr); !ok {
+					return false, fmt.Errorf("unsupported MATCH column %s", sqlparser.String(se))
+				}
+			}
+		}
+		return true, nil
+	}, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	return sel, nil
+}
+
+// checkQueryOperators refuses the operators of sql that MySQL, whose parser
+// queries are read with, gives another meaning than SQLite, which runs them.
+// MySQL reads || as OR where SQLite concatenates, and && as AND, XOR and DIV
+// don't exist in SQLite.
+func checkQueryOperators(sql string) error {
+	tkn := sqlparser.NewStringTokenizer(sql)
+	for {
+		typ, val := tkn.Scan()
+
+		var op string
+		switch {
+		case typ == 0, typ == sqlparser.LEX_ERROR:
+			return nil
+		case typ == sqlparser.OR && val == nil:
+			op = "||"
+		case typ == sqlparser.AND && val == nil:
+			op = "&&"
+		case typ == sqlparser.UNUSED && string(val) == "xor":
+			op = "XOR"
+		case typ == sqlparser.DIV:
+			op = "DIV"
+		default:
+			continue
+		}
+		return fmt.Errorf("the %s operator is not supported, as MySQL and SQLite disagree on it", op)
+	}
+}
+
+// querySearchFunc is the SQLite function MATCH (columns) AGAINST (text) is
+// rewritten to.
+const querySearchFunc = "alexandria_match"
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction(querySearchFunc, -1, querySearch)
+}
+
+// querySearch reports whether its arguments but the last hold every word of
+// the last, tokenized as the search indexes are.
+func querySearch(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%s needs columns and a search text", querySearchFunc)
+	}
+
+	search := args[len(args)-1]
+	if search == nil {
+		return nil, nil
+	}
+
+	var text strings.Builder
+	for _, v := range args[:len(args)-1] {
+		text.WriteString(formatQueryValue(v))
+		text.WriteByte(' ')
+	}
+
+	words := searchTokens(text.String())
+	for _, token := range searchTokens(formatQueryValue(search)) {
+		if !slices.Contains(words, token) {
+			return int64(0), nil
+		}
+	}
+	return int64(1), nil
+}
+
+// sqliteFormatter formats parsed queries as SQLite understands them. Strings
+// are quoted without MySQL's backslash escapes, and MATCH is rewritten to
+// querySearchFunc.
+func sqliteFormatter(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+	switch node := node.(type) {
+	case *sqlparser.SQLVal:
+		if node.Type == sqlparser.StrVal {
+			buf.WriteString("'" + strings.ReplaceAll(string(node.Val), "'", "''") + "'")
+			return
+		}
+	case *sqlparser.MatchExpr:
+		buf.WriteString(querySearchFunc + "(")
+		for _, se := range node.Columns {
+			buf.Myprintf("%v, ", se.(*sqlparser.AliasedExpr).Expr)
+		}
+		buf.Myprintf("%v)", node.Expr)
+		return
+	}
+	node.Format(buf)
+}
+
+// sqliteQuery returns sel as SQLite SQL. Every unaliased expression is named
+// after how it was written, so that results don't depend on how SQLite names
+// columns.
+func sqliteQuery(sel *sqlparser.Select) string {
+	for _, se := range sel.SelectExprs {
+		ae, ok := se.(*sqlparser.AliasedExpr)
+		if !ok || !ae.As.IsEmpty() {
+			continue
+		}
+
+		name := strings.ReplaceAll(sqlparser.String(ae.Expr), "`", "")
+		if col, ok := ae.Expr.(*sqlparser.ColName); ok {
+			name = col.Name.String()
+		}
+		ae.As = sqlparser.NewColIdent(name)
+	}
+
+	buf := sqlparser.NewTrackedBuffer(sqliteFormatter)
+	buf.Myprintf("%v", sel)
+	return buf.String()
+}
+
+// hasAggregate reports whether exprs call an aggregate function.
+func hasAggregate(exprs sqlparser.SelectExprs) bool {
+	found := false
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if fe, ok := node.(*sqlparser.FuncExpr); ok && fe.IsAggregate() {
+			found = true
+		}
+		return !found, nil
+	}, exprs)
+	return found
+}
+
+// openQueryDB opens an empty in-memory database with the logs table.
+func openQueryDB(ctx context.Context) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", queryTable, strings.Join(queryColumns, ", "))); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create %s table: %w", queryTable, err)
+	}
+
+	return db, nil
+}
+
+// run runs query and returns its result.
+func (qe *queryEngine) run(ctx context.Context, query string) (*queryResult, error) {
+	sel, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := planQuery(sel.Where)
+
+	offset, limit, err := queryLimit(sel.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openQueryDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	insert, err := db.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (?%s)", queryTable, strings.Repeat(", ?", len(queryColumns)-1)))
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	// Without sorting or grouping, scanning can stop as soon as enough rows
+	// match, which is checked for each row as it is loaded.
+	enough := -1
+	var matches *sql.Stmt
+	if len(sel.GroupBy) == 0 && sel.Having == nil && len(sel.OrderBy) == 0 && sel.Distinct == "" && limit >= 0 && !hasAggregate(sel.SelectExprs) {
+		enough = offset + limit
+		if sel.Where != nil {
+			buf := sqlparser.NewTrackedBuffer(sqliteFormatter)
+			buf.Myprintf("SELECT count(*) FROM %s WHERE rowid = ? AND (%v)", queryTable, sel.Where.Expr)
+			if matches, err = db.PrepareContext(ctx, buf.String()); err != nil {
+				return nil, fmt.Errorf("can't run query: %w", err)
+			}
+			defer matches.Close()
+		}
+	}
+
+	found := 0
+	err = qe.scan(ctx, plan, func(row *queryRow) (bool, error) {
+		res, err := insert.ExecContext(ctx, row.values()...)
+		if err != nil {
+			return false, err
+		}
+		if enough < 0 {
+			return true, nil
+		}
+
+		n := 1
+		if matches != nil {
+			id, err := res.LastInsertId()
+			if err != nil {
+				return false, err
+			}
+			if err := matches.QueryRowContext(ctx, id).Scan(&n); err != nil {
+				return false, fmt.Errorf("can't run query: %w", err)
+			}
+		}
+		found += n
+		return found < enough, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, sqliteQuery(sel))
+	if err != nil {
+		return nil, fmt.Errorf("can't run query: %w", err)
+	}
+	defer rows.Close()
+
+	result := &queryResult{}
+	if result.Columns, err = rows.Columns(); err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		values := make([]any, len(result.Columns))
+		ptrs := make([]any, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("can't run query: %w", err)
+	}
+
+	return result, nil
+}
+
+// scan calls fn with every row of the batches plan allows until fn returns
+// false. When the plan has search terms, batches covered by a search index
+// are only read where the index points.
+func (qe *queryEngine) scan(ctx context.Context, plan queryPlan, fn func(*queryRow) (bool, error)) error {
+	var covered map[string]bool
+	if plan.terms != nil {
+		var more bool
+		var err error
+		covered, more, err = qe.scanIndexes(ctx, plan, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	for _, prefix := range plan.prefixes() {
+		pages := s3.NewListObjectsV2Paginator(qe.s3c, &s3.ListObjectsV2Input{
+			Bucket: aws.String(qe.bucket),
+			Prefix: aws.String(prefix),
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("can't list %s: %w", prefix, err)
+			}
+
+			for _, obj := range page.Contents {
+				key := aws.ToString(obj.Key)
+				stored := aws.ToTime(obj.LastModified).UTC()
+
+				kind, ok := batch.ParseKey(key)
+				if !ok || covered[key] || !plan.storedOn(stored.Format(time.DateOnly)) {
+					continue
+				}
+
+				more, err := qe.scanBatch(ctx, plan, key, kind, stored, fn)
+				if err != nil || !more {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (qe *queryEngine) scanBatch(ctx context.Context, plan queryPlan, key, kind string, stored time.Time, fn func(*queryRow) (bool, error)) (bool, error) {
+	b, err := fetchBatch(ctx, qe.s3c, qe.bucket, key, kind)
+	if err != nil {
+		return false, err
+	}
+	qe.fetched++
+
+	if plan.logIDs != nil {
+		b.Entries = slices.DeleteFunc(b.Entries, func(e batch.Entry) bool {
+			return !slices.Contains(plan.logIDs, e.LogID)
+		})
+	}
+
+	rows, err := exportRows(b, stored)
+	if err != nil {
+		return false, fmt.Errorf("can't read %s: %w", key, err)
+	}
+
+	for _, row := range rows {
+		more, err := fn(&queryRow{exportRow: row, Date: stored.Format(time.DateOnly), Batch: key})
+		if err != nil || !more {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// queryLimit returns the offset and row count of a LIMIT clause, with a
+// count of -1 if there is none.
+func queryLimit(l *sqlparser.Limit) (offset, count int, err error) {
+	if l == nil {
+		return 0, -1, nil
+	}
+
+	parse := func(expr sqlparser.Expr) (int, error) {
+		v, ok := expr.(*sqlparser.SQLVal)
+		if !ok || v.Type != sqlparser.IntVal {
+			return 0, fmt.Errorf("LIMIT takes integers, got %s", sqlparser.String(expr))
+		}
+		return strconv.Atoi(string(v.Val))
+	}
+
+	if l.Offset != nil {
+		if offset, err = parse(l.Offset); err != nil {
+			return 0, 0, err
+		}
+	}
+	if count, err = parse(l.Rowcount); err != nil {
+		return 0, 0, err
+	}
+	return offset, count, nil
+}
+
+// Output formats of query results.
+const (
+	queryFormatTable = "table"
+	queryFormatJSON  = "json"
+	queryFormatCSV   = "csv"
+)
+
+// writeQueryResult writes res to w in format.
+func writeQueryResult(w io.Writer, res *queryResult, format string) error {
+	switch format {
+	case queryFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(res.Columns, "\t"))
+		for _, row := range res.Rows {
+			cells := make([]string, len(row))
+			for i, v := range row {
+				cells[i] = formatQueryValue(v)
+				if v == nil {
+					cells[i] = "NULL"
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+		return tw.Flush()
+
+	case queryFormatJSON:
+		objects := make([]queryObject, len(res.Rows))
+		for i, row := range res.Rows {
+			objects[i] = queryObject{columns: res.Columns, values: row}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(objects)
+
+	case queryFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(res.Columns)
+		for _, row := range res.Rows {
+			cells := make([]string, len(row))
+			for i, v := range row {
+				cells[i] = formatQueryValue(v)
+			}
+			cw.Write(cells)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// queryTime parses v as a time the way comparisons with timestamp in a
+// WHERE clause are commonly written.
+func queryTime(v string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// formatQueryValue formats v for output.
+func formatQueryValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// queryObject is a result row as a JSON object with its keys in column
+// order.
+type queryObject struct {
+	columns []string
+	values  []any
+}
+
+func (qo queryObject) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, col := range qo.columns {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+
+		k, err := json.Marshal(col)
+		if err != nil {
+			return nil, err
+		}
+
+		v := qo.values[i]
+		if t, ok := v.(time.Time); ok {
+			v = formatQueryValue(t)
+		}
+		val, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, k...)
+		buf = append(buf, ':')
+		buf = append(buf, val...)
+	}
+	return append(buf, '}'), nil
+}
+
+// runQuery is the query subcommand: it runs a SQL query over the log lines
+// of stored batches, exposed as the logs table.
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	bucketName := fs.String("bucket", *bucket, "bucket to read batches from")
+	format := fs.String("format", queryFormatTable, "output format: table, json or csv")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: alexandria query [flags] 'SELECT ... FROM %s ...'\n\ncolumns: %s\n\n", queryTable, strings.Join(queryColumns, ", "))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no query given")
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	qe := &queryEngine{s3c: s3.NewFromConfig(cfg), bucket: *bucketName}
+	res, err := qe.run(ctx, strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	return writeQueryResult(os.Stdout, res, *format)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+func TestPlanQuery(t *testing.T) {
+	tests := []struct {
+		where    string
+		expected queryPlan
+	}{
+		{where: "", expected: queryPlan{}},
+		{where: "kind = 'techaro.anubis'", expected: queryPlan{kinds: []string{"techaro.anubis"}}},
+		{
+			where:    "kind IN ('techaro.anubis', 'techaro.thoth') AND kind = 'techaro.thoth'",
+			expected: queryPlan{kinds: []string{"techaro.thoth"}},
+		},
+		{where: "kind = 'a' AND kind = 'b'", expected: queryPlan{kinds: []string{}}},
+		{where: "kind = 'a' OR kind = 'b'", expected: queryPlan{}},
+		{where: "'a' = kind", expected: queryPlan{kinds: []string{"a"}}},
+		{where: "logID IN ('x', 'y')", expected: queryPlan{logIDs: []string{"x", "y"}}},
+		{where: "date >= '2025-01-07'", expected: queryPlan{from: "2025-01-07"}},
+		{where: "'2025-01-07' < date", expected: queryPlan{from: "2025-01-07"}},
+		{where: "date = '2025-01-07'", expected: queryPlan{from: "2025-01-07", to: "2025-01-07"}},
+		{
+			where:    "date BETWEEN '2025-01-01' AND '2025-01-31' AND date < '2025-01-10'",
+			expected: queryPlan{from: "2025-01-01", to: "2025-01-10"},
+		},
+		{where: "timestamp > '2025-01-07T10:00:00+02:00'", expected: queryPlan{from: "2025-01-07"}},
+		{where: "timestamp < '2025-01-07'", expected: queryPlan{}},
+		{where: "date >= 'tuesday'", expected: queryPlan{}},
+		{where: "NOT kind = 'a'", expected: queryPlan{}},
+		{where: "MATCH (msg, attrs) AGAINST ('Broken pipe')", expected: queryPlan{terms: []string{"broken", "pipe"}}},
+		{where: "MATCH (msg) AGAINST ('a')", expected: queryPlan{terms: []string{}}},
+		{where: "MATCH (msg, logID) AGAINST ('broken')", expected: queryPlan{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			sql := "SELECT * FROM logs"
+			if tt.where != "" {
+				sql += " WHERE " + tt.where
+			}
+
+			sel, err := parseQuery(sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := planQuery(sel.Where)
+			if !slices.Equal(got.kinds, tt.expected.kinds) || (got.kinds == nil) != (tt.expected.kinds == nil) ||
+				!slices.Equal(got.logIDs, tt.expected.logIDs) || (got.logIDs == nil) != (tt.expected.logIDs == nil) ||
+				!slices.Equal(got.terms, tt.expected.terms) || (got.terms == nil) != (tt.expected.terms == nil) ||
+				got.from != tt.expected.from || got.to != tt.expected.to {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseQuery_Errors(t *testing.T) {
+	for _, sql := range []string{
+		"SELEKT",
+		"DELETE FROM logs",
+		"SELECT * FROM batches",
+		"SELECT * FROM logs, logs",
+		"SELECT * FROM logs JOIN logs",
+	} {
+		if _, err := parseQuery(sql); err == nil {
+			t.Errorf("%s: expected an error", sql)
+		}
+	}
+}
+
+func TestParseQuery_Operators(t *testing.T) {
+	for _, tt := range []struct {
+		sql string
+		op  string
+	}{
+		{sql: "SELECT msg || attrs FROM logs", op: "||"},
+		{sql: "SELECT * FROM logs WHERE level = 'ERROR' || level = 'WARN'", op: "||"},
+		{sql: "SELECT * FROM logs WHERE level = 'ERROR' && kind = 'techaro.anubis'", op: "&&"},
+		{sql: "SELECT * FROM logs WHERE level = 'ERROR' XOR kind = 'techaro.anubis'", op: "XOR"},
+		{sql: "SELECT * FROM logs WHERE level = 'ERROR' xor kind = 'techaro.anubis'", op: "XOR"},
+		{sql: "SELECT length(msg) DIV 2 FROM logs", op: "DIV"},
+		{sql: "SELECT * FROM logs WHERE msg = 'a || b && c xor d div e'"},
+		{sql: "SELECT * FROM logs WHERE level = 'ERROR' OR kind = 'techaro.anubis' AND NOT msg = ''"},
+		{sql: "SELECT length(msg) / 2, `div` FROM logs"},
+	} {
+		_, err := parseQuery(tt.sql)
+		switch {
+		case tt.op == "" && err != nil:
+			t.Errorf("%s: %v", tt.sql, err)
+		case tt.op != "" && (err == nil || !strings.Contains(err.Error(), " "+tt.op+" ")):
+			t.Errorf("%s: expected %s to be refused, got %v", tt.sql, tt.op, err)
+		}
+	}
+}
+
+// queryTestBucket stores anubis batches on Jan 6 and Jan 8 2025 and a thoth
+// batch on Jan 8.
+func queryTestBucket(t *testing.T) listBucket {
+	t.Helper()
+
+	entry := func(id, logID, data string) batch.Entry {
+		e := batch.Entry{ID: id, LogID: logID}
+		e.SetData([]byte(data))
+		return e
+	}
+
+	return listBucket{
+		memBucket: memBucket{
+			"logs/inp/techaro.anubis/batch-1.jsonl": encodeBatch(t,
+				entry("a", "anubis_1", `{"time":"2025-01-06T10:00:00Z","level":"ERROR","msg":"can't load policy","err":"bad regex"}`+"\n"),
+				entry("b", "anubis_2", `{"time":"2025-01-06T11:00:00Z","level":"INFO","msg":"listening"}`+"\n"),
+			),
+			"logs/inp/techaro.anubis/batch-2.jsonl": encodeBatch(t,
+				entry("c", "anubis_1", `{"time":"2025-01-08T09:00:00Z","level":"INFO","msg":"listening"}
+{"time":"2025-01-08T09:30:00Z","level":"ERROR","msg":"can't load policy","err":"missing file"}
+`),
+				entry("d", "anubis_3", `{"time":"2025-01-08T10:00:00Z","level":"ERROR","msg":"policy error","source":{"line":7}}`+"\n"),
+			),
+			"logs/inp/techaro.thoth/batch-3.jsonl": encodeBatch(t,
+				entry("e", "thoth_1", `{"time":"2025-01-08T12:00:00Z","level":"ERROR","msg":"policy sync failed"}`+"\n"),
+			),
+		},
+		modified: map[string]time.Time{
+			"logs/inp/techaro.anubis/batch-1.jsonl": time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC),
+			"logs/inp/techaro.anubis/batch-2.jsonl": time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC),
+			"logs/inp/techaro.thoth/batch-3.jsonl":  time.Date(2025, 1, 8, 13, 0, 0, 0, time.UTC),
+		},
+	}
+}
+
+func TestQueryEngine_Run(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		columns  []string
+		rows     string
+		fetched  int
+		checkErr bool
+	}{
+		{
+			name:    "policy errors since Tuesday",
+			sql:     "SELECT DISTINCT logID FROM logs WHERE kind = 'techaro.anubis' AND date >= '2025-01-07' AND level = 'ERROR' AND msg LIKE '%POLICY%' ORDER BY logID",
+			columns: []string{"logID"},
+			rows:    "[[anubis_1] [anubis_3]]",
+			fetched: 1,
+		},
+		{
+			name:    "by logID",
+			sql:     "SELECT id, msg FROM logs WHERE logID = 'anubis_1' ORDER BY timestamp DESC",
+			columns: []string{"id", "msg"},
+			rows:    "[[c-1 can't load policy] [c-0 listening] [a-0 can't load policy]]",
+			fetched: 3,
+		},
+		{
+			name:    "group by",
+			sql:     "SELECT kind, count(*) AS n, count(DISTINCT logID), max(timestamp) FROM logs WHERE level = 'ERROR' GROUP BY kind HAVING n > 0 ORDER BY n DESC",
+			columns: []string{"kind", "n", "count(distinct logID)", "max(timestamp)"},
+			rows:    "[[techaro.anubis 3 2 2025-01-08T10:00:00.000Z] [techaro.thoth 1 1 2025-01-08T12:00:00.000Z]]",
+			fetched: 3,
+		},
+		{
+			name:    "aggregate of nothing",
+			sql:     "SELECT count(*), min(msg) FROM logs WHERE kind = 'techaro.unknown'",
+			columns: []string{"count(*)", "min(msg)"},
+			rows:    "[[0 <nil>]]",
+			fetched: 0,
+		},
+		{
+			name:    "attrs",
+			sql:     "SELECT json_extract(attrs, '$.err') AS err, attrs->>'$.source.line' FROM logs WHERE attrs IS NOT NULL AND date = '2025-01-08' ORDER BY 1",
+			columns: []string{"err", "attrs ->> '$.source.line'"},
+			rows:    "[[<nil> 7] [missing file <nil>]]",
+			fetched: 2,
+		},
+		{
+			name:    "timestamp range",
+			sql:     "SELECT id FROM logs WHERE timestamp BETWEEN '2025-01-08T09:15:00Z' AND '2025-01-08T11:00:00Z' ORDER BY id",
+			columns: []string{"id"},
+			rows:    "[[c-1] [d-0]]",
+			fetched: 2,
+		},
+		{
+			name:    "limit stops scanning",
+			sql:     "SELECT upper(level) FROM logs LIMIT 1, 1",
+			columns: []string{"upper(level)"},
+			rows:    "[[INFO]]",
+			fetched: 1,
+		},
+		{
+			name:     "unknown column",
+			sql:      "SELECT nope FROM logs",
+			checkErr: true,
+		},
+		{
+			name:    "quoted string",
+			sql:     `SELECT count(*) FROM logs WHERE msg = 'can\'t load policy' OR msg = "can't load policy" OR msg = 'can''t load policy'`,
+			columns: []string{"count(*)"},
+			rows:    "[[2]]",
+			fetched: 3,
+		},
+		{
+			name:    "limit with where stops scanning",
+			sql:     "SELECT id FROM logs WHERE level = 'ERROR' AND date(timestamp) = '2025-01-08' LIMIT 1",
+			columns: []string{"id"},
+			rows:    "[[c-1]]",
+			fetched: 2,
+		},
+		{
+			name:     "subquery",
+			sql:      "SELECT id FROM logs WHERE logID IN (SELECT logID FROM logs)",
+			checkErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qe := &queryEngine{s3c: queryTestBucket(t), bucket: "logs"}
+			res, err := qe.run(context.Background(), tt.sql)
+			if tt.checkErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(res.Columns, tt.columns) {
+				t.Errorf("expected columns %q, got %q", tt.columns, res.Columns)
+			}
+			if got := fmt.Sprint(res.Rows); got != tt.rows {
+				t.Errorf("expected rows %s, got %s", tt.rows, got)
+			}
+			if qe.fetched != tt.fetched {
+				t.Errorf("expected %d batches fetched, got %d", tt.fetched, qe.fetched)
+			}
+		})
+	}
+}
+
+func TestWriteQueryResult(t *testing.T) {
+	res := &queryResult{
+		Columns: []string{"logID", "n", "at"},
+		Rows: [][]any{
+			{"anubis_1", int64(2), time.Date(2025, 1, 8, 9, 0, 0, 0, time.UTC)},
+			{nil, 1.5, nil},
+		},
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: queryFormatTable,
+			expected: `logID     n    at
+anubis_1  2    2025-01-08T09:00:00Z
+NULL      1.5  NULL
+`,
+		},
+		{
+			format: queryFormatJSON,
+			expected: `[
+  {
+    "logID": "anubis_1",
+    "n": 2,
+    "at": "2025-01-08T09:00:00Z"
+  },
+  {
+    "logID": null,
+    "n": 1.5,
+    "at": null
+  }
+]
+`,
+		},
+		{
+			format: queryFormatCSV,
+			expected: `logID,n,at
+anubis_1,2,2025-01-08T09:00:00Z
+,1.5,
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeQueryResult(&buf, res, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expected, buf.String())
+			}
+		})
+	}
+
+	if err := writeQueryResult(&bytes.Buffer{}, res, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ipRequestsPerSecond    = flag.Float64("ip-requests-per-second", 0, "sustained upload requests per second allowed from one client IP, 0 to disable; behind a reverse proxy, set -trusted-proxies too or every client shares the proxy's limit")
+	ipRequestBurst         = flag.Int("ip-request-burst", 50, "burst of upload requests allowed from one client IP")
+	logIDRequestsPerSecond = flag.Float64("logid-requests-per-second", 1, "sustained upload requests per second allowed for one logID, 0 to disable")
+	logIDRequestBurst      = flag.Int("logid-request-burst", 10, "burst of upload requests allowed for one logID")
+	bytesPerMinute         = flag.Int("upload-bytes-per-minute", 4<<20, "bytes per minute one logID may upload for a kind, 0 to disable")
+	kindBytesPerMinute     = flag.String("kind-bytes-per-minute", "", "per-kind overrides of upload-bytes-per-minute, as kind=bytes,kind=bytes")
+	trustedProxies         = flag.String("trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose client IP headers are trusted")
+	clientIPHeaders        = flag.String("client-ip-headers", "X-Forwarded-For,X-Real-Ip", "comma-separated headers that trusted proxies put the client IP in")
+)
+
+// limiterIdleTimeout is how long a key's limiter is kept after its last use.
+const limiterIdleTimeout = 10 * time.Minute
+
+// keyedLimiter is a set of token bucket rate limiters, one per key.
+type keyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rate.Limit, burst int) *keyedLimiter {
+	return &keyedLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*limiterEntry{},
+	}
+}
+
+// allow takes n tokens from key's bucket. If there aren't enough, it returns
+// false and how long the caller should wait before trying again.
+func (kl *keyedLimiter) allow(key string, n int, now time.Time) (bool, time.Duration) {
+	_, ok, retryAfter := kl.reserve(key, n, now)
+	return ok, retryAfter
+}
+
+// reserve is allow, but also returns a function that puts the tokens back
+// for when a later check rejects the request.
+//
+// Tokens are only reserved when they are all available: a reservation that
+// has to wait pushes the limiter's next event into the future, and putting
+// it back doesn't undo that, so earlier reservations couldn't be put back
+// either.
+func (kl *keyedLimiter) reserve(key string, n int, now time.Time) (undo func(), ok bool, retryAfter time.Duration) {
+	if kl == nil || kl.limit == 0 {
+		return func() {}, true, 0
+	}
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	e, ok := kl.limiters[key]
+	if !ok {
+		e = &limiterEntry{lim: rate.NewLimiter(kl.limit, kl.burst)}
+		kl.limiters[key] = e
+	}
+	e.lastSeen = now
+
+	if n > kl.burst {
+		return nil, false, time.Minute
+	}
+	if missing := float64(n) - e.lim.TokensAt(now); missing > 0 {
+		return nil, false, time.Duration(missing / float64(kl.limit) * float64(time.Second))
+	}
+
+	r := e.lim.ReserveN(now, n)
+	return func() { r.CancelAt(now) }, true, 0
+}
+
+// tooLarge reports whether n tokens are more than a bucket can ever hold, so
+// that waiting won't help.
+func (kl *keyedLimiter) tooLarge(n int) bool {
+	return kl != nil && kl.limit != 0 && n > kl.burst
+}
+
+// cleanup forgets limiters that haven't been used since before cutoff.
+func (kl *keyedLimiter) cleanup(cutoff time.Time) {
+	if kl == nil {
+		return
+	}
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	for key, e := range kl.limiters {
+		if e.lastSeen.Before(cutoff) {
+			delete(kl.limiters, key)
+		}
+	}
+}
+
+// uploadLimits holds every limit applied to uploads.
+type uploadLimits struct {
+	byIP    *keyedLimiter
+	byLogID *keyedLimiter
+	byKind  map[string]*keyedLimiter
+
+	trusted []netip.Prefix
+	headers []string
+}
+
+// newUploadLimitsFromFlags builds the upload limits from command line flags.
+func newUploadLimitsFromFlags() (*uploadLimits, error) {
+	result := &uploadLimits{
+		byIP:    newKeyedLimiter(rate.Limit(*ipRequestsPerSecond), *ipRequestBurst),
+		byLogID: newKeyedLimiter(rate.Limit(*logIDRequestsPerSecond), *logIDRequestBurst),
+		byKind:  map[string]*keyedLimiter{},
+	}
+
+	quotas, err := parseKindQuotas(*kindBytesPerMinute)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse kind-bytes-per-minute: %w", err)
+	}
+
+	for _, kind := range knownKinds {
+		quota, ok := quotas[kind]
+		if !ok {
+			quota = *bytesPerMinute
+		}
+		result.byKind[kind] = newKeyedLimiter(rate.Limit(float64(quota)/60), quota)
+	}
+
+	for cidr := range strings.SplitSeq(*trustedProxies, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse trusted proxy %q: %w", cidr, err)
+		}
+		result.trusted = append(result.trusted, prefix)
+	}
+
+	for header := range strings.SplitSeq(*clientIPHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			result.headers = append(result.headers, header)
+		}
+	}
+
+	return result, nil
+}
+
+// parseKindQuotas parses a list of kind=bytes pairs.
+func parseKindQuotas(val string) (map[string]int, error) {
+	result := map[string]int{}
+
+	for pair := range strings.SplitSeq(val, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kind, bytes, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form kind=bytes", pair)
+		}
+
+		n, err := strconv.Atoi(bytes)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q has an invalid byte count", pair)
+		}
+
+		result[kind] = n
+	}
+
+	return result, nil
+}
+
+// clientIP returns the IP address of the client that made r. Headers set by
+// reverse proxies are only honored when the direct peer is a trusted proxy,
+// and are walked from the right so that a client can't spoof its address by
+// prepending entries.
+func (ul *uploadLimits) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !ul.isTrusted(addr) {
+		return host
+	}
+
+	for _, header := range ul.headers {
+		vals := strings.Split(strings.Join(r.Header.Values(header), ","), ",")
+		for i := len(vals) - 1; i >= 0; i-- {
+			candidate, err := netip.ParseAddr(strings.TrimSpace(vals[i]))
+			if err != nil {
+				break
+			}
+
+			if !ul.isTrusted(candidate) {
+				return candidate.Unmap().String()
+			}
+		}
+	}
+
+	return host
+}
+
+func (ul *uploadLimits) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ul.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupLoop periodically forgets idle limiters so that memory use doesn't
+// grow with the number of distinct clients ever seen.
+func (ul *uploadLimits) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		cutoff := now.Add(-limiterIdleTimeout)
+		ul.byIP.cleanup(cutoff)
+		ul.byLogID.cleanup(cutoff)
+		for _, kl := range ul.byKind {
+			kl.cleanup(cutoff)
+		}
+	}
+}
+
+// rateLimited writes a 429 response telling the client when to retry.
+func rateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "rate limited", http.StatusTooManyRequests)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParseKindQuotas(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      string
+		expected map[string]int
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			val:      "",
+			expected: map[string]int{},
+		},
+		{
+			name:     "two kinds",
+			val:      "techaro.anubis=1024, techaro.thoth=2048",
+			expected: map[string]int{"techaro.anubis": 1024, "techaro.thoth": 2048},
+		},
+		{
+			name:    "missing equals",
+			val:     "techaro.anubis",
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			val:     "techaro.anubis=-1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKindQuotas(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for kind, n := range tt.expected {
+				if got[kind] != n {
+					t.Errorf("kind %s: expected %d, got %d", kind, n, got[kind])
+				}
+			}
+		})
+	}
+}
+
+func TestUploadLimits_ClientIP(t *testing.T) {
+	ul := &uploadLimits{
+		trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		headers: []string{"X-Forwarded-For", "X-Real-Ip"},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.5:1234",
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "untrusted peer headers ignored",
+			remoteAddr: "203.0.113.5:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "spoofed entry before real client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.99, 198.51.100.1, 10.0.0.2"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "fallback header",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Real-Ip": "198.51.100.7"},
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/upload/techaro.anubis/foo", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := ul.clientIP(r); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestKeyedLimiter_Allow(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	kl := newKeyedLimiter(rate.Limit(1), 2)
+
+	for i := range 2 {
+		if ok, _ := kl.allow("a", 1, now); !ok {
+			t.Fatalf("request %d within burst should be allowed", i)
+		}
+	}
+
+	ok, retryAfter := kl.allow("a", 1, now)
+	if ok {
+		t.Fatal("request over burst should be limited")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("unexpected retry after %v", retryAfter)
+	}
+
+	if ok, _ := kl.allow("b", 1, now); !ok {
+		t.Error("other keys should have their own bucket")
+	}
+
+	if ok, _ := kl.allow("a", 1, now.Add(time.Second)); !ok {
+		t.Error("bucket should refill over time")
+	}
+
+	if ok, _ := kl.allow("a", 10, now.Add(time.Hour)); ok {
+		t.Error("request larger than burst should never be allowed")
+	}
+
+	kl.cleanup(now.Add(2 * time.Hour))
+	if len(kl.limiters) != 0 {
+		t.Errorf("expected idle limiters to be removed, %d left", len(kl.limiters))
+	}
+
+	disabled := newKeyedLimiter(0, 0)
+	if ok, _ := disabled.allow("a", 1<<30, now); !ok {
+		t.Error("a zero limit should disable limiting")
+	}
+}
+
+func TestKeyedLimiter_ReserveUndoAfterRejection(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	kl := newKeyedLimiter(rate.Limit(0.001), 1)
+
+	undo, ok, _ := kl.reserve("a", 1, now)
+	if !ok {
+		t.Fatal("first request should be allowed")
+	}
+	if _, ok, _ := kl.reserve("a", 1, now); ok {
+		t.Fatal("second request should be limited")
+	}
+
+	undo()
+	if ok, _ := kl.allow("a", 1, now); !ok {
+		t.Error("expected the first request's token to be put back after a rejection")
+	}
+}
+
+func TestServer_Check_RefundsIP(t *testing.T) {
+	s := NewServer(nil, "logs")
+	s.limits = &uploadLimits{
+		byIP:    newKeyedLimiter(rate.Limit(0.001), 2),
+		byLogID: newKeyedLimiter(rate.Limit(0.001), 1),
+	}
+
+	for i, tt := range []struct {
+		logID string
+		ok    bool
+	}{
+		{logID: "anubis_01jz4k5n8v", ok: true},
+		{logID: "anubis_01jz4k5n8v", ok: false},
+		{logID: "anubis_01jz4k5n8v", ok: false},
+		{logID: "anubis_01jz4k5n8w", ok: true},
+		{logID: "anubis_01jz4k5n8x", ok: false},
+	} {
+		_, rej := s.check("techaro.anubis", tt.logID, "192.0.2.1")
+		if (rej == nil) != tt.ok {
+			t.Errorf("upload %d for %s: expected ok=%v, got %v", i, tt.logID, tt.ok, rej)
+		}
+	}
+}
+
+func TestServer_Upload_LargerThanQuota(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.limits = &uploadLimits{byKind: map[string]*keyedLimiter{
+		"techaro.anubis": newKeyedLimiter(rate.Limit(1), 16),
+	}}
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{body: strings.Repeat("x", 32) + "\n", status: http.StatusRequestEntityTooLarge},
+		{body: "hello\n", status: http.StatusOK},
+		{body: "hello again\n", status: http.StatusTooManyRequests},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/upload/techaro.anubis/anubis_01jz4k5n8v", strings.NewReader(tt.body))
+		r.SetPathValue("kind", "techaro.anubis")
+		r.SetPathValue("logID", "anubis_01jz4k5n8v")
+		w := httptest.NewRecorder()
+
+		s.Upload(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%d byte upload: expected status %d, got %d: %s", len(tt.body), tt.status, w.Code, w.Body.String())
+		}
+	}
+}
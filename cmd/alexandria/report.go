@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+)
+
+// bucketReader is the part of *s3.Client that commands reading back
+// batches use.
+type bucketReader interface {
+	objectGetter
+	s3.ListObjectsV2APIClient
+}
+
+// batchKeySkew is how long after the time in its ID a batch may be stored,
+// or before it when clocks disagree. Listings of the batches stored within
+// a window look this far either side of it.
+const batchKeySkew = time.Hour
+
+// listBatches calls fn with the key, kind and store time of every batch
+// under prefix stored within [start, end). Each kind is listed starting
+// from the batches whose IDs were made at start, and stops after those
+// made at end, so only the part of the bucket near the window is read.
+func listBatches(ctx context.Context, s3c s3.ListObjectsV2APIClient, bucket, prefix string, start, end time.Time, fn func(key, kind string, stored time.Time) error) error {
+	prefixes, err := batchKindPrefixes(ctx, s3c, bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		kind, _, _ := strings.Cut(strings.TrimPrefix(prefix, batch.KeyPrefix), "/")
+		pages := s3.NewListObjectsV2Paginator(s3c, &s3.ListObjectsV2Input{
+			Bucket:     aws.String(bucket),
+			Prefix:     aws.String(prefix),
+			StartAfter: aws.String(batch.KeyAfter(kind, start.Add(-batchKeySkew))),
+		})
+	list:
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("can't list %s: %w", prefix, err)
+			}
+
+			for _, obj := range page.Contents {
+				key := aws.ToString(obj.Key)
+				t := aws.ToTime(obj.LastModified).UTC()
+
+				if made, ok := batch.KeyTime(key); ok && !made.Before(end.Add(batchKeySkew)) {
+					break list
+				}
+
+				kind, ok := batch.ParseKey(key)
+				if !ok || t.Before(start) || !t.Before(end) {
+					continue
+				}
+
+				if err := fn(key, kind, t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// batchKindPrefixes splits prefix into prefixes that each hold the batches
+// of one kind, listing the kinds under it if it spans more than one.
+func batchKindPrefixes(ctx context.Context, s3c s3.ListObjectsV2APIClient, bucket, prefix string) ([]string, error) {
+	if strings.HasPrefix(batch.KeyPrefix, prefix) {
+		prefix = batch.KeyPrefix
+	}
+
+	rest, ok := strings.CutPrefix(prefix, batch.KeyPrefix)
+	if !ok {
+		return nil, nil
+	}
+	if strings.Contains(rest, "/") {
+		return []string{prefix}, nil
+	}
+
+	var result []string
+	pages := s3.NewListObjectsV2Paginator(s3c, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("can't list %s: %w", prefix, err)
+		}
+
+		for _, cp := range page.CommonPrefixes {
+			result = append(result, aws.ToString(cp.Prefix))
+		}
+	}
+	return result, nil
+}
+
+// fingerprintStats describes one fingerprint in a report.
+type fingerprintStats struct {
+	Fingerprint string   `json:"fingerprint"`
+	Category    string   `json:"category,omitempty"`
+	Normalized  string   `json:"normalized"`
+	Example     string   `json:"example"`
+	Count       int      `json:"count"`
+	Baseline    float64  `json:"baselinePerDay"`
+	LogIDs      int      `json:"logIDs"`
+	Versions    []string `json:"versions,omitempty"`
+
+	logIDs   map[string]struct{}
+	versions map[string]struct{}
+	baseline int
+}
+
+// kindReport is the daily report for one kind.
+type kindReport struct {
+	Kind    string              `json:"kind"`
+	Day     string              `json:"day"`
+	Errors  int                 `json:"errors"`
+	New     []*fingerprintStats `json:"new"`
+	Spiking []*fingerprintStats `json:"spiking"`
+}
+
+// reportBuilder counts fingerprints on a day and the days before it.
+//
+// A fingerprint is new if it occurred on the day but not in the baseline
+// window, and spiking if it occurred at least minCount times and
+// spikeFactor times as often as its daily average over the baseline.
+type reportBuilder struct {
+	day          time.Time
+	baselineDays int
+	spikeFactor  float64
+	minCount     int
+
+	kinds map[string]map[string]*fingerprintStats
+}
+
+func newReportBuilder(day time.Time, baselineDays int, spikeFactor float64, minCount int) *reportBuilder {
+	return &reportBuilder{
+		day:          day.UTC().Truncate(24 * time.Hour),
+		baselineDays: baselineDays,
+		spikeFactor:  spikeFactor,
+		minCount:     minCount,
+		kinds:        map[string]map[string]*fingerprintStats{},
+	}
+}
+
+// window is the range of times the report reads.
+func (rb *reportBuilder) window() (start, end time.Time) {
+	return rb.day.AddDate(0, 0, -rb.baselineDays), rb.day.AddDate(0, 0, 1)
+}
+
+// add counts the errors of a batch stored at t.
+func (rb *reportBuilder) add(kind string, t time.Time, occurrences []errorOccurrence) {
+	start, end := rb.window()
+	if t.Before(start) || !t.Before(end) {
+		return
+	}
+	onDay := !t.Before(rb.day)
+
+	fps, ok := rb.kinds[kind]
+	if !ok {
+		fps = map[string]*fingerprintStats{}
+		rb.kinds[kind] = fps
+	}
+
+	for _, o := range occurrences {
+		st, ok := fps[o.Fingerprint]
+		if !ok {
+			st = &fingerprintStats{
+				Fingerprint: o.Fingerprint,
+				Category:    o.Category,
+				Normalized:  o.Normalized,
+				Example:     o.text(),
+				logIDs:      map[string]struct{}{},
+				versions:    map[string]struct{}{},
+			}
+			fps[o.Fingerprint] = st
+		}
+
+		if !onDay {
+			st.baseline++
+			continue
+		}
+
+		st.Count++
+		st.logIDs[o.LogID] = struct{}{}
+		if o.Version != "" {
+			st.versions[o.Version] = struct{}{}
+		}
+	}
+}
+
+// build returns a report per kind, sorted by kind, with the most frequent
+// fingerprints first.
+func (rb *reportBuilder) build() []kindReport {
+	var result []kindReport
+	for _, kind := range slices.Sorted(maps.Keys(rb.kinds)) {
+		kr := kindReport{Kind: kind, Day: rb.day.Format(time.DateOnly)}
+
+		for _, st := range rb.kinds[kind] {
+			if st.Count == 0 {
+				continue
+			}
+
+			kr.Errors += st.Count
+			st.LogIDs = len(st.logIDs)
+			st.Versions = slices.Sorted(maps.Keys(st.versions))
+			if rb.baselineDays > 0 {
+				st.Baseline = float64(st.baseline) / float64(rb.baselineDays)
+			}
+
+			switch {
+			case st.baseline == 0:
+				kr.New = append(kr.New, st)
+			case st.Count >= rb.minCount && float64(st.Count) >= rb.spikeFactor*st.Baseline:
+				kr.Spiking = append(kr.Spiking, st)
+			}
+		}
+
+		byCount := func(a, b *fingerprintStats) int {
+			return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Fingerprint, b.Fingerprint))
+		}
+		slices.SortFunc(kr.New, byCount)
+		slices.SortFunc(kr.Spiking, byCount)
+
+		result = append(result, kr)
+	}
+	return result
+}
+
+// scan reads every batch under prefix that was stored within the report's
+// window.
+func (rb *reportBuilder) scan(ctx context.Context, s3c bucketReader, bucket, prefix string) error {
+	start, end := rb.window()
+
+	return listBatches(ctx, s3c, bucket, prefix, start, end, func(key, kind string, stored time.Time) error {
+		b, err := fetchBatch(ctx, s3c, bucket, key, kind)
+		if err != nil {
+			return err
+		}
+
+		occurrences, err := batchErrors(b)
+		if err != nil {
+			return fmt.Errorf("can't read %s: %w", key, err)
+		}
+
+		rb.add(kind, stored, occurrences)
+		return nil
+	})
+}
+
+// writeReports writes reports as a table per kind.
+func writeReports(w io.Writer, reports []kindReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	for i, kr := range reports {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		fmt.Fprintf(tw, "%s %s: %d errors, %d new, %d spiking\n", kr.Kind, kr.Day, kr.Errors, len(kr.New), len(kr.Spiking))
+		for _, group := range []struct {
+			label string
+			stats []*fingerprintStats
+		}{{"NEW", kr.New}, {"SPIKING", kr.Spiking}} {
+			for _, st := range group.stats {
+				category := ""
+				if st.Category != "" {
+					category = "[" + st.Category + "] "
+				}
+				fmt.Fprintf(tw, "  %s\t%d\t%.1f/day\t%d logIDs\t%s\t%s%s\n", group.label, st.Count, st.Baseline, st.LogIDs, st.Fingerprint, category, st.Normalized)
+			}
+		}
+	}
+
+	return tw.Flush()
+}
+
+// runReport is the report subcommand: it prints the new and spiking error
+// fingerprints of a day for every kind under a bucket prefix.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	bucketName := fs.String("bucket", *bucket, "bucket to read batches from")
+	prefix := fs.String("prefix", batch.KeyPrefix+"techaro.anubis/", "key prefix of the batches to read")
+	dayStr := fs.String("day", time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly), "UTC day to report on, as YYYY-MM-DD")
+	baselineDays := fs.Int("baseline-days", 7, "number of days before the report day to compare against")
+	spikeFactor := fs.Float64("spike-factor", 3, "how many times its daily baseline a fingerprint must occur to be spiking")
+	minCount := fs.Int("min-count", 10, "fewest occurrences on the day for a fingerprint to be spiking")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(time.DateOnly, *dayStr)
+	if err != nil {
+		return fmt.Errorf("can't parse -day: %w", err)
+	}
+	if *baselineDays < 0 {
+		return errors.New("-baseline-days can't be negative")
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	rb := newReportBuilder(day, *baselineDays, *spikeFactor, *minCount)
+	if err := rb.scan(ctx, s3.NewFromConfig(cfg), *bucketName, *prefix); err != nil {
+		return err
+	}
+
+	reports := rb.build()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+
+	if len(reports) == 0 {
+		fmt.Printf("no errors under %s on %s\n", *prefix, *dayStr)
+		return nil
+	}
+
+	return writeReports(os.Stdout, reports)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// listBucket is a memBucket that can also be listed.
+type listBucket struct {
+	memBucket
+	modified map[string]time.Time
+}
+
+func (lb listBucket) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	prefix := *params.Bucket + "/" + aws.ToString(params.Prefix)
+	delim := aws.ToString(params.Delimiter)
+
+	var result s3.ListObjectsV2Output
+	for _, name := range slices.Sorted(maps.Keys(lb.memBucket)) {
+		key := strings.TrimPrefix(name, *params.Bucket+"/")
+		if !strings.HasPrefix(name, prefix) || key <= aws.ToString(params.StartAfter) {
+			continue
+		}
+
+		if i := strings.Index(strings.TrimPrefix(name, prefix), delim); delim != "" && i >= 0 {
+			cp := aws.ToString(params.Prefix) + strings.TrimPrefix(name, prefix)[:i+len(delim)]
+			if n := len(result.CommonPrefixes); n == 0 || aws.ToString(result.CommonPrefixes[n-1].Prefix) != cp {
+				result.CommonPrefixes = append(result.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(cp)})
+			}
+			continue
+		}
+
+		result.Contents = append(result.Contents, types.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(lb.modified[name]),
+		})
+	}
+	return &result, nil
+}
+
+// batchKey returns the key of a batch of kind whose ID was made at made.
+func batchKey(t *testing.T, kind string, made time.Time) string {
+	t.Helper()
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := made.UnixMilli()
+	for i := range 6 {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	return batch.Key(kind, id.String())
+}
+
+func occurrencesOf(n int, msg string) []errorOccurrence {
+	el := errorLine{Msg: msg}
+	o := newErrorOccurrence(batch.Entry{Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"}, el)
+
+	var result []errorOccurrence
+	for range n {
+		result = append(result, o)
+	}
+	return result
+}
+
+func TestReportBuilder(t *testing.T) {
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+	rb := newReportBuilder(day, 7, 3, 10)
+
+	// baseline: 2 broken pipes a day, 1 timeout a day
+	for d := 1; d <= 7; d++ {
+		at := day.AddDate(0, 0, -d).Add(time.Hour)
+		rb.add("techaro.anubis", at, occurrencesOf(2, "broken pipe"))
+		rb.add("techaro.anubis", at, occurrencesOf(1, "timed out"))
+	}
+
+	// too old to count
+	rb.add("techaro.anubis", day.AddDate(0, 0, -8), occurrencesOf(100, "broken pipe"))
+
+	at := day.Add(12 * time.Hour)
+	rb.add("techaro.anubis", at, occurrencesOf(5, "broken pipe"))   // steady
+	rb.add("techaro.anubis", at, occurrencesOf(12, "timed out"))    // spiking
+	rb.add("techaro.anubis", at, occurrencesOf(1, "no such thing")) // new
+
+	// the next day isn't counted
+	rb.add("techaro.anubis", day.AddDate(0, 0, 1), occurrencesOf(100, "something else"))
+
+	reports := rb.build()
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(reports))
+	}
+
+	kr := reports[0]
+	if kr.Day != "2025-01-08" || kr.Errors != 18 {
+		t.Errorf("unexpected report %+v", kr)
+	}
+
+	if len(kr.New) != 1 || kr.New[0].Normalized != "no such thing" {
+		t.Errorf("unexpected new fingerprints %+v", kr.New)
+	}
+
+	if len(kr.Spiking) != 1 || kr.Spiking[0].Normalized != "timed out" {
+		t.Fatalf("unexpected spiking fingerprints %+v", kr.Spiking)
+	}
+	if kr.Spiking[0].Count != 12 || kr.Spiking[0].Baseline != 1 || kr.Spiking[0].LogIDs != 1 {
+		t.Errorf("unexpected stats %+v", kr.Spiking[0])
+	}
+
+	var buf bytes.Buffer
+	if err := writeReports(&buf, reports); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"18 errors, 1 new, 1 spiking", "NEW", "SPIKING", "timed out"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in report:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestReportBuilder_Scan(t *testing.T) {
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	e := batch.Entry{ID: "1", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"}
+	e.SetData([]byte(`{"level":"ERROR","msg":"can't serve","err":"broken pipe"}` + "\n"))
+	data := encodeBatch(t, e)
+
+	first := batchKey(t, "techaro.anubis", day.Add(time.Hour))
+	second := batchKey(t, "techaro.anubis", day.Add(2*time.Hour))
+	old := batchKey(t, "techaro.anubis", day.AddDate(0, 0, -30))
+	// IDs far outside the window aren't listed, even if they claim to be
+	// stored within it.
+	early := batchKey(t, "techaro.anubis", day.AddDate(0, 0, -60))
+	late := batchKey(t, "techaro.anubis", day.AddDate(0, 0, 2))
+
+	lb := listBucket{
+		memBucket: memBucket{
+			"logs/" + first:                     data,
+			"logs/" + second:                    data,
+			"logs/" + old:                       []byte("{nope"),
+			"logs/" + early:                     []byte("{nope"),
+			"logs/" + late:                      []byte("{nope"),
+			"logs/inp/techaro.anubis/notes.txt": []byte("not a batch"),
+		},
+		modified: map[string]time.Time{
+			"logs/" + first:  day.Add(time.Hour),
+			"logs/" + second: day.Add(2 * time.Hour),
+			"logs/" + old:    day.AddDate(0, 0, -30),
+			"logs/" + early:  day.Add(time.Hour),
+			"logs/" + late:   day.Add(time.Hour),
+		},
+	}
+
+	for _, prefix := range []string{"inp/techaro.anubis/", batch.KeyPrefix, ""} {
+		rb := newReportBuilder(day, 7, 3, 10)
+		if err := rb.scan(context.Background(), lb, "logs", prefix); err != nil {
+			t.Fatalf("%q: %v", prefix, err)
+		}
+
+		reports := rb.build()
+		if len(reports) != 1 || reports[0].Errors != 2 || len(reports[0].New) != 1 {
+			t.Fatalf("%q: unexpected reports %+v", prefix, reports)
+		}
+		if reports[0].New[0].Category != "" || reports[0].New[0].Example != "can't serve: broken pipe" {
+			t.Errorf("%q: unexpected fingerprint %+v", prefix, reports[0].New[0])
+		}
+	}
+}
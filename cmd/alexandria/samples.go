@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/facebookgo/flagenv"
+)
+
+const (
+	requestSamplesKind = "techaro.anubis.request-samples"
+
+	// summaryPrefix is where daily summaries are stored in the bucket.
+	summaryPrefix = "summaries/"
+
+	// sampleGrace is how long after the end of a day batches are still read
+	// for samples recorded on that day.
+	sampleGrace = time.Hour
+)
+
+// requestSample is one line of a techaro.anubis.request-samples log: a
+// request Anubis saw and what it did about it.
+type requestSample struct {
+	Time            time.Time   `json:"time"`
+	UserAgent       string      `json:"user_agent"`
+	Action          string      `json:"action"`
+	Rule            string      `json:"rule"`
+	ChallengeResult string      `json:"challenge_result"`
+	ASN             json.Number `json:"asn"`
+	Country         string      `json:"country"`
+}
+
+// countedValue is a value and how many samples had it.
+type countedValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// topValues returns the n most common values in counts, most common first.
+func topValues(counts map[string]int, n int) []countedValue {
+	result := make([]countedValue, 0, len(counts))
+	for v, c := range counts {
+		result = append(result, countedValue{Value: v, Count: c})
+	}
+	slices.SortFunc(result, func(a, b countedValue) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// sampleSummary is the stored summary of a day of request samples for one
+// logID, or for all of them if LogID is empty.
+type sampleSummary struct {
+	Kind     string `json:"kind"`
+	LogID    string `json:"logID,omitempty"`
+	Day      string `json:"day"`
+	Requests int    `json:"requests"`
+	Invalid  int    `json:"invalid,omitempty"`
+
+	Actions    map[string]int `json:"actions,omitempty"`
+	Challenges struct {
+		Passed   int     `json:"passed"`
+		Failed   int     `json:"failed"`
+		PassRate float64 `json:"passRate"`
+	} `json:"challenges"`
+
+	UserAgents []countedValue `json:"userAgents,omitempty"`
+	Rules      []countedValue `json:"rules,omitempty"`
+	ASNs       []countedValue `json:"asns,omitempty"`
+	Countries  []countedValue `json:"countries,omitempty"`
+}
+
+// key is where the summary is stored.
+func (ss *sampleSummary) key() string {
+	name := cmp.Or(ss.LogID, "all")
+	return summaryPrefix + path.Join(ss.Kind, ss.Day, name+".json")
+}
+
+// sampleStats counts the samples of one logID.
+type sampleStats struct {
+	requests, invalid int
+	passed, failed    int
+
+	actions, userAgents, rules, asns, countries map[string]int
+}
+
+func newSampleStats() *sampleStats {
+	return &sampleStats{
+		actions:    map[string]int{},
+		userAgents: map[string]int{},
+		rules:      map[string]int{},
+		asns:       map[string]int{},
+		countries:  map[string]int{},
+	}
+}
+
+func (st *sampleStats) add(rs requestSample) {
+	st.requests++
+
+	count := func(m map[string]int, v string) {
+		if v != "" {
+			m[v]++
+		}
+	}
+	count(st.actions, strings.ToUpper(rs.Action))
+	count(st.userAgents, rs.UserAgent)
+	count(st.rules, rs.Rule)
+	count(st.countries, strings.ToUpper(rs.Country))
+	if rs.ASN != "" {
+		st.asns["AS"+rs.ASN.String()]++
+	}
+
+	switch strings.ToLower(rs.ChallengeResult) {
+	case "pass":
+		st.passed++
+	case "fail":
+		st.failed++
+	}
+}
+
+func (st *sampleStats) summary(logID, day string, top int) *sampleSummary {
+	result := &sampleSummary{
+		Kind:       requestSamplesKind,
+		LogID:      logID,
+		Day:        day,
+		Requests:   st.requests,
+		Invalid:    st.invalid,
+		Actions:    st.actions,
+		UserAgents: topValues(st.userAgents, top),
+		Rules:      topValues(st.rules, top),
+		ASNs:       topValues(st.asns, top),
+		Countries:  topValues(st.countries, top),
+	}
+
+	result.Challenges.Passed = st.passed
+	result.Challenges.Failed = st.failed
+	if n := st.passed + st.failed; n != 0 {
+		result.Challenges.PassRate = float64(st.passed) / float64(n)
+	}
+
+	return result
+}
+
+// sampleAggregator summarizes a day of request samples per logID.
+type sampleAggregator struct {
+	day time.Time
+	top int
+
+	all    *sampleStats
+	logIDs map[string]*sampleStats
+}
+
+func newSampleAggregator(day time.Time, top int) *sampleAggregator {
+	return &sampleAggregator{
+		day:    day.UTC().Truncate(24 * time.Hour),
+		top:    top,
+		all:    newSampleStats(),
+		logIDs: map[string]*sampleStats{},
+	}
+}
+
+// onDay reports whether t is within the day being summarized.
+func (sa *sampleAggregator) onDay(t time.Time) bool {
+	return !t.Before(sa.day) && t.Before(sa.day.AddDate(0, 0, 1))
+}
+
+// add counts the samples of a batch stored at stored. Samples are dated by
+// their own time, then by when the client recorded the line, then by when
+// the batch was stored.
+func (sa *sampleAggregator) add(b *logBatch, stored time.Time) error {
+	for _, e := range b.Entries {
+		lines, err := e.Lines()
+		if err != nil {
+			return err
+		}
+
+		st, ok := sa.logIDs[e.LogID]
+		if !ok {
+			st = newSampleStats()
+			sa.logIDs[e.LogID] = st
+		}
+
+		for _, line := range lines {
+			var rs requestSample
+			if err := json.Unmarshal(line.Data, &rs); err != nil {
+				if sa.onDay(cmp.Or(line.Time, stored)) {
+					st.invalid++
+					sa.all.invalid++
+				}
+				continue
+			}
+
+			if !sa.onDay(cmp.Or(rs.Time, line.Time, stored)) {
+				continue
+			}
+
+			st.add(rs)
+			sa.all.add(rs)
+		}
+	}
+
+	return nil
+}
+
+// scan reads every batch of request samples that may hold samples from the
+// day being summarized.
+func (sa *sampleAggregator) scan(ctx context.Context, s3c bucketReader, bucket string) error {
+	start, end := sa.day, sa.day.AddDate(0, 0, 1).Add(sampleGrace)
+	prefix := batch.KeyPrefix + requestSamplesKind + "/"
+
+	return listBatches(ctx, s3c, bucket, prefix, start, end, func(key, kind string, stored time.Time) error {
+		b, err := fetchBatch(ctx, s3c, bucket, key, kind)
+		if err != nil {
+			return err
+		}
+
+		if err := sa.add(b, stored); err != nil {
+			return fmt.Errorf("can't read %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// summaries returns a summary per logID that had samples on the day, sorted
+// by logID, followed by the summary of all of them.
+func (sa *sampleAggregator) summaries() []*sampleSummary {
+	day := sa.day.Format(time.DateOnly)
+
+	var result []*sampleSummary
+	for _, logID := range slices.Sorted(maps.Keys(sa.logIDs)) {
+		st := sa.logIDs[logID]
+		if st.requests == 0 && st.invalid == 0 {
+			continue
+		}
+		result = append(result, st.summary(logID, day, sa.top))
+	}
+
+	return append(result, sa.all.summary("", day, sa.top))
+}
+
+// objectPutter is the part of *s3.Client used to store summaries.
+type objectPutter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// storeSummaries writes each summary to its key in bucket.
+func storeSummaries(ctx context.Context, s3c objectPutter, bucket string, summaries []*sampleSummary) error {
+	for _, ss := range summaries {
+		data, err := json.Marshal(ss)
+		if err != nil {
+			return err
+		}
+
+		if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
+			Body:        bytes.NewReader(data),
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(ss.key()),
+			ContentType: aws.String("application/json"),
+		}); err != nil {
+			return fmt.Errorf("can't store %s: %w", ss.key(), err)
+		}
+	}
+
+	return nil
+}
+
+// runSamples is the samples subcommand: it summarizes a day of request
+// samples per logID and stores the summaries under summaries/ in the
+// bucket.
+func runSamples(args []string) error {
+	fs := flag.NewFlagSet("samples", flag.ExitOnError)
+	bucketName := fs.String("bucket", *bucket, "bucket to read batches from and store summaries in")
+	dayStr := fs.String("day", time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly), "UTC day to summarize, as YYYY-MM-DD")
+	top := fs.Int("top", 20, "how many of the most common user agents, rules, ASNs and countries to keep")
+	dryRun := fs.Bool("dry-run", false, "print the summaries instead of storing them")
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(time.DateOnly, *dayStr)
+	if err != nil {
+		return fmt.Errorf("can't parse -day: %w", err)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	s3c := s3.NewFromConfig(cfg)
+
+	sa := newSampleAggregator(day, *top)
+	if err := sa.scan(ctx, s3c, *bucketName); err != nil {
+		return err
+	}
+
+	summaries := sa.summaries()
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summaries)
+	}
+
+	if err := storeSummaries(ctx, s3c, *bucketName, summaries); err != nil {
+		return err
+	}
+
+	slog.Info("stored request sample summaries", "day", *dayStr, "logIDs", len(summaries)-1, "requests", sa.all.requests)
+	return nil
+}
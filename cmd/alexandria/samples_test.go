@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// putRecorder keeps the objects put to it.
+type putRecorder map[string][]byte
+
+func (pr putRecorder) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	pr[*params.Bucket+"/"+*params.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestTopValues(t *testing.T) {
+	got := topValues(map[string]int{"a": 1, "b": 3, "c": 3, "d": 2}, 3)
+	want := []countedValue{{"b", 3}, {"c", 3}, {"d", 2}}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("expected %v, got %v", want[i], got[i])
+		}
+	}
+}
+
+func TestSampleAggregator(t *testing.T) {
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	a := batch.Entry{ID: "1", Kind: requestSamplesKind, LogID: "anubis_01jz4k5n8v"}
+	a.SetData([]byte(`{"time":"2025-01-08T10:00:00Z","user_agent":"curl/8.5.0","action":"DENY","rule":"ai-robots-txt","asn":13335,"country":"ca"}
+{"time":"2025-01-08T10:00:01Z","user_agent":"Mozilla/5.0","action":"CHALLENGE","challenge_result":"pass","asn":13335,"country":"CA"}
+{"time":"2025-01-08T10:00:02Z","user_agent":"Mozilla/5.0","action":"CHALLENGE","challenge_result":"fail"}
+{"time":"2025-01-08T10:00:03Z","user_agent":"Mozilla/5.0","action":"CHALLENGE","challenge_result":"pass"}
+{"time":"2025-01-07T23:59:59Z","user_agent":"yesterday","action":"ALLOW"}
+not json
+`))
+
+	// no time of its own, so it is dated by the batch
+	b := batch.Entry{ID: "2", Kind: requestSamplesKind, LogID: "anubis_02jz4k5n8v"}
+	b.SetData([]byte(`{"user_agent":"curl/8.5.0","action":"ALLOW"}` + "\n"))
+
+	sa := newSampleAggregator(day, 1)
+	if err := sa.add(&logBatch{Kind: requestSamplesKind, Entries: []batch.Entry{a, b}}, day.Add(11*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored after the day, with nothing dated on it
+	late := batch.Entry{ID: "3", Kind: requestSamplesKind, LogID: "anubis_03jz4k5n8v"}
+	late.SetData([]byte(`{"user_agent":"curl/8.5.0","action":"ALLOW"}` + "\n"))
+	if err := sa.add(&logBatch{Kind: requestSamplesKind, Entries: []batch.Entry{late}}, day.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries := sa.summaries()
+	if len(summaries) != 3 {
+		t.Fatalf("expected 2 logIDs and a total, got %d summaries", len(summaries))
+	}
+
+	first := summaries[0]
+	if first.LogID != "anubis_01jz4k5n8v" || first.Requests != 4 || first.Invalid != 1 {
+		t.Errorf("unexpected summary %+v", first)
+	}
+	if first.Actions["CHALLENGE"] != 3 || first.Actions["DENY"] != 1 {
+		t.Errorf("unexpected actions %v", first.Actions)
+	}
+	if first.Challenges.Passed != 2 || first.Challenges.Failed != 1 || first.Challenges.PassRate != 2.0/3 {
+		t.Errorf("unexpected challenges %+v", first.Challenges)
+	}
+	if len(first.UserAgents) != 1 || first.UserAgents[0] != (countedValue{"Mozilla/5.0", 3}) {
+		t.Errorf("unexpected user agents %v", first.UserAgents)
+	}
+	if first.ASNs[0] != (countedValue{"AS13335", 2}) || first.Countries[0] != (countedValue{"CA", 2}) {
+		t.Errorf("unexpected ASNs %v or countries %v", first.ASNs, first.Countries)
+	}
+	if first.Rules[0] != (countedValue{"ai-robots-txt", 1}) {
+		t.Errorf("unexpected rules %v", first.Rules)
+	}
+
+	all := summaries[2]
+	if all.LogID != "" || all.Requests != 5 || all.UserAgents[0] != (countedValue{"Mozilla/5.0", 3}) {
+		t.Errorf("unexpected total %+v", all)
+	}
+
+	pr := putRecorder{}
+	if err := storeSummaries(context.Background(), pr, "logs", summaries); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"logs/summaries/techaro.anubis.request-samples/2025-01-08/anubis_01jz4k5n8v.json",
+		"logs/summaries/techaro.anubis.request-samples/2025-01-08/anubis_02jz4k5n8v.json",
+		"logs/summaries/techaro.anubis.request-samples/2025-01-08/all.json",
+	} {
+		data, ok := pr[key]
+		if !ok {
+			t.Errorf("expected a summary at %s, got %d objects", key, len(pr))
+			continue
+		}
+
+		var ss sampleSummary
+		if err := json.Unmarshal(data, &ss); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestSampleAggregator_Scan(t *testing.T) {
+	day := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	e := batch.Entry{ID: "1", Kind: requestSamplesKind, LogID: "anubis_01jz4k5n8v"}
+	e.SetData([]byte(`{"time":"2025-01-08T23:59:00Z","user_agent":"curl/8.5.0","action":"ALLOW"}` + "\n"))
+	data := encodeBatch(t, e)
+
+	first := batchKey(t, requestSamplesKind, day.Add(time.Hour))
+	grace := batchKey(t, requestSamplesKind, day.AddDate(0, 0, 1).Add(time.Minute))
+	late := batchKey(t, requestSamplesKind, day.AddDate(0, 0, 2))
+	// IDs far outside the day aren't listed, even if they claim to be
+	// stored on it.
+	early := batchKey(t, requestSamplesKind, day.AddDate(0, 0, -30))
+
+	lb := listBucket{
+		memBucket: memBucket{
+			"logs/" + first: data,
+			"logs/" + grace: data,
+			"logs/" + late:  data,
+			"logs/" + early: []byte("{nope"),
+		},
+		modified: map[string]time.Time{
+			"logs/" + first: day.Add(time.Hour),
+			"logs/" + grace: day.AddDate(0, 0, 1).Add(time.Minute),
+			"logs/" + late:  day.AddDate(0, 0, 2),
+			"logs/" + early: day.Add(time.Hour),
+		},
+	}
+
+	sa := newSampleAggregator(day, 10)
+	if err := sa.scan(context.Background(), lb, "logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sa.all.requests != 2 {
+		t.Errorf("expected the batch stored within the grace period to count, got %d requests", sa.all.requests)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+var schemaMode = flag.String("schema-mode", "off", "how to check log lines against their kind's schema: off, warn to tag invalid lines, or enforce to drop them")
+
+// schemaFS holds the JSON Schema of every version of every kind, at
+// schemas/{kind}/{version}.json.
+//
+//go:embed schemas
+var schemaFS embed.FS
+
+// currentSchemas is the schema version lines of each kind are validated
+// against.
+var currentSchemas = map[string]string{
+	"techaro.anubis":                 "v1",
+	"techaro.anubis.request-samples": "v1",
+	"techaro.thoth":                  "v1",
+}
+
+// kindSchema is a compiled schema of a kind.
+type kindSchema struct {
+	version string
+	schema  *jsonschema.Schema
+}
+
+// loadSchemas compiles the current schema of every kind.
+func loadSchemas() (map[string]*kindSchema, error) {
+	c := jsonschema.NewCompiler()
+	c.AssertFormat()
+
+	result := map[string]*kindSchema{}
+	for kind, version := range currentSchemas {
+		name := path.Join("schemas", kind, version+".json")
+
+		f, err := schemaFS.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := jsonschema.UnmarshalJSON(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %s: %w", name, err)
+		}
+
+		if err := c.AddResource(name, doc); err != nil {
+			return nil, fmt.Errorf("can't add %s: %w", name, err)
+		}
+
+		sch, err := c.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile %s: %w", name, err)
+		}
+
+		result[kind] = &kindSchema{version: version, schema: sch}
+	}
+
+	return result, nil
+}
+
+// schemaValidator checks the lines of entries against their kind's schema.
+// In warn mode invalid lines are stored and listed in the entry; in enforce
+// mode they are dropped. Lines that aren't JSON objects, such as the panic
+// output of a crashing service, aren't structured logs and are kept
+// unchecked. A nil *schemaValidator checks nothing.
+type schemaValidator struct {
+	mode    string
+	schemas map[string]*kindSchema
+}
+
+func newSchemaValidatorFromFlags() (*schemaValidator, error) {
+	return newSchemaValidator(*schemaMode)
+}
+
+// newSchemaValidator returns a validator for mode, or nil if mode is off.
+func newSchemaValidator(mode string) (*schemaValidator, error) {
+	switch mode {
+	case "", "off":
+		return nil, nil
+	case "warn", "enforce":
+	default:
+		return nil, fmt.Errorf("unknown schema mode %q", mode)
+	}
+
+	schemas, err := loadSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	return &schemaValidator{mode: mode, schemas: schemas}, nil
+}
+
+// validate checks one line against ks.
+func (ks *kindSchema) validate(line []byte) error {
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	return ks.schema.Validate(v)
+}
+
+// isJSONObject reports whether line looks like a JSON object rather than
+// plain text.
+func isJSONObject(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) != 0 && line[0] == '{'
+}
+
+// apply validates the lines of entry and records the result in it. It
+// returns false if entry has nothing left worth storing.
+func (sv *schemaValidator) apply(entry *batch.Entry) (bool, error) {
+	if sv == nil {
+		return true, nil
+	}
+
+	ks, ok := sv.schemas[entry.Kind]
+	if !ok {
+		return true, nil
+	}
+
+	lines, err := entry.Lines()
+	if err != nil {
+		return false, err
+	}
+
+	entry.Schema = ks.version
+	entry.Invalid = nil
+	for i, line := range lines {
+		if !isJSONObject(line.Data) {
+			continue
+		}
+		if err := ks.validate(line.Data); err != nil {
+			slog.Debug("log line doesn't match schema", "kind", entry.Kind, "logID", entry.LogID, "schema", ks.version, "err", err)
+			entry.Invalid = append(entry.Invalid, i)
+		}
+	}
+
+	if len(entry.Invalid) == 0 {
+		return true, nil
+	}
+
+	schemaInvalidLinesTotal.WithLabelValues(entry.Kind, sv.mode).Add(float64(len(entry.Invalid)))
+
+	if sv.mode != "enforce" {
+		return true, nil
+	}
+
+	var (
+		buf   bytes.Buffer
+		times []time.Time
+		next  int
+	)
+	for i, line := range lines {
+		if next < len(entry.Invalid) && entry.Invalid[next] == i {
+			next++
+			continue
+		}
+
+		buf.Write(line.Data)
+		buf.WriteByte('\n')
+		if len(entry.Times) == len(lines) {
+			times = append(times, line.Time)
+		}
+	}
+
+	entry.SetData(buf.Bytes())
+	entry.Times = times
+	entry.Invalid = nil
+
+	return buf.Len() != 0 || entry.Dropped != 0, nil
+}
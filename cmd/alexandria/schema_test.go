@@ -0,0 +1,174 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+func TestLoadSchemas(t *testing.T) {
+	schemas, err := loadSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range knownKinds {
+		if _, ok := schemas[kind]; !ok {
+			t.Errorf("no schema for %s", kind)
+		}
+	}
+}
+
+func TestNewSchemaValidator(t *testing.T) {
+	for _, mode := range []string{"", "off"} {
+		sv, err := newSchemaValidator(mode)
+		if err != nil || sv != nil {
+			t.Errorf("%q: expected no validator, got %v, %v", mode, sv, err)
+		}
+	}
+
+	if _, err := newSchemaValidator("strict"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestSchemaValidator_Apply(t *testing.T) {
+	const lines = `{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"listening"}
+panic: oops
+{"time":"yesterday","level":"INFO","msg":"listening"}
+{"time":"2025-01-01T00:00:01Z","level":"ERROR+4","msg":"can't serve","err":"broken pipe"}
+`
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{t0, t0.Add(time.Second), t0.Add(2 * time.Second), t0.Add(3 * time.Second)}
+
+	tests := []struct {
+		name    string
+		mode    string
+		kind    string
+		data    string
+		keep    bool
+		schema  string
+		invalid []int
+		lines   []string
+		times   []time.Time
+	}{
+		{
+			name:    "warn",
+			mode:    "warn",
+			kind:    "techaro.anubis",
+			data:    lines,
+			keep:    true,
+			schema:  "v1",
+			invalid: []int{2},
+			lines: []string{
+				`{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"listening"}`,
+				"panic: oops",
+				`{"time":"yesterday","level":"INFO","msg":"listening"}`,
+				`{"time":"2025-01-01T00:00:01Z","level":"ERROR+4","msg":"can't serve","err":"broken pipe"}`,
+			},
+			times: times,
+		},
+		{
+			name:   "enforce",
+			mode:   "enforce",
+			kind:   "techaro.anubis",
+			data:   lines,
+			keep:   true,
+			schema: "v1",
+			lines: []string{
+				`{"time":"2025-01-01T00:00:00Z","level":"INFO","msg":"listening"}`,
+				"panic: oops",
+				`{"time":"2025-01-01T00:00:01Z","level":"ERROR+4","msg":"can't serve","err":"broken pipe"}`,
+			},
+			times: []time.Time{times[0], times[1], times[3]},
+		},
+		{
+			name:   "enforce with nothing valid",
+			mode:   "enforce",
+			kind:   "techaro.anubis.request-samples",
+			data:   `{"action":"CHALLENGE","asn":"AS13335"}` + "\n" + `{"asn":13335}` + "\n",
+			schema: "v1",
+		},
+		{
+			name:   "request sample",
+			mode:   "enforce",
+			kind:   "techaro.anubis.request-samples",
+			data:   `{"action":"CHALLENGE","challenge_result":"pass","asn":13335,"country":"CA"}` + "\n",
+			keep:   true,
+			schema: "v1",
+			lines:  []string{`{"action":"CHALLENGE","challenge_result":"pass","asn":13335,"country":"CA"}`},
+		},
+		{
+			name:   "request sample as samples.go reads it",
+			mode:   "enforce",
+			kind:   "techaro.anubis.request-samples",
+			data:   `{"action":"challenge","challenge_result":"PASS","asn":"13335"}` + "\n",
+			keep:   true,
+			schema: "v1",
+			lines:  []string{`{"action":"challenge","challenge_result":"PASS","asn":"13335"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sv, err := newSchemaValidator(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entry := batch.Entry{Kind: tt.kind, LogID: "anubis_01jz4k5n8v"}
+			entry.SetData([]byte(tt.data))
+			if tt.data == lines {
+				entry.Times = times
+			}
+
+			keep, err := sv.apply(&entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if keep != tt.keep {
+				t.Errorf("expected keep %v, got %v", tt.keep, keep)
+			}
+			if entry.Schema != tt.schema {
+				t.Errorf("expected schema %q, got %q", tt.schema, entry.Schema)
+			}
+			if !slices.Equal(entry.Invalid, tt.invalid) {
+				t.Errorf("expected invalid lines %v, got %v", tt.invalid, entry.Invalid)
+			}
+
+			got, err := entry.Lines()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.lines) {
+				t.Fatalf("expected %d lines, got %d", len(tt.lines), len(got))
+			}
+			for i, line := range got {
+				if string(line.Data) != tt.lines[i] {
+					t.Errorf("line %d: expected %s, got %s", i, tt.lines[i], line.Data)
+				}
+				if line.Invalid != slices.Contains(tt.invalid, i) {
+					t.Errorf("line %d: expected invalid to be %v", i, !line.Invalid)
+				}
+			}
+			if !slices.EqualFunc(entry.Times, tt.times, time.Time.Equal) {
+				t.Errorf("expected times %v, got %v", tt.times, entry.Times)
+			}
+		})
+	}
+}
+
+func TestSchemaValidator_Nil(t *testing.T) {
+	var sv *schemaValidator
+
+	entry := batch.Entry{Kind: "techaro.anubis"}
+	entry.SetData([]byte("not json\n"))
+
+	keep, err := sv.apply(&entry)
+	if err != nil || !keep || entry.Schema != "" {
+		t.Errorf("expected a nil validator to leave the entry alone, got %v, %v, %+v", keep, err, entry)
+	}
+}
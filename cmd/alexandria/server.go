@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"slices"
+	"sync/atomic"
 	"time"
 
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
@@ -24,29 +27,51 @@ var knownKinds = []string{
 	"techaro.thoth",
 }
 
-// LogEntry represents a single log entry in the batch
-type LogEntry struct {
-	ID    string `json:"id"`
-	Kind  string `json:"kind"`
-	LogID string `json:"logID"`
-	Data  string `json:"data"`
+// queuedEntry is an entry waiting in a bundler.
+type queuedEntry struct {
+	batch.Entry
+
+	// size is the length of the JSON encoding of the entry, as counted by
+	// the bundler.
+	size int
+}
+
+// ingestBucket is the part of *s3.Client the ingestion server uses.
+type ingestBucket interface {
+	objectPutter
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 }
 
 type Server struct {
-	s3c      *s3.Client
-	bundlers map[string]*bundler.Bundler[LogEntry]
+	s3c        ingestBucket
+	bucket     string
+	bundlers   map[string]*bundler.Bundler[queuedEntry]
+	buffered   map[string]*atomic.Int64
+	limits     *uploadLimits
+	sinks      *fanout
+	schemas    *schemaValidator
+	tails      *tailHub
+	directives *directiveStore
 }
 
 // NewServer creates a new Server with configured bundlers for each kind
-func NewServer(s3c *s3.Client, bucket string) *Server {
+func NewServer(s3c ingestBucket, bucket string) *Server {
 	s := &Server{
 		s3c:      s3c,
-		bundlers: make(map[string]*bundler.Bundler[LogEntry]),
+		bucket:   bucket,
+		bundlers: make(map[string]*bundler.Bundler[queuedEntry]),
+		buffered: make(map[string]*atomic.Int64),
 	}
 
 	// Create a bundler for each known kind
 	for _, kind := range knownKinds {
-		b := bundler.New[LogEntry](func(ctx context.Context, items []LogEntry) {
+		b := bundler.New[queuedEntry](func(ctx context.Context, items []queuedEntry) {
+			size := 0
+			for _, item := range items {
+				size += item.size
+			}
+			defer s.trackBuffered(kind, -size)
+
 			if err := s.uploadBatch(ctx, bucket, items); err != nil {
 				slog.Error("failed to upload batch", "kind", kind, "err", err)
 			}
@@ -62,65 +87,348 @@ func NewServer(s3c *s3.Client, bucket string) *Server {
 		b.HandlerLimit = 1               // one handler at a time
 
 		s.bundlers[kind] = b
+		s.buffered[kind] = new(atomic.Int64)
 	}
 
 	return s
 }
 
+// trackBuffered records bytes entering (positive delta) or leaving (negative
+// delta) a kind's bundler.
+func (s *Server) trackBuffered(kind string, delta int) {
+	n := s.buffered[kind].Add(int64(delta))
+	bundlerBufferedBytes.WithLabelValues(kind).Set(float64(n))
+}
+
 func (s *Server) Index(w http.ResponseWriter, r *http.Request) {}
 
 func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
 	kind := r.PathValue("kind")
-	logID := r.PathValue("logID")
-	slog.Info("got request for", "kind", kind, "logID", logID)
+	slog.Info("got request for", "kind", kind, "logID", r.PathValue("logID"))
 
-	if !slices.Contains(knownKinds, kind) {
-		slog.Error("unknown kind", "kind", kind)
+	w.Header().Set(alexandria.HeaderProtocols, supportedProtocols)
+
+	logID, ok := s.admit(w, r, kind, r.PathValue("logID"))
+	if !ok {
 		return
 	}
+	s.setDirectives(w, r, kind, logID)
 
 	defer r.Body.Close()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		slog.Error("can't read from client", "err", err)
+		s.rejectRead(err)
 		return
 	}
 
-	if err := s.uploadFor(r.Context(), kind, logID, data); err != nil {
+	if !s.withinQuota(w, kind, logID, len(data)) {
+		return
+	}
+
+	var meta *alexandria.Metadata
+	if md := alexandria.MetadataFromHeaders(r.Header); !md.IsZero() {
+		meta = &md
+	}
+
+	if err := s.uploadFor(r.Context(), kind, logID, meta, data); err != nil {
 		slog.Error("can't publish logs", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBundler).Inc()
 		return
 	}
+
+	uploadsTotal.WithLabelValues(kind).Inc()
+	uploadBytesTotal.WithLabelValues(kind).Add(float64(len(data)))
 }
 
-func (s *Server) uploadFor(ctx context.Context, kind, logID string, data []byte) error {
-	// Get the bundler for this specific kind
-	bundler, exists := s.bundlers[kind]
-	if !exists {
-		return fmt.Errorf("no bundler found for kind: %s", kind)
+// rejection explains why an upload was refused.
+type rejection struct {
+	reason     string
+	status     int
+	retryAfter time.Duration
+	err        error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+// check decides whether an upload from ip for kind and rawLogID may proceed.
+// It returns the canonical logID.
+func (s *Server) check(kind, rawLogID, ip string) (string, *rejection) {
+	logID, rej := s.validate(kind, rawLogID)
+	if rej != nil {
+		return "", rej
+	}
+
+	if _, rej := s.limit(logID, ip); rej != nil {
+		return "", rej
+	}
+
+	return logID, nil
+}
+
+// validate checks that kind is stored and returns the canonical form of
+// rawLogID.
+func (s *Server) validate(kind, rawLogID string) (string, *rejection) {
+	if !slices.Contains(knownKinds, kind) {
+		slog.Error("unknown kind", "kind", kind)
+		return "", &rejection{reason: rejectUnknownKind, status: http.StatusBadRequest, err: fmt.Errorf("unknown kind %q", kind)}
+	}
+
+	logID, err := alexandria.CanonicalLogID(rawLogID)
+	if err != nil {
+		slog.Error("invalid logID", "kind", kind, "err", err)
+		return "", &rejection{reason: rejectInvalidLogID, status: http.StatusBadRequest, err: err}
+	}
+
+	return logID, nil
+}
+
+// limit takes a request token from ip and logID. It returns a function that
+// puts them back for when a later check rejects the request.
+func (s *Server) limit(logID, ip string) (func(), *rejection) {
+	if s.limits == nil {
+		return func() {}, nil
+	}
+
+	now := time.Now()
+
+	undoIP, ok, retryAfter := s.limits.byIP.reserve(ip, 1, now)
+	if !ok {
+		slog.Debug("client IP rate limited", "ip", ip, "logID", logID)
+		return nil, &rejection{reason: rejectRateLimited, status: http.StatusTooManyRequests, retryAfter: retryAfter, err: errors.New("rate limited")}
+	}
+
+	undoLogID, ok, retryAfter := s.limits.byLogID.reserve(logID, 1, now)
+	if !ok {
+		// Rejected uploads shouldn't use up the allowance of everyone
+		// else behind the same IP
+		undoIP()
+		slog.Debug("logID rate limited", "ip", ip, "logID", logID)
+		return nil, &rejection{reason: rejectRateLimited, status: http.StatusTooManyRequests, retryAfter: retryAfter, err: errors.New("rate limited")}
 	}
 
-	// Create log entry with UUIDv7, kind, logID, and base64 encoded data
-	id := uuid.Must(uuid.NewV7()).String()
-	encodedData := base64.StdEncoding.EncodeToString(data)
+	return func() {
+		undoLogID()
+		undoIP()
+	}, nil
+}
+
+// checkQuota takes size bytes from logID's quota for kind. Uploads larger
+// than the quota can ever allow are refused with 413 rather than 429, so
+// that clients don't retry them forever.
+func (s *Server) checkQuota(kind, logID string, size int) *rejection {
+	_, rej := s.reserveQuota(kind, logID, size)
+	return rej
+}
+
+// reserveQuota is checkQuota, but also returns a function that puts the
+// bytes back for when a later check rejects the request.
+func (s *Server) reserveQuota(kind, logID string, size int) (func(), *rejection) {
+	if s.limits == nil {
+		return func() {}, nil
+	}
+
+	kl := s.limits.byKind[kind]
+	if kl.tooLarge(size) {
+		slog.Debug("upload larger than quota", "kind", kind, "logID", logID, "size", size, "quota", kl.burst)
+		return nil, &rejection{reason: rejectTooLarge, status: http.StatusRequestEntityTooLarge, err: fmt.Errorf("upload of %d bytes is larger than the %d byte quota for %s", size, kl.burst, kind)}
+	}
 
-	entry := LogEntry{
-		ID:    id,
+	undo, ok, retryAfter := kl.reserve(logID, size, time.Now())
+	if !ok {
+		slog.Debug("upload quota exceeded", "kind", kind, "logID", logID, "size", size)
+		return nil, &rejection{reason: rejectQuota, status: http.StatusTooManyRequests, retryAfter: retryAfter, err: errors.New("upload quota exceeded")}
+	}
+
+	return undo, nil
+}
+
+// admit is check for HTTP handlers, writing an error response on rejection.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, kind, rawLogID string) (string, bool) {
+	ip := r.RemoteAddr
+	if s.limits != nil {
+		ip = s.limits.clientIP(r)
+	}
+
+	logID, rej := s.check(kind, rawLogID, ip)
+	if rej != nil {
+		s.reject(w, rej)
+		return "", false
+	}
+
+	return logID, true
+}
+
+// admittedEnvelope is an envelope that passed every check, with its
+// canonical logID.
+type admittedEnvelope struct {
+	env   *alexandria.Envelope
+	logID string
+}
+
+// quotaKey is a logID's quota for one kind.
+type quotaKey struct {
+	kind, logID string
+}
+
+// admitAll checks every envelope of a request from ip before any is
+// ingested. Envelopes refused for good, such as those of unknown kinds, are
+// left out and their rejections returned. The request takes one request
+// token per distinct logID and its envelopes' total size from each quota.
+// If any of those are rate limited, over quota or larger than a quota, that
+// rejection is returned as limited, every token taken is put back and
+// nothing should be ingested, so that the client can retry the whole request
+// without storing its first envelopes twice.
+func (s *Server) admitAll(envs []*alexandria.Envelope, ip string) (admitted []admittedEnvelope, refused []*rejection, limited *rejection) {
+	var undos []func()
+	refund := func() {
+		for _, undo := range undos {
+			undo()
+		}
+	}
+
+	limitedIDs := map[string]bool{}
+	var quotas []quotaKey
+	sizes := map[quotaKey]int{}
+	for _, env := range envs {
+		logID, rej := s.validate(env.Kind, env.LogID)
+		if rej != nil {
+			rejectedRequestsTotal.WithLabelValues(rej.reason).Inc()
+			refused = append(refused, rej)
+			continue
+		}
+
+		if !limitedIDs[logID] {
+			undo, rej := s.limit(logID, ip)
+			if rej != nil {
+				refund()
+				return nil, nil, rej
+			}
+			undos = append(undos, undo)
+			limitedIDs[logID] = true
+		}
+
+		key := quotaKey{kind: env.Kind, logID: logID}
+		if _, ok := sizes[key]; !ok {
+			quotas = append(quotas, key)
+		}
+		sizes[key] += envelopeSize(env)
+		admitted = append(admitted, admittedEnvelope{env: env, logID: logID})
+	}
+
+	for _, key := range quotas {
+		undo, rej := s.reserveQuota(key.kind, key.logID, sizes[key])
+		if rej != nil {
+			refund()
+			return nil, nil, rej
+		}
+		undos = append(undos, undo)
+	}
+
+	return admitted, refused, nil
+}
+
+// ingestAll ingests admitted envelopes in order until one fails, and returns
+// how many were ingested.
+func (s *Server) ingestAll(admitted []admittedEnvelope) (int, error) {
+	for i, ae := range admitted {
+		if err := s.ingestEnvelope(ae.env, ae.logID); err != nil {
+			slog.Error("can't publish logs", "err", err)
+			rejectedRequestsTotal.WithLabelValues(rejectBundler).Inc()
+			return i, err
+		}
+	}
+
+	return len(admitted), nil
+}
+
+// withinQuota is checkQuota for HTTP handlers, writing an error response on
+// rejection.
+func (s *Server) withinQuota(w http.ResponseWriter, kind, logID string, size int) bool {
+	if rej := s.checkQuota(kind, logID, size); rej != nil {
+		s.reject(w, rej)
+		return false
+	}
+
+	return true
+}
+
+// reject records rej and writes it as an HTTP response.
+func (s *Server) reject(w http.ResponseWriter, rej *rejection) {
+	rejectedRequestsTotal.WithLabelValues(rej.reason).Inc()
+
+	switch {
+	case rej.reason == rejectUnknownKind:
+		// Legacy clients get a silent success for kinds we don't store
+	case rej.status == http.StatusTooManyRequests:
+		rateLimited(w, rej.retryAfter)
+	default:
+		http.Error(w, rej.Error(), rej.status)
+	}
+}
+
+// rejectRead records a failure to read a request body.
+func (s *Server) rejectRead(err error) {
+	slog.Error("can't read from client", "err", err)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		rejectedRequestsTotal.WithLabelValues(rejectTooLarge).Inc()
+	} else {
+		rejectedRequestsTotal.WithLabelValues(rejectReadError).Inc()
+	}
+}
+
+func (s *Server) uploadFor(ctx context.Context, kind, logID string, meta *alexandria.Metadata, data []byte) error {
+	entry := batch.Entry{
 		Kind:  kind,
 		LogID: logID,
-		Data:  encodedData,
+		Meta:  meta,
 	}
+	entry.SetData(data)
+
+	return s.enqueue(entry)
+}
+
+// enqueue validates entry against its kind's schema, assigns it an ID and
+// adds it to its kind's bundler.
+func (s *Server) enqueue(entry batch.Entry) error {
+	// Get the bundler for this specific kind
+	bundler, exists := s.bundlers[entry.Kind]
+	if !exists {
+		return fmt.Errorf("no bundler found for kind: %s", entry.Kind)
+	}
+
+	keep, err := s.schemas.apply(&entry)
+	if err != nil {
+		return fmt.Errorf("can't validate log entry: %w", err)
+	}
+	if !keep {
+		slog.Debug("dropping entry with no valid lines", "kind", entry.Kind, "logID", entry.LogID)
+		return nil
+	}
+
+	entry.ID = uuid.Must(uuid.NewV7()).String()
 
 	// Add to the kind-specific bundler - the size is the length of the JSON representation
 	jsonData, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("failed to marshal log entry: %w", err)
 	}
+	size := len(jsonData)
+
+	if err := bundler.Add(queuedEntry{Entry: entry, size: size}, size); err != nil {
+		return err
+	}
 
-	return bundler.Add(entry, len(jsonData))
+	s.trackBuffered(entry.Kind, size)
+	s.sinks.publishEntry(entry)
+	s.tails.publish(entry)
+	return nil
 }
 
 // uploadBatch handles a batch of log entries, writing them as a JSONL file to S3
-func (s *Server) uploadBatch(ctx context.Context, bucket string, items []LogEntry) error {
+func (s *Server) uploadBatch(ctx context.Context, bucket string, items []queuedEntry) error {
 	if len(items) == 0 {
 		return nil
 	}
@@ -130,7 +438,7 @@ func (s *Server) uploadBatch(ctx context.Context, bucket string, items []LogEntr
 
 	// Write each log entry as a separate line
 	for _, item := range items {
-		jsonLine, err := json.Marshal(item)
+		jsonLine, err := json.Marshal(item.Entry)
 		if err != nil {
 			return fmt.Errorf("failed to marshal log entry: %w", err)
 		}
@@ -142,19 +450,27 @@ func (s *Server) uploadBatch(ctx context.Context, bucket string, items []LogEntr
 	batchID := uuid.Must(uuid.NewV7()).String()
 	kind := items[0].Kind // Use the kind from the first item
 
+	batchItems.WithLabelValues(kind).Observe(float64(len(items)))
+	batchBytes.WithLabelValues(kind).Observe(float64(buf.Len()))
+	size := buf.Len()
+
 	// Upload the batch to S3
-	key := fmt.Sprintf("inp/%s/batch-%s.jsonl", kind, batchID)
+	key := batch.Key(kind, batchID)
+	start := time.Now()
 	_, err := s.s3c.PutObject(ctx, &s3.PutObjectInput{
 		Body:        &buf,
 		Bucket:      aws.String(bucket),
 		Key:         aws.String(key),
 		ContentType: aws.String("application/jsonl"),
 	})
+	s3PutDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		s3PutFailuresTotal.WithLabelValues(kind).Inc()
 		return fmt.Errorf("failed to upload batch to S3: %w", err)
 	}
 
-	slog.Info("uploaded batch of logs", "batchID", batchID, "kind", kind, "items", len(items), "size", buf.Len(), "key", key)
+	slog.Info("uploaded batch of logs", "batchID", batchID, "kind", kind, "items", len(items), "size", size, "key", key)
+	s.sinks.publishBatch(kind, batchRef{ID: batchID, Bucket: bucket, Key: key, Items: len(items), Size: size})
 	return nil
 }
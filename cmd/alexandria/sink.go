@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+var (
+	sinkEvents        = flag.String("sink-events", "batch", "comma-separated events to publish to sinks: entry, batch")
+	sinkWebhookURL    = flag.String("sink-webhook-url", "", "URL to POST sink events to, empty to disable")
+	sinkWebhookSecret = flag.String("sink-webhook-secret", "", "secret used to sign webhook sink requests")
+	sinkNATSURL       = flag.String("sink-nats-url", "", "NATS server to publish sink events to, empty to disable")
+	sinkNATSSubject   = flag.String("sink-nats-subject", "alexandria", "subject prefix for NATS sink events")
+)
+
+// Types of sink events.
+const (
+	// sinkEventEntry is published when a log entry is accepted, before it
+	// is batched.
+	sinkEventEntry = "entry"
+
+	// sinkEventBatch is published when a batch has been written to the
+	// bucket.
+	sinkEventBatch = "batch"
+
+	// sinkEventFinding is published by the analyze worker for each
+	// finding.
+	sinkEventFinding = "finding"
+)
+
+const (
+	// sinkQueueSize is how many events may wait for each sink before new
+	// ones are dropped.
+	sinkQueueSize = 1024
+
+	// sinkTimeout bounds how long a sink may spend publishing one event.
+	sinkTimeout = 10 * time.Second
+)
+
+// sinkEvent is what sinks publish, encoded as JSON.
+type sinkEvent struct {
+	Type  string       `json:"type"`
+	Time  time.Time    `json:"time"`
+	Kind  string       `json:"kind"`
+	Entry *batch.Entry `json:"entry,omitempty"`
+	Batch *batchRef    `json:"batch,omitempty"`
+
+	Finding *finding `json:"finding,omitempty"`
+}
+
+// batchRef points at a batch in the bucket.
+type batchRef struct {
+	ID     string `json:"id"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Items  int    `json:"items"`
+	Size   int    `json:"size"`
+}
+
+// sink publishes events to a secondary consumer.
+type sink interface {
+	Name() string
+	Publish(ctx context.Context, ev *sinkEvent) error
+}
+
+// fanout publishes events to every configured sink. Each sink has its own
+// queue and goroutine so a slow sink can't hold up ingestion or the others;
+// events for a sink whose queue is full are dropped.
+//
+// A nil *fanout publishes nothing.
+type fanout struct {
+	entries bool
+	batches bool
+	queues  []sinkQueue
+}
+
+type sinkQueue struct {
+	name   string
+	events chan *sinkEvent
+}
+
+func newFanout(events []string, sinks ...sink) (*fanout, error) {
+	result := &fanout{}
+	for _, ev := range events {
+		switch strings.TrimSpace(ev) {
+		case sinkEventEntry:
+			result.entries = true
+		case sinkEventBatch:
+			result.batches = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown sink event %q", ev)
+		}
+	}
+
+	for _, sk := range sinks {
+		queue := sinkQueue{name: sk.Name(), events: make(chan *sinkEvent, sinkQueueSize)}
+		result.queues = append(result.queues, queue)
+		go runSink(sk, queue.events)
+	}
+
+	return result, nil
+}
+
+// newFanoutFromFlags builds the sinks configured by flags. It returns nil if
+// there are none.
+func newFanoutFromFlags() (*fanout, error) {
+	var sinks []sink
+
+	if *sinkWebhookURL != "" {
+		sinks = append(sinks, newWebhookSink(*sinkWebhookURL, *sinkWebhookSecret))
+	}
+
+	if *sinkNATSURL != "" {
+		ns, err := newNATSSink(*sinkNATSURL, *sinkNATSSubject)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, ns)
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	return newFanout(strings.Split(*sinkEvents, ","), sinks...)
+}
+
+func runSink(sk sink, queue <-chan *sinkEvent) {
+	for ev := range queue {
+		ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+		err := sk.Publish(ctx, ev)
+		cancel()
+
+		if err != nil {
+			slog.Error("can't publish to sink", "sink", sk.Name(), "type", ev.Type, "kind", ev.Kind, "err", err)
+			sinkEventsTotal.WithLabelValues(sk.Name(), "error").Inc()
+			continue
+		}
+
+		sinkEventsTotal.WithLabelValues(sk.Name(), "ok").Inc()
+	}
+}
+
+func (f *fanout) publish(ev *sinkEvent) {
+	for _, queue := range f.queues {
+		select {
+		case queue.events <- ev:
+		default:
+			sinkEventsTotal.WithLabelValues(queue.name, "dropped").Inc()
+		}
+	}
+}
+
+// publishEntry publishes an accepted entry, if entry events are enabled.
+func (f *fanout) publishEntry(entry batch.Entry) {
+	if f == nil || !f.entries {
+		return
+	}
+
+	f.publish(&sinkEvent{
+		Type:  sinkEventEntry,
+		Time:  time.Now().UTC(),
+		Kind:  entry.Kind,
+		Entry: &entry,
+	})
+}
+
+// publishBatch publishes a stored batch, if batch events are enabled.
+func (f *fanout) publishBatch(kind string, ref batchRef) {
+	if f == nil || !f.batches {
+		return
+	}
+
+	f.publish(&sinkEvent{
+		Type:  sinkEventBatch,
+		Time:  time.Now().UTC(),
+		Kind:  kind,
+		Batch: &ref,
+	})
+}
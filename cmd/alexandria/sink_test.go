@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+// chanSink hands published events to a channel.
+type chanSink chan *sinkEvent
+
+func (cs chanSink) Name() string { return "chan" }
+
+func (cs chanSink) Publish(_ context.Context, ev *sinkEvent) error {
+	cs <- ev
+	return nil
+}
+
+func TestFanout(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "batches only",
+			events:   []string{"batch"},
+			expected: []string{sinkEventBatch},
+		},
+		{
+			name:     "entries and batches",
+			events:   []string{"entry", " batch"},
+			expected: []string{sinkEventEntry, sinkEventBatch},
+		},
+		{
+			name:    "unknown event",
+			events:  []string{"object"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := make(chanSink, 4)
+			f, err := newFanout(tt.events, cs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			f.publishEntry(batch.Entry{Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"})
+			f.publishBatch("techaro.anubis", batchRef{ID: "batch", Key: "inp/techaro.anubis/batch-batch.jsonl"})
+
+			for _, want := range tt.expected {
+				select {
+				case ev := <-cs:
+					if ev.Type != want {
+						t.Errorf("expected %s event, got %s", want, ev.Type)
+					}
+					if ev.Kind != "techaro.anubis" {
+						t.Errorf("expected kind techaro.anubis, got %s", ev.Kind)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("timed out waiting for %s event", want)
+				}
+			}
+
+			select {
+			case ev := <-cs:
+				t.Errorf("unexpected %s event", ev.Type)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestFanout_Nil(t *testing.T) {
+	var f *fanout
+	f.publishEntry(batch.Entry{})
+	f.publishBatch("techaro.anubis", batchRef{})
+}
+
+func TestFanout_DropsWhenFull(t *testing.T) {
+	// An unbuffered sink blocks after taking the first event off its queue
+	cs := make(chanSink)
+	f, err := newFanout([]string{"batch"}, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for range sinkQueueSize + 10 {
+			f.publishBatch("techaro.anubis", batchRef{})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a full sink queue")
+	}
+}
+
+func TestNATSSubject(t *testing.T) {
+	got := natsSubject("alexandria", &sinkEvent{Type: sinkEventBatch, Kind: "techaro.anubis"})
+	if want := "alexandria.batch.techaro.anubis"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
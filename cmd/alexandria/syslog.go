@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+)
+
+var (
+	syslogUDPBind = flag.String("syslog-udp-bind", "", "host:port to receive syslog over UDP on, empty to disable")
+	syslogTCPBind = flag.String("syslog-tcp-bind", "", "host:port to receive syslog over TCP on, empty to disable")
+	syslogTLSBind = flag.String("syslog-tls-bind", "", "host:port to receive syslog over TLS on, empty to disable")
+	syslogTLSCert = flag.String("syslog-tls-cert", "", "TLS certificate file for syslog-tls-bind")
+	syslogTLSKey  = flag.String("syslog-tls-key", "", "TLS key file for syslog-tls-bind")
+	syslogKinds   = flag.String("syslog-kinds", "", "kinds to store syslog app names as, as app=kind,app=kind; * matches any app")
+)
+
+const (
+	// syslogMaxMessageSize is the largest syslog message accepted.
+	syslogMaxMessageSize = maxLogSize
+
+	// syslogFlushInterval is how often buffered syslog messages are stored.
+	syslogFlushInterval = 5 * time.Second
+
+	// syslogIdleTimeout is how long a TCP sender may stay silent before it
+	// is disconnected.
+	syslogIdleTimeout = 10 * time.Minute
+)
+
+// syslogMaxLengthDigits is how many digits the length of an octet-counted
+// frame may have.
+var syslogMaxLengthDigits = len(strconv.Itoa(syslogMaxMessageSize))
+
+var (
+	errSyslogNoPriority = errors.New("syslog: message doesn't start with a priority")
+	errSyslogTooLarge   = errors.New("syslog: message too large")
+)
+
+// syslogMessage is a parsed RFC 5424 or RFC 3164 message. Fields the sender
+// left out are empty.
+type syslogMessage struct {
+	Facility int
+	Severity int
+	Time     time.Time
+	Hostname string
+	AppName  string
+	ProcID   string
+	MsgID    string
+
+	// StructuredData maps SD-IDs to their parameters (RFC 5424 only).
+	StructuredData map[string]map[string]string
+	Msg            string
+}
+
+// parseSyslog parses an RFC 5424 message, falling back to RFC 3164 for
+// anything that doesn't look like one. now fills in the year RFC 3164
+// timestamps lack and the time of messages without one.
+func parseSyslog(data []byte, now time.Time) (syslogMessage, error) {
+	var result syslogMessage
+
+	line := strings.TrimRight(string(data), "\r\n\x00")
+	if !utf8.ValidString(line) {
+		line = strings.ToValidUTF8(line, "\ufffd")
+	}
+
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return result, errSyslogNoPriority
+	}
+
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return result, errSyslogNoPriority
+	}
+	result.Facility = pri / 8
+	result.Severity = pri % 8
+
+	rest := line[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		if err := parseRFC5424(&result, rest[2:]); err != nil {
+			return result, err
+		}
+	} else {
+		parseRFC3164(&result, rest, now)
+	}
+
+	if result.Time.IsZero() {
+		result.Time = now
+	}
+
+	return result, nil
+}
+
+// parseRFC5424 parses everything after the version of an RFC 5424 message.
+func parseRFC5424(m *syslogMessage, rest string) error {
+	var fields [5]string
+	for i := range fields {
+		var ok bool
+		fields[i], rest, ok = strings.Cut(rest, " ")
+		if !ok {
+			return fmt.Errorf("syslog: truncated RFC 5424 header")
+		}
+	}
+
+	if fields[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("syslog: can't parse timestamp: %w", err)
+		}
+		m.Time = t.UTC()
+	}
+
+	m.Hostname = nilValue(fields[1])
+	m.AppName = nilValue(fields[2])
+	m.ProcID = nilValue(fields[3])
+	m.MsgID = nilValue(fields[4])
+
+	sd, rest, err := parseStructuredData(rest)
+	if err != nil {
+		return err
+	}
+	m.StructuredData = sd
+
+	rest = strings.TrimPrefix(rest, " ")
+	m.Msg = strings.TrimPrefix(rest, "\ufeff")
+	return nil
+}
+
+// parseStructuredData parses RFC 5424 STRUCTURED-DATA from the start of s and
+// returns what follows it.
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		return nil, rest, nil
+	}
+
+	result := map[string]map[string]string{}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd <= 0 {
+			return nil, "", fmt.Errorf("syslog: malformed structured data")
+		}
+		params := map[string]string{}
+		result[s[:idEnd]] = params
+		s = s[idEnd:]
+
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+
+			name, _, ok := strings.Cut(s, `="`)
+			if !ok || name == "" {
+				return nil, "", fmt.Errorf("syslog: malformed structured data parameter")
+			}
+
+			var sb strings.Builder
+			i := len(name) + 2
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, "", fmt.Errorf("syslog: unterminated structured data value")
+			}
+
+			params[name] = sb.String()
+			s = s[i+1:]
+		}
+
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", fmt.Errorf("syslog: unterminated structured data element")
+		}
+		s = s[1:]
+	}
+
+	if len(result) == 0 {
+		return nil, "", fmt.Errorf("syslog: missing structured data")
+	}
+
+	return result, s, nil
+}
+
+// parseRFC3164 parses everything after the priority of a BSD syslog message.
+// RFC 3164 only describes common practice, so this is lenient: a message
+// without a recognizable timestamp is kept whole.
+func parseRFC3164(m *syslogMessage, rest string, now time.Time) {
+	if len(rest) < len(time.Stamp)+1 || rest[len(time.Stamp)] != ' ' {
+		m.Msg = rest
+		return
+	}
+
+	t, err := time.ParseInLocation(time.Stamp, rest[:len(time.Stamp)], time.UTC)
+	if err != nil {
+		m.Msg = rest
+		return
+	}
+
+	// The year is missing, so pick the one that puts the message closest to
+	// now. Messages from just before New Year's arrive just after it.
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.AddDate(0, 0, 1)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	m.Time = t
+	rest = rest[len(time.Stamp)+1:]
+
+	// HOSTNAME is optional in practice; a token ending in ':' or containing
+	// '[' is the tag.
+	if host, after, ok := strings.Cut(rest, " "); ok && !strings.HasSuffix(host, ":") && !strings.Contains(host, "[") {
+		m.Hostname = host
+		rest = after
+	}
+
+	tag, msg, ok := strings.Cut(rest, ": ")
+	if !ok || strings.Contains(tag, " ") {
+		m.Msg = rest
+		return
+	}
+
+	if name, pid, ok := strings.Cut(tag, "["); ok {
+		m.AppName = name
+		m.ProcID = strings.TrimSuffix(pid, "]")
+	} else {
+		m.AppName = tag
+	}
+	m.Msg = msg
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// syslogFacilities are the RFC 5424 facility names, indexed by code.
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// level maps the message's syslog severity onto slog levels. Emergency,
+// alert and critical are all above ERROR, like OTLP's FATAL.
+func (m syslogMessage) level() slog.Level {
+	switch m.Severity {
+	case 0, 1, 2:
+		return slog.LevelError + 4
+	case 3:
+		return slog.LevelError
+	case 4:
+		return slog.LevelWarn
+	case 7:
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// line renders the message as a slog-style JSON line.
+func (m syslogMessage) line() []byte {
+	line := map[string]any{
+		"time":     m.Time,
+		"level":    m.level().String(),
+		"msg":      m.Msg,
+		"facility": syslogFacilities[m.Facility],
+	}
+	if m.Hostname != "" {
+		line["host"] = m.Hostname
+	}
+	if m.AppName != "" {
+		line["app"] = m.AppName
+	}
+	if m.ProcID != "" {
+		line["procid"] = m.ProcID
+	}
+	if m.MsgID != "" {
+		line["msgid"] = m.MsgID
+	}
+	if len(m.StructuredData) != 0 {
+		line["sd"] = m.StructuredData
+	}
+
+	// every value is a string, a time or a map of strings, so this can't fail
+	data, _ := json.Marshal(line)
+	return append(data, '\n')
+}
+
+// syslogSource identifies the log stream a syslog message belongs to.
+type syslogSource struct {
+	kind  string
+	logID string
+}
+
+type syslogBatch struct {
+	ip   string
+	meta alexandria.Metadata
+	buf  bytes.Buffer
+}
+
+// syslogListener receives syslog messages and stores them through uploadFor.
+//
+// Messages are routed to a kind by app name. Each sender host and app name
+// pair gets a stable logID, and its messages are batched for up to
+// syslogFlushInterval so that a chatty sender makes one upload rather than
+// one per line.
+type syslogListener struct {
+	s     *Server
+	kinds map[string]string
+
+	mu      sync.Mutex
+	pending map[syslogSource]*syslogBatch
+}
+
+func newSyslogListener(s *Server, kinds map[string]string) *syslogListener {
+	return &syslogListener{
+		s:       s,
+		kinds:   kinds,
+		pending: map[syslogSource]*syslogBatch{},
+	}
+}
+
+// parseSyslogKinds parses app=kind pairs and checks that every kind is known.
+func parseSyslogKinds(val string) (map[string]string, error) {
+	result := map[string]string{}
+	for pair := range strings.SplitSeq(val, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		app, kind, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form app=kind", pair)
+		}
+
+		app, kind = strings.TrimSpace(app), strings.TrimSpace(kind)
+		if !slices.Contains(knownKinds, kind) {
+			return nil, fmt.Errorf("%q: unknown kind %q", pair, kind)
+		}
+
+		result[app] = kind
+	}
+	return result, nil
+}
+
+// kindFor returns the kind to store app's messages as, or "" to drop them.
+func (sl *syslogListener) kindFor(app string) string {
+	if kind, ok := sl.kinds[app]; ok {
+		return kind
+	}
+	return sl.kinds["*"]
+}
+
+// syslogLogID derives a stable logID for a sender and app name.
+func syslogLogID(host, app string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + app))
+	return "syslog_" + hex.EncodeToString(sum[:8])
+}
+
+// handle parses one message from ip and adds it to its batch.
+func (sl *syslogListener) handle(data []byte, ip string) {
+	m, err := parseSyslog(data, time.Now().UTC())
+	if err != nil {
+		slog.Debug("can't parse syslog message", "ip", ip, "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBadMessage).Inc()
+		return
+	}
+
+	kind := sl.kindFor(m.AppName)
+	if kind == "" {
+		rejectedRequestsTotal.WithLabelValues(rejectUnknownKind).Inc()
+		return
+	}
+
+	host := m.Hostname
+	if host == "" {
+		host = ip
+	}
+
+	src := syslogSource{kind: kind, logID: syslogLogID(host, m.AppName)}
+	line := m.line()
+
+	sl.mu.Lock()
+	batch, ok := sl.pending[src]
+	if !ok {
+		hostHash := sha256.Sum256([]byte(host))
+		batch = &syslogBatch{
+			ip: ip,
+			meta: alexandria.Metadata{
+				Service:  m.AppName,
+				HostHash: hex.EncodeToString(hostHash[:8]),
+			},
+		}
+		sl.pending[src] = batch
+	}
+	batch.buf.Write(line)
+
+	full := batch.buf.Len() >= maxLogSize
+	if full {
+		delete(sl.pending, src)
+	}
+	sl.mu.Unlock()
+
+	if full {
+		sl.store(src, batch)
+	}
+}
+
+// flush stores every pending batch.
+func (sl *syslogListener) flush() {
+	sl.mu.Lock()
+	pending := sl.pending
+	sl.pending = map[syslogSource]*syslogBatch{}
+	sl.mu.Unlock()
+
+	for src, batch := range pending {
+		sl.store(src, batch)
+	}
+}
+
+func (sl *syslogListener) flushLoop() {
+	t := time.NewTicker(syslogFlushInterval)
+	defer t.Stop()
+
+	for range t.C {
+		sl.flush()
+	}
+}
+
+// store uploads batch as if src had PUT it over HTTP.
+func (sl *syslogListener) store(src syslogSource, batch *syslogBatch) {
+	slog.Info("got request for", "kind", src.kind, "logID", src.logID, "transport", "syslog")
+
+	logID, rej := sl.s.check(src.kind, src.logID, batch.ip)
+	if rej == nil {
+		rej = sl.s.checkQuota(src.kind, logID, batch.buf.Len())
+	}
+	if rej != nil {
+		rejectedRequestsTotal.WithLabelValues(rej.reason).Inc()
+		return
+	}
+
+	if err := sl.s.uploadFor(context.Background(), src.kind, logID, &batch.meta, batch.buf.Bytes()); err != nil {
+		slog.Error("can't publish logs", "err", err)
+		rejectedRequestsTotal.WithLabelValues(rejectBundler).Inc()
+		return
+	}
+
+	uploadsTotal.WithLabelValues(src.kind).Inc()
+	uploadBytesTotal.WithLabelValues(src.kind).Add(float64(batch.buf.Len()))
+}
+
+// ServeUDP reads one message per datagram from conn.
+func (sl *syslogListener) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, syslogMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		sl.handle(buf[:n], addrIP(addr))
+	}
+}
+
+// ServeTCP accepts connections from ln and reads messages framed as in
+// RFC 6587, either octet counted or newline terminated.
+func (sl *syslogListener) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go sl.serveConn(conn)
+	}
+}
+
+func (sl *syslogListener) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	ip := addrIP(conn.RemoteAddr())
+	// ReadSlice can only return lines that fit in the buffer
+	br := bufio.NewReaderSize(conn, syslogMaxMessageSize+1)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(syslogIdleTimeout))
+
+		msg, err := readSyslogFrame(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("closing syslog connection", "ip", ip, "err", err)
+			}
+			return
+		}
+
+		if len(bytes.TrimSpace(msg)) != 0 {
+			sl.handle(msg, ip)
+		}
+	}
+}
+
+// readSyslogFrame reads one message from br. Octet counted frames start with
+// their length; anything else runs to the next newline.
+func readSyslogFrame(br *bufio.Reader) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] < '1' || first[0] > '9' {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errSyslogTooLarge
+		}
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		return line, nil
+	}
+
+	// The length is read a digit at a time so that a client can't make us
+	// buffer an endless prefix
+	n := 0
+	for digits := 0; ; digits++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("syslog: invalid frame length character %q", c)
+		}
+		if digits == syslogMaxLengthDigits {
+			return nil, errSyslogTooLarge
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n > syslogMaxMessageSize {
+		return nil, errSyslogTooLarge
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// addrIP returns the IP address of a network address.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// serveSyslog starts the syslog listeners configured by flags, if any.
+func serveSyslog(s *Server) error {
+	if *syslogUDPBind == "" && *syslogTCPBind == "" && *syslogTLSBind == "" {
+		return nil
+	}
+
+	kinds, err := parseSyslogKinds(*syslogKinds)
+	if err != nil {
+		return fmt.Errorf("can't parse syslog-kinds: %w", err)
+	}
+	if len(kinds) == 0 {
+		return errors.New("syslog-kinds must map at least one app name to a kind")
+	}
+
+	sl := newSyslogListener(s, kinds)
+	go sl.flushLoop()
+
+	if *syslogUDPBind != "" {
+		conn, err := net.ListenPacket("udp", *syslogUDPBind)
+		if err != nil {
+			return fmt.Errorf("can't listen for syslog over UDP: %w", err)
+		}
+
+		slog.Info("listening for syslog over UDP", "bind", *syslogUDPBind)
+		go func() { log.Fatal(sl.ServeUDP(conn)) }()
+	}
+
+	if *syslogTCPBind != "" {
+		ln, err := net.Listen("tcp", *syslogTCPBind)
+		if err != nil {
+			return fmt.Errorf("can't listen for syslog over TCP: %w", err)
+		}
+
+		slog.Info("listening for syslog over TCP", "bind", *syslogTCPBind)
+		go func() { log.Fatal(sl.ServeTCP(ln)) }()
+	}
+
+	if *syslogTLSBind != "" {
+		cert, err := tls.LoadX509KeyPair(*syslogTLSCert, *syslogTLSKey)
+		if err != nil {
+			return fmt.Errorf("can't load syslog TLS certificate: %w", err)
+		}
+
+		ln, err := tls.Listen("tcp", *syslogTLSBind, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return fmt.Errorf("can't listen for syslog over TLS: %w", err)
+		}
+
+		slog.Info("listening for syslog over TLS", "bind", *syslogTLSBind)
+		go func() { log.Fatal(sl.ServeTCP(ln)) }()
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 30, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		data     string
+		expected syslogMessage
+		wantErr  bool
+	}{
+		{
+			name: "rfc5424",
+			data: `<165>1 2025-03-04T05:06:07.123Z edge01 haproxy 4242 ID47 - backend down`,
+			expected: syslogMessage{
+				Facility: 20,
+				Severity: 5,
+				Time:     time.Date(2025, 3, 4, 5, 6, 7, 123000000, time.UTC),
+				Hostname: "edge01",
+				AppName:  "haproxy",
+				ProcID:   "4242",
+				MsgID:    "ID47",
+				Msg:      "backend down",
+			},
+		},
+		{
+			name: "rfc5424 structured data",
+			data: `<14>1 - edge01 anubis - - [req@32473 path="/a\"b" status="200"][meta seq="1"] ` + "\ufeff" + `served`,
+			expected: syslogMessage{
+				Facility: 1,
+				Severity: 6,
+				Time:     now,
+				Hostname: "edge01",
+				AppName:  "anubis",
+				StructuredData: map[string]map[string]string{
+					"req@32473": {"path": `/a"b`, "status": "200"},
+					"meta":      {"seq": "1"},
+				},
+				Msg: "served",
+			},
+		},
+		{
+			name: "rfc5424 without message",
+			data: "<11>1 2025-03-04T05:06:07Z edge01 anubis 1 - -\n",
+			expected: syslogMessage{
+				Facility: 1,
+				Severity: 3,
+				Time:     time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC),
+				Hostname: "edge01",
+				AppName:  "anubis",
+				ProcID:   "1",
+			},
+		},
+		{
+			name: "rfc3164",
+			data: `<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed`,
+			expected: syslogMessage{
+				Facility: 4,
+				Severity: 2,
+				Time:     time.Date(2024, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname: "mymachine",
+				AppName:  "su",
+				ProcID:   "230",
+				Msg:      "'su root' failed",
+			},
+		},
+		{
+			name: "rfc3164 without hostname",
+			data: `<30>Jan  1 00:00:10 systemd: Started session`,
+			expected: syslogMessage{
+				Facility: 3,
+				Severity: 6,
+				Time:     time.Date(2025, 1, 1, 0, 0, 10, 0, time.UTC),
+				AppName:  "systemd",
+				Msg:      "Started session",
+			},
+		},
+		{
+			name: "rfc3164 without header",
+			data: `<13>just some text`,
+			expected: syslogMessage{
+				Facility: 1,
+				Severity: 5,
+				Time:     now,
+				Msg:      "just some text",
+			},
+		},
+		{
+			name:    "no priority",
+			data:    `hello`,
+			wantErr: true,
+		},
+		{
+			name:    "priority out of range",
+			data:    `<192>1 - - - - - -`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated rfc5424",
+			data:    `<14>1 - edge01`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated structured data",
+			data:    `<14>1 - edge01 anubis - - [req path="x`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSyslog([]byte(tt.data), now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.expected)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("expected %s, got %s", wantJSON, gotJSON)
+			}
+		})
+	}
+}
+
+func TestSyslogMessage_Line(t *testing.T) {
+	m := syslogMessage{
+		Facility: 20,
+		Severity: 1,
+		Time:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hostname: "edge01",
+		AppName:  "haproxy",
+		Msg:      "all backends down",
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(m.line(), &got); err != nil {
+		t.Fatalf("line isn't JSON: %v", err)
+	}
+
+	expected := map[string]any{
+		"time":     "2025-01-01T00:00:00Z",
+		"level":    (slog.LevelError + 4).String(),
+		"msg":      "all backends down",
+		"facility": "local4",
+		"host":     "edge01",
+		"app":      "haproxy",
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	input := "20 <14>1 - h a - - - hi20 <14>1 - h a - - - ho<13>plain text\n5 <13>x"
+
+	br := bufio.NewReader(strings.NewReader(input))
+	expected := []string{
+		"<14>1 - h a - - - hi",
+		"<14>1 - h a - - - ho",
+		"<13>plain text\n",
+		"<13>x",
+	}
+
+	for _, want := range expected {
+		got, err := readSyslogFrame(br)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+
+	if _, err := readSyslogFrame(br); err == nil {
+		t.Error("expected an error at end of input")
+	}
+
+	big := bufio.NewReader(strings.NewReader("999999999 <14>"))
+	if _, err := readSyslogFrame(big); err != errSyslogTooLarge {
+		t.Errorf("expected errSyslogTooLarge, got %v", err)
+	}
+
+	bad := bufio.NewReader(strings.NewReader("12a <14>"))
+	if _, err := readSyslogFrame(bad); err == nil || err == errSyslogTooLarge {
+		t.Errorf("expected an invalid length error, got %v", err)
+	}
+}
+
+// endlessDigits is a reader that never stops sending digits.
+type endlessDigits struct{}
+
+func (endlessDigits) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '1'
+	}
+	return len(p), nil
+}
+
+func TestReadSyslogFrame_EndlessLength(t *testing.T) {
+	br := bufio.NewReaderSize(endlessDigits{}, syslogMaxMessageSize+1)
+	if _, err := readSyslogFrame(br); err != errSyslogTooLarge {
+		t.Errorf("expected errSyslogTooLarge, got %v", err)
+	}
+}
+
+func TestParseSyslogKinds(t *testing.T) {
+	got, err := parseSyslogKinds("anubis=techaro.anubis, *=techaro.thoth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := newSyslogListener(nil, got)
+	if kind := sl.kindFor("anubis"); kind != "techaro.anubis" {
+		t.Errorf("expected techaro.anubis, got %q", kind)
+	}
+	if kind := sl.kindFor("haproxy"); kind != "techaro.thoth" {
+		t.Errorf("expected wildcard kind techaro.thoth, got %q", kind)
+	}
+
+	for _, bad := range []string{"anubis", "anubis=techaro.nope"} {
+		if _, err := parseSyslogKinds(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestSyslogListener_Batches(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	sl := newSyslogListener(s, map[string]string{"anubis": "techaro.anubis"})
+
+	sl.handle([]byte(`<14>1 - edge01 anubis - - - one`), "192.0.2.1")
+	sl.handle([]byte(`<14>1 - edge01 anubis - - - two`), "192.0.2.1")
+	sl.handle([]byte(`<14>1 - edge02 anubis - - - three`), "192.0.2.2")
+	sl.handle([]byte(`<14>1 - edge01 haproxy - - - dropped`), "192.0.2.1")
+	sl.handle([]byte(`garbage`), "192.0.2.1")
+
+	if len(sl.pending) != 2 {
+		t.Fatalf("expected 2 pending batches, got %d", len(sl.pending))
+	}
+
+	batch := sl.pending[syslogSource{kind: "techaro.anubis", logID: syslogLogID("edge01", "anubis")}]
+	if batch == nil {
+		t.Fatal("no batch for edge01")
+	}
+	if n := strings.Count(batch.buf.String(), "\n"); n != 2 {
+		t.Errorf("expected 2 lines in edge01's batch, got %d", n)
+	}
+	if batch.meta.Service != "anubis" || batch.meta.HostHash == "" {
+		t.Errorf("unexpected metadata %+v", batch.meta)
+	}
+
+	if _, err := alexandria.CanonicalLogID(syslogLogID("edge01", "anubis")); err != nil {
+		t.Errorf("derived logID isn't valid: %v", err)
+	}
+
+	sl.flush()
+
+	if len(sl.pending) != 0 {
+		t.Errorf("expected flush to empty pending batches, %d left", len(sl.pending))
+	}
+	if s.buffered["techaro.anubis"].Load() == 0 {
+		t.Error("expected batches to reach the bundler")
+	}
+}
+
+func TestSyslogListener_FlushesFullBatch(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	sl := newSyslogListener(s, map[string]string{"*": "techaro.anubis"})
+
+	msg := []byte(`<14>1 - edge01 anubis - - - ` + base64.StdEncoding.EncodeToString(make([]byte, 1024)))
+	for range maxLogSize/1024 + 1 {
+		sl.handle(msg, "192.0.2.1")
+	}
+
+	if s.buffered["techaro.anubis"].Load() == 0 {
+		t.Error("expected a full batch to be stored without waiting for a flush")
+	}
+}
+
+func TestSyslogListener_ServeConnLargeMessage(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	sl := newSyslogListener(s, map[string]string{"anubis": "techaro.anubis"})
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		sl.serveConn(server)
+		close(done)
+	}()
+
+	big := strings.Repeat("x", 5000)
+	client.Write([]byte("<14>1 - edge01 anubis - - - " + big + "\n<14>1 - edge01 anubis - - - small\n"))
+	client.Close()
+	<-done
+
+	batch := sl.pending[syslogSource{kind: "techaro.anubis", logID: syslogLogID("edge01", "anubis")}]
+	if batch == nil {
+		t.Fatal("no batch for edge01")
+	}
+	if !strings.Contains(batch.buf.String(), big) {
+		t.Error("expected the message over 4 KiB to be kept")
+	}
+	if n := strings.Count(batch.buf.String(), "\n"); n != 2 {
+		t.Errorf("expected 2 lines, got %d", n)
+	}
+}
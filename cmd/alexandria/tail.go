@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TecharoHQ/alexandria/alexandria"
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+	"github.com/facebookgo/flagenv"
+)
+
+var (
+	tailToken  = flag.String("tail-token", "", "token tail clients must send as a bearer token or basic auth password, empty to disable tailing")
+	tailBuffer = flag.Int("tail-buffer", 256, "entries buffered for each tail client before new ones are dropped")
+)
+
+const (
+	// tailPath is where clients tail the entries of a logID as they are
+	// accepted.
+	tailPath = "/tail/{kind}/{logID}"
+
+	// tailHeartbeat is how often an idle tail stream gets a comment, so
+	// proxies don't close it.
+	tailHeartbeat = 15 * time.Second
+
+	// maxTailEvent bounds the size of an event the tail client reads.
+	maxTailEvent = 1 << 20
+)
+
+// tailSubscriber receives the entries of one logID.
+type tailSubscriber struct {
+	entries chan batch.Entry
+
+	// dropped counts the entries that didn't fit in the buffer.
+	dropped atomic.Int64
+}
+
+// tailBus carries accepted entries between the replicas of a deployment,
+// so that tail clients see the entries every replica accepts and not only
+// those of the replica they're connected to.
+type tailBus interface {
+	// publish sends entry to every replica subscribed to its logID,
+	// including this one.
+	publish(entry batch.Entry) error
+
+	// subscribe calls deliver with every entry of logID published by any
+	// replica until the returned function is called.
+	subscribe(kind, logID string, deliver func(batch.Entry)) (unsubscribe func(), err error)
+}
+
+// tailHub passes accepted entries to the tail clients of their logID. Each
+// subscriber has a bounded buffer; entries for a subscriber whose buffer is
+// full are dropped, so a slow client can't hold up ingestion.
+//
+// Without a bus, a hub only sees the entries its own replica accepts. With
+// one, it subscribes to the entries of a logID on the bus while it has a
+// subscriber for it.
+//
+// A nil *tailHub publishes nothing.
+type tailHub struct {
+	token   string
+	buffer  int
+	bus     tailBus
+	replica string
+
+	mu   sync.Mutex
+	subs map[string][]*tailSubscriber
+
+	// busMu serializes subscribing and unsubscribing, so that busSubs
+	// holds the bus subscription of every topic in subs.
+	busMu   sync.Mutex
+	busSubs map[string]func()
+}
+
+func newTailHub(token string, buffer int) *tailHub {
+	replica, _ := os.Hostname()
+	return &tailHub{
+		token:   token,
+		buffer:  buffer,
+		replica: replica,
+		subs:    map[string][]*tailSubscriber{},
+		busSubs: map[string]func(){},
+	}
+}
+
+// newTailHubFromFlags returns a tailHub, or nil if no tail token is set.
+// When a NATS sink is configured, entries are shared between replicas over
+// NATS.
+func newTailHubFromFlags() (*tailHub, error) {
+	if *tailToken == "" {
+		return nil, nil
+	}
+	if *tailBuffer < 1 {
+		return nil, fmt.Errorf("-tail-buffer must be positive, got %d", *tailBuffer)
+	}
+
+	h := newTailHub(*tailToken, *tailBuffer)
+	if *sinkNATSURL != "" {
+		bus, err := newNATSTailBus(*sinkNATSURL, *sinkNATSSubject)
+		if err != nil {
+			return nil, err
+		}
+		h.bus = bus
+	}
+
+	return h, nil
+}
+
+func tailTopic(kind, logID string) string {
+	return kind + "/" + logID
+}
+
+// subscribe starts buffering the entries of logID, subscribing to them on
+// the bus if it is the first subscriber for logID. Call unsubscribe when
+// done.
+func (h *tailHub) subscribe(kind, logID string) (*tailSubscriber, error) {
+	sub := &tailSubscriber{entries: make(chan batch.Entry, h.buffer)}
+	topic := tailTopic(kind, logID)
+
+	h.busMu.Lock()
+	defer h.busMu.Unlock()
+
+	if _, ok := h.busSubs[topic]; h.bus != nil && !ok {
+		unsubscribe, err := h.bus.subscribe(kind, logID, h.deliver)
+		if err != nil {
+			return nil, fmt.Errorf("can't subscribe to tailed entries: %w", err)
+		}
+		h.busSubs[topic] = unsubscribe
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[topic] = append(h.subs[topic], sub)
+	tailSubscribers.Inc()
+
+	return sub, nil
+}
+
+// unsubscribe stops buffering entries for sub, and unsubscribes from the
+// entries of logID on the bus if it was the last subscriber for logID.
+func (h *tailHub) unsubscribe(kind, logID string, sub *tailSubscriber) {
+	topic := tailTopic(kind, logID)
+
+	h.busMu.Lock()
+	defer h.busMu.Unlock()
+
+	h.mu.Lock()
+	h.subs[topic] = slices.DeleteFunc(h.subs[topic], func(s *tailSubscriber) bool { return s == sub })
+	last := len(h.subs[topic]) == 0
+	if last {
+		delete(h.subs, topic)
+	}
+	tailSubscribers.Dec()
+	h.mu.Unlock()
+
+	if unsubscribe, ok := h.busSubs[topic]; last && ok {
+		unsubscribe()
+		delete(h.busSubs, topic)
+	}
+}
+
+// publish hands entry to the subscribers of its logID on every replica
+// without blocking.
+func (h *tailHub) publish(entry batch.Entry) {
+	if h == nil {
+		return
+	}
+
+	if h.bus == nil {
+		h.deliver(entry)
+		return
+	}
+
+	if err := h.bus.publish(entry); err != nil {
+		slog.Error("can't share tailed entry", "kind", entry.Kind, "logID", entry.LogID, "err", err)
+		tailDroppedEntriesTotal.WithLabelValues(entry.Kind).Inc()
+	}
+}
+
+// deliver hands entry to the subscribers of its logID on this replica
+// without blocking.
+func (h *tailHub) deliver(entry batch.Entry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.subs[tailTopic(entry.Kind, entry.LogID)] {
+		select {
+		case sub.entries <- entry:
+		default:
+			sub.dropped.Add(1)
+			tailDroppedEntriesTotal.WithLabelValues(entry.Kind).Inc()
+		}
+	}
+}
+
+// tailReady is the data of the ready event a tail stream starts with.
+type tailReady struct {
+	// Replica is the hostname of the replica serving the stream.
+	Replica string `json:"replica"`
+
+	// AllReplicas is false when the stream only has the entries this
+	// replica accepts.
+	AllReplicas bool `json:"allReplicas"`
+}
+
+// Tail streams the entries of a logID as Server-Sent Events as they are
+// accepted, before they are batched. The stream starts with a ready event
+// saying whether it covers every replica. Each entry event carries the JSON
+// encoded batch.Entry. A dropped event reports the total number of entries
+// dropped so far because the client fell behind.
+func (s *Server) Tail(w http.ResponseWriter, r *http.Request) {
+	if s.tails == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !tokenAuthorized(r, s.tails.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	kind := r.PathValue("kind")
+	if !slices.Contains(knownKinds, kind) {
+		http.Error(w, fmt.Sprintf("unknown kind %q", kind), http.StatusBadRequest)
+		return
+	}
+
+	logID, err := alexandria.CanonicalLogID(r.PathValue("logID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sub, err := s.tails.subscribe(kind, logID)
+	if err != nil {
+		slog.Error("can't tail", "kind", kind, "logID", logID, "err", err)
+		http.Error(w, "can't subscribe to entries", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.tails.unsubscribe(kind, logID, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ready, _ := json.Marshal(tailReady{Replica: s.tails.replica, AllReplicas: s.tails.bus != nil})
+	fmt.Fprintf(w, "event: ready\ndata: %s\n\n", ready)
+	if err := rc.Flush(); err != nil {
+		slog.Error("can't stream tail", "err", err)
+		return
+	}
+
+	slog.Debug("tail client connected", "kind", kind, "logID", logID)
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	var reported int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case entry := <-sub.entries:
+			if dropped := sub.dropped.Load(); dropped != reported {
+				reported = dropped
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+				if err != nil {
+					return
+				}
+			}
+
+			var data []byte
+			data, err = json.Marshal(entry)
+			if err != nil {
+				slog.Error("can't encode tailed entry", "err", err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: entry\ndata: %s\n\n", entry.ID, data)
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readEvents calls fn with the type and data of every Server-Sent Event in
+// r until r ends or fn fails.
+func readEvents(r io.Reader, fn func(event, data string) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxTailEvent)
+
+	var event string
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if len(data) != 0 {
+				if err := fn(cmp.Or(event, "message"), strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	return sc.Err()
+}
+
+// runTail is the tail subcommand: it prints the lines of a logID as an
+// ingestion server accepts them.
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	server := fs.String("tail-url", "http://localhost:8989", "base URL of the ingestion server")
+	token := fs.String("tail-token", "", "token to authenticate to the server with")
+	asJSON := fs.Bool("json", false, "print entries as JSON instead of their lines")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: alexandria tail [flags] kind logID")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := flagenv.ParseSet("", fs); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("tail needs a kind and a logID")
+	}
+
+	u, err := url.JoinPath(*server, "tail", fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("can't parse -tail-url: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't connect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("can't tail: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	err = readEvents(resp.Body, func(event, data string) error {
+		return printTailEvent(os.Stdout, event, data, *asJSON)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		err = errors.New("server closed the stream")
+	}
+	return err
+}
+
+// printTailEvent writes the lines of an entry event to w, or the event's
+// data as is if asJSON is set. Dropped events, and ready events of streams
+// that only cover one replica, are logged.
+func printTailEvent(w io.Writer, event, data string, asJSON bool) error {
+	switch event {
+	case "ready":
+		var ready tailReady
+		if err := json.Unmarshal([]byte(data), &ready); err != nil {
+			return fmt.Errorf("can't decode ready event: %w", err)
+		}
+		if !ready.AllReplicas {
+			slog.Warn("only showing entries accepted by one replica; configure NATS on the server to see every replica", "replica", ready.Replica)
+		}
+	case "dropped":
+		slog.Warn("entries were dropped because the client fell behind", "data", data)
+	case "entry":
+		if asJSON {
+			_, err := fmt.Fprintln(w, data)
+			return err
+		}
+
+		var entry batch.Entry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return fmt.Errorf("can't decode entry: %w", err)
+		}
+
+		lines, err := entry.Lines()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if _, err := fmt.Fprintf(w, "%s\n", line.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TecharoHQ/alexandria/alexandria/batch"
+)
+
+func TestTailHub(t *testing.T) {
+	h := newTailHub("secret", 2)
+	sub, err := h.subscribe("techaro.anubis", "anubis_01jz4k5n8v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		h.publish(batch.Entry{ID: fmt.Sprint(i), Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"})
+	}
+	h.publish(batch.Entry{ID: "other", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8w"})
+	h.publish(batch.Entry{ID: "other", Kind: "techaro.thoth", LogID: "anubis_01jz4k5n8v"})
+
+	if got := len(sub.entries); got != 2 {
+		t.Errorf("expected 2 buffered entries, got %d", got)
+	}
+	if got := sub.dropped.Load(); got != 1 {
+		t.Errorf("expected 1 dropped entry, got %d", got)
+	}
+	if e := <-sub.entries; e.ID != "0" {
+		t.Errorf("expected entry 0 first, got %s", e.ID)
+	}
+
+	h.unsubscribe("techaro.anubis", "anubis_01jz4k5n8v", sub)
+	if len(h.subs) != 0 {
+		t.Errorf("expected no subscribers left, got %v", h.subs)
+	}
+	h.publish(batch.Entry{Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"})
+
+	var nilHub *tailHub
+	nilHub.publish(batch.Entry{})
+}
+
+// memTailBus is a tailBus shared by hubs in one process.
+type memTailBus struct {
+	subs map[*memTailSub]struct{}
+}
+
+type memTailSub struct {
+	topic   string
+	deliver func(batch.Entry)
+}
+
+func (mb *memTailBus) publish(entry batch.Entry) error {
+	for sub := range mb.subs {
+		if sub.topic == tailTopic(entry.Kind, entry.LogID) {
+			sub.deliver(entry)
+		}
+	}
+	return nil
+}
+
+func (mb *memTailBus) subscribe(kind, logID string, deliver func(batch.Entry)) (func(), error) {
+	sub := &memTailSub{topic: tailTopic(kind, logID), deliver: deliver}
+	mb.subs[sub] = struct{}{}
+	return func() { delete(mb.subs, sub) }, nil
+}
+
+func TestTailHub_Bus(t *testing.T) {
+	bus := &memTailBus{subs: map[*memTailSub]struct{}{}}
+	a, b := newTailHub("secret", 2), newTailHub("secret", 2)
+	a.bus, b.bus = bus, bus
+
+	subscribe := func(h *tailHub, logID string) *tailSubscriber {
+		t.Helper()
+		sub, err := h.subscribe("techaro.anubis", logID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+
+	subA := subscribe(a, "anubis_01jz4k5n8v")
+	subB := subscribe(b, "anubis_01jz4k5n8v")
+	subB2 := subscribe(b, "anubis_01jz4k5n8v")
+	subOther := subscribe(b, "anubis_01jz4k5n8w")
+	if len(bus.subs) != 3 {
+		t.Errorf("expected a bus subscription per hub and logID, got %d", len(bus.subs))
+	}
+
+	a.publish(batch.Entry{ID: "from-a", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"})
+	b.publish(batch.Entry{ID: "from-b", Kind: "techaro.anubis", LogID: "anubis_01jz4k5n8v"})
+
+	for name, sub := range map[string]*tailSubscriber{"a": subA, "b": subB, "b2": subB2} {
+		if got := len(sub.entries); got != 2 {
+			t.Errorf("%s: expected the entries of both replicas, got %d", name, got)
+		}
+	}
+	if got := len(subOther.entries); got != 0 {
+		t.Errorf("expected no entries for another logID, got %d", got)
+	}
+
+	a.unsubscribe("techaro.anubis", "anubis_01jz4k5n8v", subA)
+	b.unsubscribe("techaro.anubis", "anubis_01jz4k5n8v", subB)
+	if len(bus.subs) != 2 {
+		t.Errorf("expected the bus subscription to last until the last subscriber leaves, got %d", len(bus.subs))
+	}
+	b.unsubscribe("techaro.anubis", "anubis_01jz4k5n8v", subB2)
+	b.unsubscribe("techaro.anubis", "anubis_01jz4k5n8w", subOther)
+	if len(bus.subs) != 0 || len(b.busSubs) != 0 {
+		t.Errorf("expected no bus subscriptions left, got %d and %v", len(bus.subs), b.busSubs)
+	}
+}
+
+// failingTailBus is a tailBus that can't subscribe.
+type failingTailBus struct{}
+
+func (failingTailBus) publish(batch.Entry) error { return nil }
+
+func (failingTailBus) subscribe(string, string, func(batch.Entry)) (func(), error) {
+	return nil, errors.New("no connection")
+}
+
+func TestTailHub_BusError(t *testing.T) {
+	h := newTailHub("secret", 2)
+	h.bus = failingTailBus{}
+
+	if _, err := h.subscribe("techaro.anubis", "anubis_01jz4k5n8v"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(h.subs) != 0 || len(h.busSubs) != 0 {
+		t.Errorf("expected no subscribers left, got %v and %v", h.subs, h.busSubs)
+	}
+}
+
+func TestServer_Tail(t *testing.T) {
+	s := NewServer(nil, "bucket")
+	s.tails = newTailHub("secret", 8)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+tailPath, s.Tail)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path, token string
+		status      int
+	}{
+		{path: "/tail/techaro.anubis/anubis_01jz4k5n8v", status: http.StatusUnauthorized},
+		{path: "/tail/techaro.anubis/anubis_01jz4k5n8v", token: "wrong", status: http.StatusUnauthorized},
+		{path: "/tail/techaro.nope/anubis_01jz4k5n8v", token: "secret", status: http.StatusBadRequest},
+		{path: "/tail/techaro.anubis/nope", token: "secret", status: http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s with token %q: expected status %d, got %d", tt.path, tt.token, tt.status, resp.StatusCode)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/tail/techaro.anubis/anubis_01jz4k5n8v", nil)
+	req.SetBasicAuth("", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+
+	if err := s.uploadFor(ctx, "techaro.anubis", "anubis_01jz4k5n8w", nil, []byte("someone else\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.uploadFor(ctx, "techaro.anubis", "anubis_01jz4k5n8v", nil, []byte("first\nsecond\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	var ready tailReady
+	errDone := errors.New("done")
+	err = readEvents(resp.Body, func(event, data string) error {
+		if event == "ready" {
+			if err := json.Unmarshal([]byte(data), &ready); err != nil {
+				return err
+			}
+		}
+		if err := printTailEvent(&out, event, data, false); err != nil {
+			return err
+		}
+		if event == "entry" {
+			return errDone
+		}
+		return nil
+	})
+	if !errors.Is(err, errDone) {
+		t.Fatalf("expected an event, got %v", err)
+	}
+
+	if out.String() != "first\nsecond\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if ready.AllReplicas {
+		t.Error("expected a hub without a bus to say it only covers one replica")
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := `: heartbeat
+
+event: dropped
+data: {"dropped":3}
+
+data: one
+data: two
+
+id: 1
+event: entry
+data: {}
+`
+
+	var got []string
+	if err := readEvents(strings.NewReader(stream), func(event, data string) error {
+		got = append(got, event+"="+data)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last event isn't dispatched without its terminating blank line.
+	want := []string{`dropped={"dropped":3}`, "message=one\ntwo"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		wantErr       bool
+		expectedCalls int32
+	}{
+		{
+			name:          "ok",
+			statuses:      []int{http.StatusNoContent},
+			expectedCalls: 1,
+		},
+		{
+			name:          "retries server errors",
+			statuses:      []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK},
+			expectedCalls: 3,
+		},
+		{
+			name:          "gives up after attempts",
+			statuses:      []int{500, 500, 500, 500},
+			wantErr:       true,
+			expectedCalls: webhookAttempts,
+		},
+		{
+			name:          "client errors aren't retried",
+			statuses:      []int{http.StatusUnauthorized},
+			wantErr:       true,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+
+				body, _ := io.ReadAll(r.Body)
+				ts := r.Header.Get(webhookTimestampHeader)
+				if got, want := r.Header.Get(webhookSignatureHeader), signWebhook([]byte("hunter2"), ts, body); got != want {
+					t.Errorf("bad signature %q, want %q", got, want)
+				}
+				if got := r.Header.Get(webhookEventHeader); got != sinkEventBatch {
+					t.Errorf("expected event header %s, got %s", sinkEventBatch, got)
+				}
+
+				var ev sinkEvent
+				if err := json.Unmarshal(body, &ev); err != nil || ev.Batch == nil || ev.Batch.Key != "inp/techaro.anubis/batch-1.jsonl" {
+					t.Errorf("unexpected body %s: %v", body, err)
+				}
+
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			ws := newWebhookSink(srv.URL, "hunter2")
+			ws.backoff = time.Millisecond
+
+			err := ws.Publish(context.Background(), &sinkEvent{
+				Type:  sinkEventBatch,
+				Kind:  "techaro.anubis",
+				Batch: &batchRef{Key: "inp/techaro.anubis/batch-1.jsonl"},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+
+			if got := calls.Load(); got != tt.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tt.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Computed with: printf '1735689600.{}' | openssl dgst -sha256 -hmac hunter2
+	const want = "sha256=77ad9ebe897637e83ba1593e9e616b045a6e93ea277cc6b5cdfa79be89cbac8c"
+
+	got := signWebhook([]byte("hunter2"), "1735689600", []byte("{}"))
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if got == signWebhook([]byte("hunter3"), "1735689600", []byte("{}")) {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if got == signWebhook([]byte("hunter2"), "1735689601", []byte("{}")) {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}